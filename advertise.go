@@ -0,0 +1,259 @@
+/*
+ * VC5 load balancer. Copyright (C) 2021-present David Coles
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package cue
+
+import (
+	"errors"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/davidcoles/cue/bgp"
+)
+
+// When a VIP should be advertised.
+type VIPPolicy string
+
+const (
+	ADVERTISE_HEALTHY VIPPolicy = ""       // when the VIP is healthy according to the Director's thresholds (see VIPStatus)
+	ADVERTISE_ALL     VIPPolicy = "all"    // when all services on the VIP are up, critical or not
+	ADVERTISE_ANY     VIPPolicy = "any"    // when at least one service on the VIP is up
+	ADVERTISE_ALWAYS  VIPPolicy = "always" // whenever the VIP is configured, regardless of health
+)
+
+// Anything which advertises a set of addresses, such as *bgp.Pool.
+type Routes interface {
+	RIB([]netip.Addr)
+}
+
+// Keeps the routes advertised by a Routes (typically a *bgp.Pool) in
+// step with the health of the VIPs managed by a Director.
+type Advertiser struct {
+	Director *Director
+	Routes   Routes
+
+	HoldUp   time.Duration // a VIP must have been healthy for this long before it is advertised
+	HoldDown time.Duration // a VIP must have been unhealthy for this long before it is withdrawn
+	Grace    time.Duration // advertise all configured VIPs for this long after starting, regardless of health
+
+	// should not be changed after starting
+	Policy  map[netip.Addr]VIPPolicy // per-VIP policy
+	Default VIPPolicy                // policy for VIPs without an entry in Policy
+
+	mutex sync.Mutex
+	state map[netip.Addr]*vipState
+	rib   []netip.Addr
+	start time.Time
+	sub   *Subscription
+	done  chan bool
+}
+
+type vipState struct {
+	healthy    bool
+	since      time.Time // when healthy last changed
+	advertised bool
+}
+
+// Start tracking the Director. The current set of VIPs is advertised
+// immediately if a grace period is set.
+func (a *Advertiser) Start() error {
+
+	if a.Director == nil || a.Routes == nil {
+		return errors.New("Director and Routes must be set")
+	}
+
+	// events are only used as a trigger to re-read the status, so overflows don't matter
+	sub := a.Director.Subscribe(100)
+	done := make(chan bool)
+
+	a.mutex.Lock()
+	a.state = map[netip.Addr]*vipState{}
+	a.rib = nil
+	a.start = time.Now()
+	a.sub = sub
+	a.done = done
+	a.mutex.Unlock()
+
+	go a.background(sub, done)
+
+	return nil
+}
+
+// Stop tracking the Director. Routes are left as they are. It is safe
+// to call Stop if Start was not called or failed.
+func (a *Advertiser) Stop() {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.done != nil {
+		close(a.done)
+		a.sub.Unsubscribe()
+		a.done = nil
+		a.sub = nil
+	}
+}
+
+// The addresses currently being advertised.
+func (a *Advertiser) Advertised() []netip.Addr {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return append([]netip.Addr{}, a.rib...)
+}
+
+func (a *Advertiser) background(sub *Subscription, done chan bool) {
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case _, ok := <-sub.C:
+			if !ok {
+				return // director was stopped
+			}
+		case <-timer.C:
+		}
+
+		rib, next := a.evaluate(a.Director.Status(), a.Director.threshold(), time.Now())
+
+		a.mutex.Lock()
+		changed := bgp.AddrsDiffer(rib, a.rib)
+		a.rib = rib
+		a.mutex.Unlock()
+
+		if changed {
+			a.Routes.RIB(rib)
+		}
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+
+		if !next.IsZero() {
+			timer.Reset(time.Until(next))
+		}
+	}
+}
+
+func (a *Advertiser) policy(vip netip.Addr) VIPPolicy {
+	if p, ok := a.Policy[vip]; ok {
+		return p
+	}
+
+	return a.Default
+}
+
+func (p VIPPolicy) healthy(vip netip.Addr, services []Service, threshold Threshold) bool {
+	switch p {
+	case ADVERTISE_HEALTHY:
+		return vipHealth(vip, services, threshold).Healthy
+	case ADVERTISE_ALWAYS:
+		return true
+	case ADVERTISE_ANY:
+		for _, s := range services {
+			if s.Up {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, s := range services {
+		if !s.Up {
+			return false
+		}
+	}
+
+	return len(services) > 0
+}
+
+// Returns the VIPs to advertise, and the time at which the result may
+// next change due to a hold timer or the grace period expiring (zero
+// if no change is pending).
+func (a *Advertiser) evaluate(services []Service, thresholds map[netip.Addr]Threshold, now time.Time) (rib []netip.Addr, next time.Time) {
+
+	vips := map[netip.Addr][]Service{}
+
+	for _, s := range services {
+		vips[s.Address] = append(vips[s.Address], s)
+	}
+
+	a.mutex.Lock()
+	state := a.state
+	start := a.start
+	a.mutex.Unlock()
+
+	later := func(t time.Time) {
+		if t.After(now) && (next.IsZero() || t.Before(next)) {
+			next = t
+		}
+	}
+
+	grace := start.Add(a.Grace)
+	later(grace)
+
+	for vip, _ := range state {
+		if _, ok := vips[vip]; !ok {
+			delete(state, vip) // withdrawn immediately
+		}
+	}
+
+	for vip, list := range vips {
+		healthy := a.policy(vip).healthy(vip, list, thresholds[vip])
+
+		s, ok := state[vip]
+
+		if !ok {
+			s = &vipState{healthy: healthy, since: now}
+			state[vip] = s
+		}
+
+		if s.healthy != healthy {
+			s.healthy = healthy
+			s.since = now
+		}
+
+		hold := a.HoldDown
+		if healthy {
+			hold = a.HoldUp
+		}
+
+		if s.advertised != healthy {
+			if deadline := s.since.Add(hold); now.Before(deadline) {
+				later(deadline)
+			} else {
+				s.advertised = healthy
+			}
+		}
+
+		if s.advertised || now.Before(grace) {
+			rib = append(rib, vip)
+		}
+	}
+
+	sort.Slice(rib, func(i, j int) bool { return rib[i].Less(rib[j]) })
+
+	return
+}
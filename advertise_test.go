@@ -0,0 +1,169 @@
+/*
+ * VC5 load balancer. Copyright (C) 2021-present David Coles
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package cue
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/davidcoles/cue/bgp"
+)
+
+type routes chan []netip.Addr
+
+func (r routes) RIB(rib []netip.Addr) {
+	r <- rib
+}
+
+func TestAdvertiserEvaluate(t *testing.T) {
+	vip1 := netip.MustParseAddr("192.168.0.1")
+	vip2 := netip.MustParseAddr("192.168.0.2")
+	vip3 := netip.MustParseAddr("192.168.0.3")
+
+	t0 := time.Now()
+
+	a := &Advertiser{
+		HoldUp:   10 * time.Second,
+		HoldDown: 20 * time.Second,
+		Grace:    30 * time.Second,
+		Policy:   map[netip.Addr]VIPPolicy{vip2: ADVERTISE_ANY, vip3: ADVERTISE_ALWAYS},
+		state:    map[netip.Addr]*vipState{},
+		start:    t0,
+	}
+
+	services := func(up ...bool) (r []Service) {
+		for i, vip := range []netip.Addr{vip1, vip1, vip2, vip2, vip3} {
+			r = append(r, Service{Address: vip, Port: uint16(80 + i), Protocol: TCP, Up: up[i]})
+		}
+		return
+	}
+
+	check := func(at time.Duration, s []Service, want []netip.Addr, deadline time.Duration) {
+		t.Helper()
+
+		rib, next := a.evaluate(s, nil, t0.Add(at))
+
+		if bgp.AddrsDiffer(rib, want) {
+			t.Error(at, "Unexpected RIB:", rib, "expected", want)
+		}
+
+		if (deadline == 0 && !next.IsZero()) || (deadline != 0 && !next.Equal(t0.Add(deadline))) {
+			t.Error(at, "Unexpected deadline:", next.Sub(t0))
+		}
+	}
+
+	all := []netip.Addr{vip1, vip2, vip3}
+
+	// everything is advertised during the grace period
+	check(0, services(true, false, true, false, false), all, 10*time.Second)
+	check(10*time.Second, services(true, false, true, false, false), all, 30*time.Second)
+
+	// vip1 needs both services up, vip2 either, vip3 is always advertised
+	check(31*time.Second, services(true, false, true, false, false), []netip.Addr{vip2, vip3}, 0)
+
+	// vip2 fails, but is held down for 20 seconds
+	check(40*time.Second, services(true, false, false, false, false), []netip.Addr{vip2, vip3}, 60*time.Second)
+	check(60*time.Second, services(true, false, false, false, false), []netip.Addr{vip3}, 0)
+
+	// vip1 recovers, and is held up for 10 seconds
+	check(70*time.Second, services(true, true, false, false, false), []netip.Addr{vip3}, 80*time.Second)
+	check(80*time.Second, services(true, true, false, false, false), []netip.Addr{vip1, vip3}, 0)
+
+	// a flap shorter than the hold down time is not seen by peers
+	check(90*time.Second, services(false, true, false, false, false), []netip.Addr{vip1, vip3}, 110*time.Second)
+	check(95*time.Second, services(true, true, false, false, false), []netip.Addr{vip1, vip3}, 0)
+
+	// removed VIPs are withdrawn immediately
+	check(100*time.Second, services(true, true, false, false, false)[:2], []netip.Addr{vip1}, 0)
+}
+
+func TestAdvertiser(t *testing.T) {
+	d := &Director{Prober: prober(false)}
+
+	a := service("192.168.0.1", 80, "10.0.0.1")
+	b := service("192.168.0.1", 443, "10.0.0.1")
+
+	if err := d.Start([]Service{a}); err != nil {
+		t.Fatal(err)
+	}
+
+	defer d.Stop()
+
+	r := routes(make(chan []netip.Addr, 10))
+	x := &Advertiser{Director: d, Routes: r, Default: ADVERTISE_ANY}
+
+	if err := x.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	defer x.Stop()
+
+	wait := func(want ...netip.Addr) {
+		t.Helper()
+
+		select {
+		case rib := <-r:
+			if bgp.AddrsDiffer(rib, want) {
+				t.Error("Unexpected RIB:", rib, "expected", want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for RIB")
+		}
+	}
+
+	// destinations for a new service on an existing VIP start as healthy
+	if err := d.Configure([]Service{a, b}); err != nil {
+		t.Fatal(err)
+	}
+
+	wait(a.Address)
+
+	if err := d.Configure(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	wait()
+
+	if len(x.Advertised()) != 0 {
+		t.Error("Unexpected advertised VIPs:", x.Advertised())
+	}
+}
+
+func TestAdvertiserStop(t *testing.T) {
+	x := &Advertiser{}
+
+	x.Stop() // never started
+
+	if err := x.Start(); err == nil {
+		t.Error("Advertiser started without a Director")
+	}
+
+	x.Stop()
+
+	x.Director = &Director{}
+	x.Routes = routes(make(chan []netip.Addr, 10))
+
+	if err := x.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	x.Stop()
+	x.Stop()
+}
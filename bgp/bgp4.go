@@ -20,9 +20,11 @@
 
 // https://datatracker.ietf.org/doc/html/rfc4271 - A Border Gateway Protocol 4 (BGP-4)
 // https://datatracker.ietf.org/doc/html/rfc8203 - BGP Administrative Shutdown Communication
+// https://datatracker.ietf.org/doc/html/rfc9003 - Extended BGP Administrative Shutdown Communication
 // https://datatracker.ietf.org/doc/html/rfc4486 - Subcodes for BGP Cease Notification Message
 
 // https://datatracker.ietf.org/doc/html/rfc2918 - Route Refresh Capability for BGP-4
+// https://datatracker.ietf.org/doc/html/rfc8654 - Extended Message Support for BGP
 
 package bgp
 
@@ -37,10 +39,11 @@ func htons(h uint16) [2]byte {
 }
 
 const (
-	M_OPEN         = 1
-	M_UPDATE       = 2
-	M_NOTIFICATION = 3
-	M_KEEPALIVE    = 4
+	M_OPEN          = 1
+	M_UPDATE        = 2
+	M_NOTIFICATION  = 3
+	M_KEEPALIVE     = 4
+	M_ROUTE_REFRESH = 5 // [RFC2918]
 
 	IGP = 0
 	EGP = 1
@@ -49,7 +52,16 @@ const (
 	CAPABILITIES_OPTIONAL_PARAMETER = 2 // Capabilities Optional Parameter (Parameter Type 2)
 
 	// https://www.iana.org/assignments/capability-codes/capability-codes.xhtml
-	BGP4_MP = 1 //Multiprotocol Extensions for BGP-4
+	BGP4_MP          = 1  //Multiprotocol Extensions for BGP-4
+	ROUTE_REFRESH    = 2  // Route Refresh Capability for BGP-4 [RFC2918]
+	EXTENDED_MESSAGE = 6  // Extended Message Support for BGP [RFC8654]
+	AS4_CAPABILITY   = 65 // Support for 4-octet AS number capability [RFC6793]
+
+	AS_TRANS = 23456 // placeholder for a 4-octet AS number in 2-octet fields [RFC6793]
+
+	// Maximum message sizes, including the header
+	MAX_MESSAGE_LENGTH          = 4096
+	MAX_EXTENDED_MESSAGE_LENGTH = 65535
 
 	// Path attribute types
 	ORIGIN          = 1
@@ -60,6 +72,7 @@ const (
 	COMMUNITIES     = 8
 	MP_REACH_NLRI   = 14 // Multiprotocol Reachable NLRI - MP_REACH_NLRI (Type Code 14)
 	MP_UNREACH_NLRI = 15 // Multiprotocol Unreachable NLRI - MP_UNREACH_NLRI (Type Code 15)
+	AS4_PATH        = 17 // [RFC6793]
 
 	AS_SET      = 1
 	AS_SEQUENCE = 2
@@ -73,12 +86,29 @@ const (
 	CEASE                       = 6 // [RFC4271]
 	ROUTE_REFRESH_MESSAGE_ERROR = 7 // [RFC7313]
 
-	UNSUPPORTED_VERSION_NUMBER = 1 // OPEN_MESSAGE_ERROR
-	BAD_BGP_ID                 = 3 // OPEN_MESSAGE_ERROR
-	UNNACEPTABLE_HOLD_TIME     = 6 // OPEN_MESSAGE_ERROR
-	BAD_MESSAGE_TYPE           = 3 // MESSAGE_HEADER_ERROR
-	ADMINISTRATIVE_SHUTDOWN    = 2 // CEASE
-	OUT_OF_RESOURCES           = 8 // CEASE
+	UNSPECIFIC                     = 0  // any error code [RFC Errata 4493]
+	UNSUPPORTED_VERSION_NUMBER     = 1  // OPEN_MESSAGE_ERROR
+	BAD_PEER_AS                    = 2  // OPEN_MESSAGE_ERROR
+	BAD_BGP_ID                     = 3  // OPEN_MESSAGE_ERROR
+	UNSUPPORTED_OPTIONAL_PARAMETER = 4  // OPEN_MESSAGE_ERROR
+	UNNACEPTABLE_HOLD_TIME         = 6  // OPEN_MESSAGE_ERROR
+	CONNECTION_NOT_SYNCHRONIZED    = 1  // MESSAGE_HEADER_ERROR
+	BAD_MESSAGE_LENGTH             = 2  // MESSAGE_HEADER_ERROR
+	BAD_MESSAGE_TYPE               = 3  // MESSAGE_HEADER_ERROR
+	MALFORMED_ATTRIBUTE_LIST       = 1  // UPDATE_MESSAGE_ERROR
+	ATTRIBUTE_LENGTH_ERROR         = 5  // UPDATE_MESSAGE_ERROR
+	INVALID_ORIGIN_ATTRIBUTE       = 6  // UPDATE_MESSAGE_ERROR
+	OPTIONAL_ATTRIBUTE_ERROR       = 9  // UPDATE_MESSAGE_ERROR
+	INVALID_NETWORK_FIELD          = 10 // UPDATE_MESSAGE_ERROR
+	MALFORMED_AS_PATH              = 11 // UPDATE_MESSAGE_ERROR
+	INVALID_MESSAGE_LENGTH         = 1  // ROUTE_REFRESH_MESSAGE_ERROR [RFC7313]
+	UNEXPECTED_IN_OPEN_SENT        = 1  // FSM_ERROR [RFC6608]
+	UNEXPECTED_IN_OPEN_CONFIRM     = 2  // FSM_ERROR [RFC6608]
+	UNEXPECTED_IN_ESTABLISHED      = 3  // FSM_ERROR [RFC6608]
+	ADMINISTRATIVE_SHUTDOWN        = 2  // CEASE
+	ADMINISTRATIVE_RESET           = 4  // CEASE
+	OTHER_CONFIGURATION_CHANGE     = 6  // CEASE
+	OUT_OF_RESOURCES               = 8  // CEASE
 
 	// Optional/Well-known, Non-transitive/Transitive Complete/Partial Regular/Extended-length
 	// 128 64 32 16 8 4 2 1
@@ -226,7 +256,16 @@ func (n *notification) note() string {
 		s += "; " + sub
 	}
 
-	if len(n.data) > 0 {
+	if n.code == 0 {
+		// local errors carry a plain text description
+		if len(n.data) > 0 {
+			s += " (" + string(n.data) + ")"
+		}
+	} else if text, ok := n.communication(); ok {
+		if len(text) > 0 {
+			s += ` "` + text + `"`
+		}
+	} else if len(n.data) > 0 {
 		s += " " + fmt.Sprint(n.data)
 	}
 
@@ -0,0 +1,522 @@
+/*
+ * VC5 load balancer. Copyright (C) 2021-present David Coles
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+// Package bgptest provides a scriptable BGP speaker listening on a
+// loopback port, for exercising sessions in tests. Connections from a
+// Session are accepted with Peer.Accept, after which the test may
+// complete the OPEN exchange (Establish), inspect messages and routes
+// received, and inject NOTIFICATIONs or arbitrary malformed data.
+package bgptest
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/davidcoles/cue/bgp"
+)
+
+// A fake BGP speaker.
+type Peer struct {
+	ASNumber uint32
+	RouterID [4]byte
+	HoldTime uint16 // hold time offered in our OPEN (default 90)
+	Extended bool   // offer RFC 8654 extended messages
+	AS4      bool   // offer 4-octet AS numbers (implied if ASNumber is greater than 65535)
+	Silent   bool   // don't send KEEPALIVEs once established
+	Refresh  bool   // offer RFC 2918 route refresh
+
+	listener net.Listener
+	conns    chan *Conn
+}
+
+// Start a speaker on a random loopback port.
+func New(asn uint32, id [4]byte) (*Peer, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Peer{ASNumber: asn, RouterID: id, HoldTime: 90, listener: l, conns: make(chan *Conn, 10)}
+
+	go p.accept()
+
+	return p, nil
+}
+
+// The address to pass as the peer of a Session.
+func (p *Peer) Addr() string {
+	return p.listener.Addr().String()
+}
+
+func (p *Peer) Close() {
+	p.listener.Close()
+}
+
+func (p *Peer) accept() {
+	defer close(p.conns)
+
+	for {
+		c, err := p.listener.Accept()
+
+		if err != nil {
+			return
+		}
+
+		conn := &Conn{peer: p, conn: c, C: make(chan bgp.Message, 1000), rib: map[netip.Prefix]bool{}, done: make(chan bool)}
+
+		go conn.reader()
+
+		p.conns <- conn
+	}
+}
+
+// Wait for the next incoming connection.
+func (p *Peer) Accept(timeout time.Duration) (*Conn, error) {
+	select {
+	case c, ok := <-p.conns:
+		if !ok {
+			return nil, errors.New("Listener closed")
+		}
+		return c, nil
+	case <-time.After(timeout):
+		return nil, errors.New("Timed out waiting for connection")
+	}
+}
+
+// A connection accepted from a session.
+type Conn struct {
+	// Every message received, in order. Closed when the connection is.
+	C chan bgp.Message
+
+	peer  *Peer
+	conn  net.Conn
+	wmu   sync.Mutex
+	mutex sync.Mutex
+	rib   map[netip.Prefix]bool
+	err   error
+
+	// 4-octet AS number capability offered by the session/us - AS_PATH
+	// is decoded with 4 byte AS numbers if both are set
+	local, remote bool
+	done          chan bool
+}
+
+func (c *Conn) reader() {
+	defer close(c.C)
+	defer close(c.done)
+
+	buf := make([]byte, 0, 65536)
+	tmp := make([]byte, 65536)
+
+	for {
+		// process all complete messages in the buffer
+		for len(buf) >= 19 {
+			length := int(buf[16])<<8 | int(buf[17])
+
+			if length < 19 || len(buf) < length {
+				break
+			}
+
+			c.mutex.Lock()
+			d := bgp.Decoder{AS4: c.local && c.remote}
+			c.mutex.Unlock()
+
+			m, _, err := d.Decode(buf[:length])
+
+			if err != nil {
+				c.fail(err)
+				return
+			}
+
+			if m.Open != nil {
+				for _, x := range m.Open.Capabilities {
+					if x.Code == bgp.AS4_CAPABILITY {
+						c.mutex.Lock()
+						c.remote = true
+						c.mutex.Unlock()
+					}
+				}
+			}
+
+			if m.Update != nil {
+				advertised, withdrawn := m.Update.Routes()
+				c.mutex.Lock()
+				for _, p := range withdrawn {
+					delete(c.rib, p)
+				}
+				for _, p := range advertised {
+					c.rib[p] = true
+				}
+				c.mutex.Unlock()
+			}
+
+			c.C <- m
+			buf = buf[length:]
+		}
+
+		n, err := c.conn.Read(tmp)
+
+		if err != nil {
+			c.fail(err)
+			return
+		}
+
+		buf = append(buf, tmp[:n]...)
+	}
+}
+
+func (c *Conn) fail(err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.err == nil {
+		c.err = err
+	}
+	c.conn.Close()
+}
+
+// The error which caused the connection to close (io.EOF if the
+// session closed it cleanly), or nil if still open.
+func (c *Conn) Err() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.err
+}
+
+// Close the TCP connection without a NOTIFICATION.
+func (c *Conn) Close() {
+	c.fail(errors.New("Closed"))
+}
+
+// Wait for the session to close the connection.
+func (c *Conn) Closed(timeout time.Duration) bool {
+	select {
+	case <-c.done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// Routes received from the session on this connection, sorted.
+func (c *Conn) Routes() (r []netip.Prefix) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for p, _ := range c.rib {
+		r = append(r, p)
+	}
+
+	sort.Slice(r, func(i, j int) bool {
+		if c := r[i].Addr().Compare(r[j].Addr()); c != 0 {
+			return c < 0
+		}
+		return r[i].Bits() < r[j].Bits()
+	})
+
+	return r
+}
+
+// Send raw bytes - which need not be a valid message.
+func (c *Conn) Send(b []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	_, err := c.conn.Write(b)
+	return err
+}
+
+func (c *Conn) SendOpen(o Open) error {
+	c.mutex.Lock()
+	c.local = o.AS4 || o.ASNumber > 65535
+	c.mutex.Unlock()
+	return c.Send(o.Message())
+}
+
+func (c *Conn) SendKeepalive() error {
+	return c.Send(Message(bgp.M_KEEPALIVE, nil))
+}
+
+func (c *Conn) SendNotification(code, sub uint8, data []byte) error {
+	return c.Send(Message(bgp.M_NOTIFICATION, append([]byte{code, sub}, data...)))
+}
+
+// Wait for the next message from the session.
+func (c *Conn) Next(timeout time.Duration) (bgp.Message, error) {
+	select {
+	case m, ok := <-c.C:
+		if !ok {
+			if err := c.Err(); err != nil {
+				return m, err
+			}
+			return m, errors.New("Connection closed")
+		}
+		return m, nil
+	case <-time.After(timeout):
+		return bgp.Message{}, errors.New("Timed out waiting for message")
+	}
+}
+
+// Wait for a message of the given type, failing the test if the next
+// message is of a different type or none arrives in time.
+func (c *Conn) Expect(t testing.TB, typ uint8, timeout time.Duration) bgp.Message {
+	t.Helper()
+
+	m, err := c.Next(timeout)
+
+	if err != nil {
+		t.Fatalf("Expected %d message: %s", typ, err)
+	}
+
+	if m.Header.Type != typ {
+		t.Fatalf("Expected %d message, received %s: %+v", typ, m.Header.Name, m)
+	}
+
+	return m
+}
+
+// Wait for a message of the given type, discarding any others (eg.
+// KEEPALIVEs and UPDATEs) received first.
+func (c *Conn) WaitFor(t testing.TB, typ uint8, timeout time.Duration) bgp.Message {
+	t.Helper()
+
+	deadline := time.Now().Add(timeout)
+
+	for {
+		m, err := c.Next(time.Until(deadline))
+
+		if err != nil {
+			t.Fatalf("Expected %d message: %s", typ, err)
+		}
+
+		if m.Header.Type == typ {
+			return m
+		}
+	}
+}
+
+// Complete the OPEN exchange: receive the session's OPEN, reply with
+// ours and a KEEPALIVE, and wait for the KEEPALIVE confirming it. Unless
+// the peer is Silent, KEEPALIVEs are then sent periodically. The
+// session's OPEN is returned.
+func (c *Conn) Establish(t testing.TB) *bgp.Open {
+	t.Helper()
+
+	m := c.Expect(t, bgp.M_OPEN, 5*time.Second)
+
+	p := c.peer
+
+	o := Open{ASNumber: p.ASNumber, HoldTime: p.HoldTime, RouterID: p.RouterID, Extended: p.Extended, AS4: p.AS4, Multiprotocol: true}
+
+	if p.Refresh {
+		o.Capabilities = append(o.Capabilities, []byte{bgp.ROUTE_REFRESH, 0})
+	}
+
+	if err := c.SendOpen(o); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.SendKeepalive(); err != nil {
+		t.Fatal(err)
+	}
+
+	c.Expect(t, bgp.M_KEEPALIVE, 5*time.Second)
+
+	if !p.Silent {
+		go c.keepalives(m.Open.HoldTime, p.HoldTime)
+	}
+
+	return m.Open
+}
+
+func (c *Conn) keepalives(a, b uint16) {
+	hold := a
+	if b < a {
+		hold = b
+	}
+
+	if hold < 3 {
+		return
+	}
+
+	ticker := time.NewTicker(time.Duration(hold) * time.Second / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if c.SendKeepalive() != nil {
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// Wait until the routes received from the session match the list.
+func (c *Conn) WaitRoutes(t testing.TB, want []netip.Prefix, timeout time.Duration) {
+	t.Helper()
+
+	deadline := time.Now().Add(timeout)
+
+	for {
+		got := c.Routes()
+
+		if equal(got, want) {
+			return
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("Routes: got %v, want %v", got, want)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func equal(a, b []netip.Prefix) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Send an UPDATE advertising and/or withdrawing IPv4 prefixes, with
+// ORIGIN IGP, an AS_PATH of the peer's AS number and the peer's
+// router ID as the next hop.
+func (c *Conn) SendRoutes(advertised, withdrawn []netip.Prefix) error {
+	c.mutex.Lock()
+	as4 := c.local && c.remote
+	c.mutex.Unlock()
+
+	asn := c.peer.ASNumber
+	path := []byte{bgp.AS_SEQUENCE, 1, byte(asn >> 8), byte(asn)}
+
+	if as4 {
+		path = []byte{bgp.AS_SEQUENCE, 1, byte(asn >> 24), byte(asn >> 16), byte(asn >> 8), byte(asn)}
+	} else if asn > 65535 {
+		path = []byte{bgp.AS_SEQUENCE, 1, bgp.AS_TRANS >> 8, bgp.AS_TRANS & 0xff}
+	}
+
+	var attrs []byte
+
+	if len(advertised) > 0 {
+		id := c.peer.RouterID
+		attrs = append(attrs, 0x40, bgp.ORIGIN, 1, bgp.IGP)
+		attrs = append(attrs, 0x40, bgp.AS_PATH, byte(len(path)))
+		attrs = append(attrs, path...)
+		attrs = append(attrs, 0x40, bgp.NEXT_HOP, 4, id[0], id[1], id[2], id[3])
+	}
+
+	wd := nlri(withdrawn)
+	body := append([]byte{byte(len(wd) >> 8), byte(len(wd))}, wd...)
+	body = append(body, byte(len(attrs)>>8), byte(len(attrs)))
+	body = append(body, attrs...)
+	body = append(body, nlri(advertised)...)
+
+	return c.Send(Message(bgp.M_UPDATE, body))
+}
+
+func nlri(prefixes []netip.Prefix) (b []byte) {
+	for _, p := range prefixes {
+		a := p.Masked().Addr().As4()
+		n := (p.Bits() + 7) / 8
+		b = append(b, byte(p.Bits()))
+		b = append(b, a[:n]...)
+	}
+	return
+}
+
+// Parameters for an OPEN message sent by the peer.
+type Open struct {
+	Version       uint8  // default 4
+	ASNumber      uint32 // sent as AS_TRANS, with the 4-octet AS number capability, if greater than 65535
+	HoldTime      uint16
+	RouterID      [4]byte
+	Multiprotocol bool // IPv4 and IPv6 unicast
+	Extended      bool
+	AS4           bool     // 4-octet AS number capability
+	Capabilities  [][]byte // additional raw capabilities (code, length, value)
+}
+
+func (o Open) Message() []byte {
+	version := o.Version
+
+	if version == 0 {
+		version = 4
+	}
+
+	var caps []byte
+
+	if o.Multiprotocol {
+		caps = append(caps, bgp.BGP4_MP, 4, 0, 1, 0, 1)
+		caps = append(caps, bgp.BGP4_MP, 4, 0, 2, 0, 1)
+	}
+
+	if o.Extended {
+		caps = append(caps, bgp.EXTENDED_MESSAGE, 0)
+	}
+
+	asn := uint16(o.ASNumber)
+
+	if o.AS4 || o.ASNumber > 65535 {
+		a := o.ASNumber
+		caps = append(caps, bgp.AS4_CAPABILITY, 4, byte(a>>24), byte(a>>16), byte(a>>8), byte(a))
+
+		if o.ASNumber > 65535 {
+			asn = bgp.AS_TRANS
+		}
+	}
+
+	for _, c := range o.Capabilities {
+		caps = append(caps, c...)
+	}
+
+	body := []byte{version, byte(asn >> 8), byte(asn), byte(o.HoldTime >> 8), byte(o.HoldTime)}
+	body = append(body, o.RouterID[:]...)
+
+	if len(caps) > 0 {
+		body = append(body, byte(len(caps)+2), bgp.CAPABILITIES_OPTIONAL_PARAMETER, byte(len(caps)))
+		body = append(body, caps...)
+	} else {
+		body = append(body, 0)
+	}
+
+	return Message(bgp.M_OPEN, body)
+}
+
+// Frame a message body with the BGP header. The length field is
+// calculated from the body.
+func Message(typ uint8, body []byte) []byte {
+	l := 19 + len(body)
+	m := []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, byte(l >> 8), byte(l), typ}
+	return append(m, body...)
+}
@@ -0,0 +1,136 @@
+/*
+ * VC5 load balancer. Copyright (C) 2021-present David Coles
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package bgptest
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/davidcoles/cue/bgp"
+)
+
+func TestPoolPeers(t *testing.T) {
+	p := peer(t)
+
+	pool := bgp.NewPool(routerID, nil, []bgp.IP{{192, 168, 1, 1}}, nil)
+	defer pool.Close()
+
+	params := bgp.Parameters{ASNumber: 65000, HoldTime: 30, ConnectRetry: 1, IdleHoldTime: 1}
+
+	if err := pool.AddPeer("not-an-address", params); err != bgp.ErrInvalidPeer {
+		t.Error("Unexpected error:", err)
+	}
+
+	if err := pool.AddPeer(p.Addr(), bgp.Parameters{}); err == nil {
+		t.Error("Parameters without an AS number accepted")
+	}
+
+	if err := pool.AddPeer(p.Addr(), params); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := pool.AddPeer(p.Addr(), params); err != bgp.ErrPeerExists {
+		t.Error("Unexpected error:", err)
+	}
+
+	c, err := p.Accept(5 * time.Second)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.Establish(t)
+	c.WaitRoutes(t, prefixes("192.168.1.1/32"), 5*time.Second)
+
+	// MED can be changed without resetting the session
+	params.MED = 50
+
+	if reset, err := pool.UpdatePeer(p.Addr(), params); err != nil || reset {
+		t.Error("Unexpected result:", reset, err)
+	}
+
+	for med := uint32(0); med != 50; {
+		m := c.WaitFor(t, bgp.M_UPDATE, 5*time.Second)
+
+		if a, ok := m.Update.Attribute(bgp.MULTI_EXIT_DISC); ok {
+			med = *a.MED
+		}
+	}
+
+	// hold time is only negotiated at session start
+	params.HoldTime = 60
+
+	if reset, err := pool.UpdatePeer(p.Addr(), params); err != nil || !reset {
+		t.Error("Unexpected result:", reset, err)
+	}
+
+	m := c.WaitFor(t, bgp.M_NOTIFICATION, 5*time.Second)
+
+	if n := m.Notification; n.Code != bgp.CEASE || n.Subcode != bgp.OTHER_CONFIGURATION_CHANGE {
+		t.Error("Unexpected NOTIFICATION:", n)
+	}
+
+	c, err = p.Accept(5 * time.Second)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if o := c.Establish(t); o.HoldTime != 60 {
+		t.Error("Unexpected hold time:", o.HoldTime)
+	}
+
+	if peers := pool.Peers(); len(peers) != 1 || peers[p.Addr()].HoldTime != 60 {
+		t.Error("Unexpected peers:", peers)
+	}
+
+	if err := pool.RemovePeer(p.Addr(), "decommissioned"); err != nil {
+		t.Fatal(err)
+	}
+
+	m = c.WaitFor(t, bgp.M_NOTIFICATION, 5*time.Second)
+
+	if n := m.Notification; n.Code != bgp.CEASE || n.Subcode != bgp.ADMINISTRATIVE_SHUTDOWN || n.Communication != "decommissioned" {
+		t.Error("Unexpected NOTIFICATION:", n)
+	}
+
+	if err := pool.RemovePeer(p.Addr(), ""); err != bgp.ErrNoSuchPeer {
+		t.Error("Unexpected error:", err)
+	}
+
+	if peers := pool.Peers(); len(peers) != 0 {
+		t.Error("Unexpected peers:", peers)
+	}
+}
+
+func TestParameterChanges(t *testing.T) {
+	a := bgp.Parameters{ASNumber: 65000, HoldTime: 30, MED: 10}
+	b := bgp.Parameters{ASNumber: 65000, HoldTime: 60, MED: 20, Accept: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}}
+
+	reset, live := a.Changes(b)
+
+	if len(reset) != 1 || reset[0] != "hold_time" || len(live) != 2 || live[0] != "med" || live[1] != "accept" {
+		t.Error("Unexpected changes:", reset, live)
+	}
+
+	if reset, live := a.Changes(a); len(reset) != 0 || len(live) != 0 {
+		t.Error("Unexpected changes:", reset, live)
+	}
+}
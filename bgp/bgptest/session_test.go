@@ -0,0 +1,912 @@
+/*
+ * VC5 load balancer. Copyright (C) 2021-present David Coles
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package bgptest
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/davidcoles/cue/bgp"
+)
+
+var routerID = [4]byte{10, 0, 0, 1}
+
+func peer(t *testing.T) *Peer {
+	p, err := New(65001, [4]byte{10, 0, 0, 2})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(p.Close)
+
+	return p
+}
+
+func session(t *testing.T, p *Peer, params bgp.Parameters, rib ...string) *bgp.Session {
+	var r []netip.Addr
+
+	for _, a := range rib {
+		r = append(r, netip.MustParseAddr(a))
+	}
+
+	if params.ASNumber == 0 {
+		params.ASNumber = 65000
+	}
+
+	// retry quickly
+	params.ConnectRetry = 1
+	params.IdleHoldTime = 1
+
+	var s bgp.Session
+	s.Start(routerID, p.Addr(), params, r, nil)
+
+	return &s
+}
+
+type logger struct {
+	mutex    sync.Mutex
+	sessions []string
+}
+
+func (l *logger) BGPPeer(peer string, params bgp.Parameters, add bool) {}
+func (l *logger) BGPSession(peer string, local bool, reason string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.sessions = append(l.sessions, reason)
+}
+
+func (l *logger) wait(t *testing.T, text string) {
+	t.Helper()
+
+	for n := 0; n < 500; n++ {
+		l.mutex.Lock()
+		for _, s := range l.sessions {
+			if strings.Contains(s, text) {
+				l.mutex.Unlock()
+				return
+			}
+		}
+		l.mutex.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("No log message containing %q", text)
+}
+
+func prefixes(s ...string) (r []netip.Prefix) {
+	for _, p := range s {
+		r = append(r, netip.MustParsePrefix(p))
+	}
+	return
+}
+
+func waitState(t *testing.T, s *bgp.Session, state string) bgp.Status {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+
+	for {
+		status := s.Status()
+
+		if status.State == state {
+			return status
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected state %s, got %s (%s)", state, status.State, status.LastError)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestEstablishAndAdvertise(t *testing.T) {
+	p := peer(t)
+	s := session(t, p, bgp.Parameters{HoldTime: 30}, "192.168.1.1", "192.168.1.2")
+
+	c, err := p.Accept(5 * time.Second)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	o := c.Establish(t)
+
+	if o.ASNumber != 65000 || o.HoldTime != 30 || o.RouterID != netip.AddrFrom4(routerID) {
+		t.Error("Unexpected OPEN:", o)
+	}
+
+	status := waitState(t, s, bgp.ESTABLISHED)
+
+	if status.RemoteASN != 65001 || status.LocalASN != 65000 {
+		t.Error("Unexpected ASNs:", status)
+	}
+
+	var states []string
+
+	for _, h := range status.History {
+		states = append(states, h.To)
+	}
+
+	if strings.Join(states, " ") != "ACTIVE CONNECT OPEN_SENT OPEN_CONFIRM ESTABLISHED" {
+		t.Error("Unexpected transitions:", states)
+	}
+
+	c.WaitRoutes(t, prefixes("192.168.1.1/32", "192.168.1.2/32"), 5*time.Second)
+
+	s.LocRIB([]netip.Addr{netip.MustParseAddr("192.168.1.2"), netip.MustParseAddr("192.168.1.3")})
+
+	c.WaitRoutes(t, prefixes("192.168.1.2/32", "192.168.1.3/32"), 5*time.Second)
+
+	s.Close("maintenance")
+
+	m := c.WaitFor(t, bgp.M_NOTIFICATION, 5*time.Second)
+
+	if n := m.Notification; n.Code != bgp.CEASE || n.Subcode != bgp.ADMINISTRATIVE_SHUTDOWN || n.Communication != "maintenance" {
+		t.Error("Unexpected NOTIFICATION:", n)
+	}
+
+	if !c.Closed(5 * time.Second) {
+		t.Error("Connection not closed")
+	}
+}
+
+func TestExtendedMessage(t *testing.T) {
+	p := peer(t)
+	p.Extended = true
+
+	s := session(t, p, bgp.Parameters{})
+	defer s.Stop()
+
+	c, err := p.Accept(5 * time.Second)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.Establish(t)
+
+	if status := waitState(t, s, bgp.ESTABLISHED); !status.ExtendedMessage {
+		t.Error("Extended messages not negotiated")
+	}
+}
+
+func TestReceivedNotification(t *testing.T) {
+	p := peer(t)
+	s := session(t, p, bgp.Parameters{})
+	defer s.Stop()
+
+	c, err := p.Accept(5 * time.Second)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.Establish(t)
+	waitState(t, s, bgp.ESTABLISHED)
+
+	c.SendNotification(bgp.CEASE, bgp.ADMINISTRATIVE_RESET, nil)
+
+	status := waitState(t, s, bgp.IDLE)
+
+	if !strings.HasPrefix(status.LastError, "Received notification[6:4]") {
+		t.Error("Unexpected error:", status.LastError)
+	}
+
+	// the session should come back after the idle hold time
+	if c, err = p.Accept(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	c.Establish(t)
+	waitState(t, s, bgp.ESTABLISHED)
+}
+
+func TestReset(t *testing.T) {
+	p := peer(t)
+	s := session(t, p, bgp.Parameters{})
+	defer s.Stop()
+
+	c, err := p.Accept(5 * time.Second)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.Establish(t)
+	waitState(t, s, bgp.ESTABLISHED)
+
+	s.Reset()
+
+	m := c.WaitFor(t, bgp.M_NOTIFICATION, 5*time.Second)
+
+	if m.Notification.Code != bgp.CEASE || m.Notification.Subcode != bgp.ADMINISTRATIVE_RESET {
+		t.Error("Unexpected NOTIFICATION:", m.Notification)
+	}
+
+	if _, err := p.Accept(5 * time.Second); err != nil {
+		t.Error("No reconnection after reset:", err)
+	}
+}
+
+func TestHoldTimerExpired(t *testing.T) {
+	p := peer(t)
+	p.Silent = true
+	p.HoldTime = 3
+
+	s := session(t, p, bgp.Parameters{})
+	defer s.Stop()
+
+	c, err := p.Accept(5 * time.Second)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.Establish(t)
+	waitState(t, s, bgp.ESTABLISHED)
+
+	m := c.WaitFor(t, bgp.M_NOTIFICATION, 5*time.Second)
+
+	if m.Notification.Code != bgp.HOLD_TIMER_EXPIRED {
+		t.Error("Unexpected NOTIFICATION:", m.Notification)
+	}
+}
+
+// Protocol errors from the peer should each result in the session
+// sending a NOTIFICATION with the appropriate code and subcode, and
+// closing the connection
+func TestErrors(t *testing.T) {
+
+	open := func(hold uint16) []byte {
+		return Open{ASNumber: 65001, HoldTime: hold, RouterID: [4]byte{10, 0, 0, 2}}.Message()
+	}
+
+	keepalive := Message(bgp.M_KEEPALIVE, nil)
+	update := Message(bgp.M_UPDATE, []byte{0, 0, 0, 0})
+
+	marker := append([]byte{}, keepalive...)
+	marker[0] = 0
+
+	length := append([]byte{}, keepalive...)
+	length[17] = 18
+
+	for _, x := range []struct {
+		name      string
+		send      [][]byte
+		code, sub uint8
+	}{
+		{"bad marker", [][]byte{marker}, bgp.MESSAGE_HEADER_ERROR, bgp.CONNECTION_NOT_SYNCHRONIZED},
+		{"bad length", [][]byte{length}, bgp.MESSAGE_HEADER_ERROR, bgp.BAD_MESSAGE_LENGTH},
+		{"bad type", [][]byte{Message(99, nil)}, bgp.MESSAGE_HEADER_ERROR, bgp.BAD_MESSAGE_TYPE},
+		{"hold time", [][]byte{open(2)}, bgp.OPEN_MESSAGE_ERROR, bgp.UNNACEPTABLE_HOLD_TIME},
+		{"version", [][]byte{Open{Version: 3, ASNumber: 65001, HoldTime: 90, RouterID: [4]byte{10, 0, 0, 2}}.Message()}, bgp.OPEN_MESSAGE_ERROR, bgp.UNSUPPORTED_VERSION_NUMBER},
+		{"router id", [][]byte{Open{ASNumber: 65001, HoldTime: 90, RouterID: routerID}.Message()}, bgp.OPEN_MESSAGE_ERROR, bgp.BAD_BGP_ID},
+		{"peer AS", [][]byte{Open{ASNumber: 65002, HoldTime: 90, RouterID: [4]byte{10, 0, 0, 2}}.Message()}, bgp.OPEN_MESSAGE_ERROR, bgp.BAD_PEER_AS},
+		{"peer AS4", [][]byte{Open{ASNumber: 65001, AS4: true, Capabilities: [][]byte{{bgp.AS4_CAPABILITY, 4, 0, 1, 0, 1}}, HoldTime: 90, RouterID: [4]byte{10, 0, 0, 2}}.Message()}, bgp.OPEN_MESSAGE_ERROR, bgp.BAD_PEER_AS},
+		{"peer ID", [][]byte{Open{ASNumber: 65001, HoldTime: 90, RouterID: [4]byte{10, 0, 0, 3}}.Message()}, bgp.OPEN_MESSAGE_ERROR, bgp.BAD_BGP_ID},
+		{"short open", [][]byte{Message(bgp.M_OPEN, []byte{4, 0xfd, 0xe9, 0, 90})}, bgp.MESSAGE_HEADER_ERROR, bgp.BAD_MESSAGE_LENGTH},
+		{"malformed parameters", [][]byte{Message(bgp.M_OPEN, []byte{4, 0xfd, 0xe9, 0, 90, 10, 0, 0, 2, 4, 2, 9, 1})}, bgp.OPEN_MESSAGE_ERROR, bgp.UNSPECIFIC},
+		{"unsupported parameter", [][]byte{Message(bgp.M_OPEN, []byte{4, 0xfd, 0xe9, 0, 90, 10, 0, 0, 2, 3, 1, 1, 0})}, bgp.OPEN_MESSAGE_ERROR, bgp.UNSUPPORTED_OPTIONAL_PARAMETER},
+		{"keepalive in OpenSent", [][]byte{keepalive}, bgp.FSM_ERROR, bgp.UNEXPECTED_IN_OPEN_SENT},
+		{"update in OpenSent", [][]byte{update}, bgp.FSM_ERROR, bgp.UNEXPECTED_IN_OPEN_SENT},
+		{"open in OpenConfirm", [][]byte{open(90), open(90)}, bgp.FSM_ERROR, bgp.UNEXPECTED_IN_OPEN_CONFIRM},
+		{"update in OpenConfirm", [][]byte{open(90), update}, bgp.FSM_ERROR, bgp.UNEXPECTED_IN_OPEN_CONFIRM},
+		{"open in Established", [][]byte{open(90), keepalive, open(90)}, bgp.FSM_ERROR, bgp.UNEXPECTED_IN_ESTABLISHED},
+	} {
+		t.Run(x.name, func(t *testing.T) {
+			p := peer(t)
+			s := session(t, p, bgp.Parameters{PeerAS: 65001, PeerID: [4]byte{10, 0, 0, 2}})
+			defer s.Stop()
+
+			c, err := p.Accept(5 * time.Second)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c.Expect(t, bgp.M_OPEN, 5*time.Second)
+
+			for _, b := range x.send {
+				c.Send(b)
+			}
+
+			m := c.WaitFor(t, bgp.M_NOTIFICATION, 5*time.Second)
+
+			if m.Notification.Code != x.code || m.Notification.Subcode != x.sub {
+				t.Errorf("Expected NOTIFICATION %d:%d, got %d:%d", x.code, x.sub, m.Notification.Code, m.Notification.Subcode)
+			}
+
+			if !c.Closed(5 * time.Second) {
+				t.Error("Connection not closed")
+			}
+		})
+	}
+}
+
+// A peer with a 4-octet AS number sends AS_TRANS in its OPEN - the
+// session should check the real AS number from the capability, and
+// encode AS_PATH with 4-octet AS numbers
+func TestPeerAS4(t *testing.T) {
+	p := peer(t)
+	p.ASNumber = 4200000001
+
+	var l logger
+
+	var s bgp.Session
+	s.Start(routerID, p.Addr(), bgp.Parameters{ASNumber: 65000, PeerAS: 4200000001, PeerID: p.RouterID}, []netip.Addr{netip.MustParseAddr("192.168.1.1")}, &l)
+	defer s.Stop()
+
+	c, err := p.Accept(5 * time.Second)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	o := c.Establish(t)
+
+	if len(o.Capabilities) < 1 {
+		t.Fatal("No capabilities")
+	}
+
+	if status := waitState(t, &s, bgp.ESTABLISHED); status.RemoteASN != 4200000001 {
+		t.Error("Unexpected remote AS:", status.RemoteASN)
+	}
+
+	m := c.WaitFor(t, bgp.M_UPDATE, 5*time.Second)
+
+	a, ok := m.Update.Attribute(bgp.AS_PATH)
+
+	if !ok || len(a.ASPath) != 1 || len(a.ASPath[0].ASNs) != 1 || a.ASPath[0].ASNs[0] != 65000 {
+		t.Error("Unexpected AS_PATH:", a)
+	}
+
+	l.wait(t, "Peer verified: AS 4200000001, router ID 10.0.0.2")
+}
+
+func TestPeerASMismatch(t *testing.T) {
+	p := peer(t)
+
+	var l logger
+
+	var s bgp.Session
+	s.Start(routerID, p.Addr(), bgp.Parameters{ASNumber: 65000, PeerAS: 65002, ConnectRetry: 1, IdleHoldTime: 1}, nil, &l)
+	defer s.Stop()
+
+	c, err := p.Accept(5 * time.Second)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.Expect(t, bgp.M_OPEN, 5*time.Second)
+	c.SendOpen(Open{ASNumber: 65001, HoldTime: 90, RouterID: p.RouterID})
+
+	m := c.WaitFor(t, bgp.M_NOTIFICATION, 5*time.Second)
+
+	if m.Notification.Code != bgp.OPEN_MESSAGE_ERROR || m.Notification.Subcode != bgp.BAD_PEER_AS {
+		t.Error("Unexpected NOTIFICATION:", m.Notification)
+	}
+
+	l.wait(t, "Expected AS 65002, peer sent AS 65001")
+
+	if status := waitState(t, &s, bgp.IDLE); !strings.Contains(status.LastError, "Bad Peer AS") {
+		t.Error("Unexpected error:", status.LastError)
+	}
+}
+
+type recorder struct {
+	mutex  sync.Mutex
+	events []bgp.Event
+}
+
+func (r *recorder) BGPEvent(e bgp.Event) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.events = append(r.events, e)
+}
+
+// wait for an event matching the function, returning all events up to that point
+func (r *recorder) wait(t *testing.T, f func(bgp.Event) bool) []bgp.Event {
+	t.Helper()
+
+	for n := 0; n < 500; n++ {
+		r.mutex.Lock()
+		for i, e := range r.events {
+			if f(e) {
+				events := append([]bgp.Event{}, r.events[:i+1]...)
+				r.mutex.Unlock()
+				return events
+			}
+		}
+		r.mutex.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatal("Event not received")
+	return nil
+}
+
+func TestEvents(t *testing.T) {
+	p := peer(t)
+	p.HoldTime = 3
+	p.Silent = true
+
+	var r recorder
+
+	var s bgp.Session
+	s.Events(&r)
+	s.Start(routerID, p.Addr(), bgp.Parameters{ASNumber: 65000, ConnectRetry: 1, IdleHoldTime: 1}, []netip.Addr{netip.MustParseAddr("192.168.1.1")}, nil)
+	defer s.Stop()
+
+	c, err := p.Accept(5 * time.Second)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.Establish(t)
+
+	events := r.wait(t, func(e bgp.Event) bool { return e.Type == bgp.EVENT_UPDATE })
+
+	var states []string
+
+	for _, e := range events {
+		if e.Peer != p.Addr() {
+			t.Error("Unexpected peer:", e.Peer)
+		}
+
+		if e.Type == bgp.EVENT_STATE {
+			states = append(states, e.From+">"+e.To)
+		}
+	}
+
+	if events[0].Type != bgp.EVENT_TIMER || events[0].Timer != bgp.TIMER_CONNECT_RETRY {
+		t.Error("Unexpected first event:", events[0])
+	}
+
+	if strings.Join(states, " ") != "IDLE>ACTIVE ACTIVE>CONNECT CONNECT>OPEN_SENT OPEN_SENT>OPEN_CONFIRM OPEN_CONFIRM>ESTABLISHED" {
+		t.Error("Unexpected transitions:", states)
+	}
+
+	if u := events[len(events)-1]; len(u.Advertised) != 1 || u.Advertised[0] != netip.MustParsePrefix("192.168.1.1/32") || u.Messages != 1 {
+		t.Error("Unexpected update:", u)
+	}
+
+	s.LocRIB(nil)
+
+	r.wait(t, func(e bgp.Event) bool { return e.Type == bgp.EVENT_UPDATE && len(e.Withdrawn) == 1 })
+
+	// peer is silent - the hold timer should expire
+	r.wait(t, func(e bgp.Event) bool { return e.Type == bgp.EVENT_TIMER && e.Timer == bgp.TIMER_HOLD })
+
+	n := r.wait(t, func(e bgp.Event) bool { return e.Type == bgp.EVENT_NOTIFICATION })
+	x := n[len(n)-1]
+
+	if !x.Sent || x.Notification.Code != bgp.HOLD_TIMER_EXPIRED {
+		t.Error("Unexpected notification:", x)
+	}
+
+	r.wait(t, func(e bgp.Event) bool { return e.Type == bgp.EVENT_CLOSED && !e.Local })
+	r.wait(t, func(e bgp.Event) bool { return e.Type == bgp.EVENT_STATE && e.To == bgp.IDLE })
+}
+
+func TestConditionalAdvertisement(t *testing.T) {
+	p := peer(t)
+	def := prefixes("0.0.0.0/0")
+	conditions := []bgp.Condition{{Prefix: def[0]}}
+	s := session(t, p, bgp.Parameters{HoldTime: 30, Conditions: conditions}, "192.168.1.1")
+	defer s.Stop()
+
+	c, err := p.Accept(5 * time.Second)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.Establish(t)
+
+	if status := waitState(t, s, bgp.ESTABLISHED); len(c.Routes()) != 0 || status.ConditionsMet {
+		t.Error("Routes advertised without a default route:", c.Routes())
+	}
+
+	if err := c.SendRoutes(def, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	c.WaitRoutes(t, prefixes("192.168.1.1/32"), 5*time.Second)
+
+	if status := s.Status(); status.ReceivedPrefixes != 1 || !status.ConditionsMet {
+		t.Error("Unexpected status:", status)
+	}
+
+	if err := c.SendRoutes(nil, def); err != nil {
+		t.Fatal(err)
+	}
+
+	c.WaitRoutes(t, nil, 5*time.Second)
+
+	if status := s.Status(); status.ReceivedPrefixes != 0 || status.ConditionsMet {
+		t.Error("Unexpected status:", status)
+	}
+}
+
+func TestConditionalAdvertisementAbsent(t *testing.T) {
+	p := peer(t)
+	def := prefixes("0.0.0.0/0")
+	conditions := []bgp.Condition{{Prefix: def[0], Absent: true}}
+	s := session(t, p, bgp.Parameters{HoldTime: 30, Conditions: conditions}, "192.168.1.1")
+	defer s.Stop()
+
+	c, err := p.Accept(5 * time.Second)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.Establish(t)
+	c.WaitRoutes(t, prefixes("192.168.1.1/32"), 5*time.Second)
+
+	if err := c.SendRoutes(def, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	c.WaitRoutes(t, nil, 5*time.Second)
+}
+
+func TestConfigureReset(t *testing.T) {
+	p := peer(t)
+
+	var l logger
+
+	params := bgp.Parameters{ASNumber: 65000, HoldTime: 30, ConnectRetry: 1, IdleHoldTime: 1}
+
+	var s bgp.Session
+	s.Start(routerID, p.Addr(), params, nil, &l)
+	defer s.Stop()
+
+	c, err := p.Accept(5 * time.Second)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.Establish(t)
+	waitState(t, &s, bgp.ESTABLISHED)
+
+	// live change - no reset
+	params.MED = 50
+	s.Configure(params)
+
+	params.HoldTime = 60
+	s.Configure(params)
+
+	m := c.WaitFor(t, bgp.M_NOTIFICATION, 5*time.Second)
+
+	if n := m.Notification; n.Code != bgp.CEASE || n.Subcode != bgp.OTHER_CONFIGURATION_CHANGE {
+		t.Error("Unexpected NOTIFICATION:", n)
+	}
+
+	l.wait(t, "configuration changed: hold_time")
+
+	c, err = p.Accept(5 * time.Second)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if o := c.Establish(t); o.HoldTime != 60 {
+		t.Error("Unexpected hold time:", o.HoldTime)
+	}
+
+	if status := waitState(t, &s, bgp.ESTABLISHED); status.Reconfigured != 1 {
+		t.Error("Unexpected reset count:", status.Reconfigured)
+	}
+}
+
+func TestConnectRetry(t *testing.T) {
+	p := peer(t)
+	p.Close() // connections will be refused
+
+	s := session(t, p, bgp.Parameters{})
+	defer s.Stop()
+
+	status := waitState(t, s, bgp.IDLE)
+
+	for n := 0; status.NextRetry.IsZero() && n < 100; n++ {
+		time.Sleep(10 * time.Millisecond)
+		status = s.Status()
+	}
+
+	if status.LastError == "" {
+		t.Error("No error recorded for failed connection")
+	}
+
+	// ConnectRetry is 1s, jittered down by up to a quarter and rounded
+	if wait := time.Until(status.NextRetry); wait > 2*time.Second {
+		t.Error("Unexpected retry delay:", wait)
+	}
+
+	first := status.Attempts
+
+	time.Sleep(2500 * time.Millisecond)
+
+	if status = s.Status(); status.Attempts <= first {
+		t.Error("Connection not retried:", status.Attempts)
+	}
+}
+
+func TestMaxPrefixes(t *testing.T) {
+	for _, warn := range []bool{false, true} {
+		p := peer(t)
+		s := session(t, p, bgp.Parameters{MaxPrefixes: 2, MaxPrefixesWarn: warn}, "192.168.1.1", "192.168.1.2", "192.168.1.3")
+
+		c, err := p.Accept(5 * time.Second)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c.Establish(t)
+
+		if warn {
+			c.WaitRoutes(t, prefixes("192.168.1.1/32", "192.168.1.2/32", "192.168.1.3/32"), 5*time.Second)
+		} else {
+			c.WaitRoutes(t, prefixes("192.168.1.1/32", "192.168.1.2/32"), 5*time.Second)
+		}
+
+		status := s.Status()
+
+		if !status.LimitExceeded {
+			t.Error("Limit not reported:", warn)
+		}
+
+		if (warn && status.Suppressed != 0) || (!warn && status.Suppressed != 1) {
+			t.Error("Unexpected suppressed count:", warn, status.Suppressed)
+		}
+
+		s.Stop()
+	}
+}
+
+func TestMRAI(t *testing.T) {
+	p := peer(t)
+	s := session(t, p, bgp.Parameters{MRAI: 2}, "192.168.1.1")
+	defer s.Stop()
+
+	c, err := p.Accept(5 * time.Second)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.Establish(t)
+	c.WaitRoutes(t, prefixes("192.168.1.1/32"), 5*time.Second)
+
+	start := time.Now()
+
+	// the advertisement is held back by the MRAI timer ...
+	s.LocRIB([]netip.Addr{netip.MustParseAddr("192.168.1.1"), netip.MustParseAddr("192.168.1.2")})
+	time.Sleep(200 * time.Millisecond)
+
+	if r := c.Routes(); len(r) != 1 {
+		t.Error("Advertisement not batched:", r)
+	}
+
+	// ... but withdrawals are sent immediately
+	s.LocRIB([]netip.Addr{netip.MustParseAddr("192.168.1.2")})
+	c.WaitRoutes(t, nil, time.Second)
+
+	if time.Since(start) > time.Second {
+		t.Error("Withdrawal delayed by MRAI")
+	}
+
+	c.WaitRoutes(t, prefixes("192.168.1.2/32"), 5*time.Second)
+
+	if status := s.Status(); status.Batched < 2 {
+		t.Error("Unexpected batched count:", status.Batched)
+	}
+}
+
+func TestUpdateRate(t *testing.T) {
+	p := peer(t)
+
+	// different attributes for each prefix, so each is sent in a separate UPDATE
+	var policy bgp.Policy
+	for i, a := range prefixes("192.168.1.1/32", "192.168.1.2/32", "192.168.1.3/32", "192.168.1.4/32") {
+		policy = append(policy, bgp.Term{Match: bgp.Match{Prefixes: []netip.Prefix{a}}, Set: bgp.Set{MED: uint32(i + 1)}})
+	}
+
+	s := session(t, p, bgp.Parameters{UpdateRate: 2, Policy: policy}, "192.168.1.1", "192.168.1.2", "192.168.1.3", "192.168.1.4")
+	defer s.Stop()
+
+	c, err := p.Accept(5 * time.Second)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.Establish(t)
+	start := time.Now()
+	c.WaitFor(t, bgp.M_UPDATE, 5*time.Second)
+
+	// the Adj-RIB-Out is only reported once the UPDATEs have been sent
+	if status := s.Status(); status.Queued == 0 || len(status.AdjRIBOut) != 0 {
+		t.Error("Unexpected status while paced:", status.Queued, status.AdjRIBOut)
+	}
+
+	c.WaitRoutes(t, prefixes("192.168.1.1/32", "192.168.1.2/32", "192.168.1.3/32", "192.168.1.4/32"), 5*time.Second)
+
+	if took := time.Since(start); took < time.Second {
+		t.Error("UPDATEs not paced:", took)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	if status := s.Status(); status.Queued != 0 || len(status.AdjRIBOut) != 4 {
+		t.Error("Unexpected status after pacing:", status.Queued, status.AdjRIBOut)
+	}
+}
+
+func TestMRT(t *testing.T) {
+	p := peer(t)
+	path := filepath.Join(t.TempDir(), "bgp.mrt")
+
+	m, err := bgp.NewMRT(path, 0, 0)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// attached before starting, so that the OPEN messages are recorded
+	var s bgp.Session
+	s.MRT(m)
+	s.Start(routerID, p.Addr(), bgp.Parameters{ASNumber: 65000}, nil, nil)
+
+	c, err := p.Accept(5 * time.Second)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.Establish(t)
+	waitState(t, &s, bgp.ESTABLISHED)
+	s.Stop()
+	c.Closed(5 * time.Second)
+	m.Close()
+
+	f, err := os.Open(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer f.Close()
+
+	var sent, received bool
+
+	for r := bgp.NewMRTReader(f); ; {
+		rec, err := r.Next()
+
+		if err != nil {
+			break
+		}
+
+		if msg, err := rec.Decode(); err == nil && msg.Open != nil {
+			if rec.Sent {
+				sent = true
+			} else {
+				received = true
+			}
+		}
+	}
+
+	if !sent || !received {
+		t.Error("OPEN messages not recorded:", sent, received)
+	}
+}
+
+// An UPDATE which cannot be decoded is ignored rather than resetting the session
+func TestMalformedUpdate(t *testing.T) {
+	p := peer(t)
+	def := prefixes("0.0.0.0/0")
+	s := session(t, p, bgp.Parameters{Conditions: []bgp.Condition{{Prefix: def[0]}}}, "192.168.1.1")
+	defer s.Stop()
+
+	c, err := p.Accept(5 * time.Second)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.Establish(t)
+	waitState(t, s, bgp.ESTABLISHED)
+
+	// ORIGIN attribute with a bad length
+	c.Send(Message(bgp.M_UPDATE, []byte{0, 0, 0, 5, 0x40, bgp.ORIGIN, 2, 0, 0}))
+
+	if err := c.SendRoutes(def, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	c.WaitRoutes(t, prefixes("192.168.1.1/32"), 5*time.Second)
+
+	if status := s.Status(); status.State != bgp.ESTABLISHED || status.MalformedUpdates != 1 {
+		t.Error("Unexpected status:", status.State, status.MalformedUpdates)
+	}
+}
+
+// Received routes are only kept while conditions refer to them - when a
+// condition is added the peer is asked to send its routes again
+func TestRouteRefresh(t *testing.T) {
+	p := peer(t)
+	p.Refresh = true
+
+	def := prefixes("0.0.0.0/0")
+	params := bgp.Parameters{ASNumber: 65000, ConnectRetry: 1, IdleHoldTime: 1}
+
+	var s bgp.Session
+	s.Start(routerID, p.Addr(), params, []netip.Addr{netip.MustParseAddr("192.168.1.1")}, nil)
+	defer s.Stop()
+
+	c, err := p.Accept(5 * time.Second)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.Establish(t)
+	c.WaitRoutes(t, prefixes("192.168.1.1/32"), 5*time.Second)
+
+	if err := c.SendRoutes(def, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	if status := s.Status(); status.ReceivedPrefixes != 0 {
+		t.Error("Routes kept without conditions:", status.ReceivedPrefixes)
+	}
+
+	params.Conditions = []bgp.Condition{{Prefix: def[0]}}
+	s.Configure(params)
+
+	// the default route was discarded, so the VIP is withdrawn until it is re-sent
+	m := c.WaitFor(t, bgp.M_ROUTE_REFRESH, 5*time.Second)
+
+	if r := m.RouteRefresh; r == nil || r.AFI != 1 || r.SAFI != 1 {
+		t.Error("Unexpected ROUTE-REFRESH:", r)
+	}
+
+	if err := c.SendRoutes(def, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	c.WaitRoutes(t, prefixes("192.168.1.1/32"), 5*time.Second)
+
+	if status := s.Status(); status.ReceivedPrefixes != 1 || !status.ConditionsMet {
+		t.Error("Unexpected status:", status.ReceivedPrefixes, status.ConditionsMet)
+	}
+}
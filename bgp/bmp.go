@@ -0,0 +1,405 @@
+/*
+ * VC5 load balancer. Copyright (C) 2021-present David Coles
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+// https://datatracker.ietf.org/doc/html/rfc7854 - BGP Monitoring Protocol (BMP)
+// https://datatracker.ietf.org/doc/html/rfc8671 - Support for Adj-RIB-Out in the BGP Monitoring Protocol (BMP)
+
+package bgp
+
+import (
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	BMP_VERSION = 3
+
+	// message types
+	BMP_ROUTE_MONITORING = 0
+	BMP_STATISTICS       = 1
+	BMP_PEER_DOWN        = 2
+	BMP_PEER_UP          = 3
+	BMP_INITIATION       = 4
+	BMP_TERMINATION      = 5
+
+	// per-peer header flags
+	BMP_PEER_V = 0x80 // IPv6 peer address
+	BMP_PEER_L = 0x40 // post-policy
+	BMP_PEER_A = 0x20 // legacy 2-byte AS_PATH format
+	BMP_PEER_O = 0x10 // Adj-RIB-Out [RFC8671]
+
+	// peer down reasons
+	BMP_LOCAL_NOTIFICATION  = 1
+	BMP_LOCAL_NO_DATA       = 2
+	BMP_REMOTE_NOTIFICATION = 3
+	BMP_REMOTE_NO_DATA      = 4
+
+	// initiation/termination information TLVs
+	BMP_INFO_STRING   = 0
+	BMP_INFO_SYSDESCR = 1
+	BMP_INFO_SYSNAME  = 2
+	BMP_INFO_REASON   = 1 // termination
+
+	// statistics types
+	BMP_STAT_ADJ_RIB_OUT_PRE  = 14 // [RFC8671]
+	BMP_STAT_ADJ_RIB_OUT_POST = 15 // [RFC8671]
+)
+
+type bmppeer struct {
+	info  peerinfo
+	up    []byte // Peer Up message, replayed on reconnection to the collector
+	tmpl  advert
+	rib   map[netip.Addr]bool
+	total int // size of the RIB before export filtering
+}
+
+// A BMP client which streams the activity of sessions to a collector.
+// Peer Up/Down, Route Monitoring (post-policy Adj-RIB-Out) and
+// periodic Statistics Reports are sent. If the connection to the
+// collector fails then it is retried, and the current state of all
+// established sessions is replayed when it succeeds.
+type BMP struct {
+	mutex  sync.Mutex
+	peers  map[string]*bmppeer
+	out    chan []byte
+	resync bool
+	done   chan bool
+	exit   chan bool
+
+	name  string
+	descr string
+	stats time.Duration
+}
+
+// Start a BMP client which connects to the collector (host:port). If
+// name is empty then the system's hostname is used as the sysName.
+// Statistics Reports are sent at the given interval (default 60s).
+func NewBMP(collector string, name string, stats time.Duration) *BMP {
+
+	if name == "" {
+		name, _ = os.Hostname()
+	}
+
+	if stats <= 0 {
+		stats = 60 * time.Second
+	}
+
+	b := &BMP{
+		peers: map[string]*bmppeer{},
+		out:   make(chan []byte, 1000),
+		done:  make(chan bool),
+		exit:  make(chan bool),
+		name:  name,
+		descr: "github.com/davidcoles/cue/bgp",
+		stats: stats,
+	}
+
+	go b.run(collector)
+
+	return b
+}
+
+// Send a Termination message to the collector and close the connection.
+func (b *BMP) Close() {
+	close(b.done)
+	<-b.exit
+}
+
+func (b *BMP) run(collector string) {
+	defer close(b.exit)
+
+	retry := time.NewTimer(0)
+	defer retry.Stop()
+
+	for {
+		select {
+		case <-b.done:
+			return
+		case <-retry.C:
+		}
+
+		conn, err := net.DialTimeout("tcp", collector, 10*time.Second)
+
+		if err == nil {
+			if b.connected(conn) {
+				return
+			}
+		}
+
+		retry.Reset(30 * time.Second)
+	}
+}
+
+// returns true if the client has been closed
+func (b *BMP) connected(conn net.Conn) bool {
+	defer conn.Close()
+
+	write := func(m []byte) bool {
+		conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		_, err := conn.Write(m)
+		return err == nil
+	}
+
+	b.mutex.Lock()
+
+	// anything queued while disconnected is superseded by the replay
+	for len(b.out) > 0 {
+		<-b.out
+	}
+
+	b.resync = false
+
+	replay := [][]byte{b.initiation()}
+
+	for _, p := range b.peers {
+		replay = append(replay, p.up)
+		replay = append(replay, b.routes(p, p.rib)...)
+	}
+
+	b.mutex.Unlock()
+
+	for _, m := range replay {
+		if !write(m) {
+			return false
+		}
+	}
+
+	ticker := time.NewTicker(b.stats)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.done:
+			write(b.termination())
+			return true
+
+		case m := <-b.out:
+			if !write(m) {
+				return false
+			}
+
+			b.mutex.Lock()
+			resync := b.resync
+			b.mutex.Unlock()
+
+			if resync {
+				return false // messages were dropped - reconnect and replay the current state
+			}
+
+		case <-ticker.C:
+			b.mutex.Lock()
+			var stats [][]byte
+			for _, p := range b.peers {
+				stats = append(stats, b.statistics(p))
+			}
+			b.mutex.Unlock()
+
+			for _, m := range stats {
+				if !write(m) {
+					return false
+				}
+			}
+		}
+	}
+}
+
+// must be called with the mutex held
+func (b *BMP) send(m ...[]byte) {
+	for _, x := range m {
+		select {
+		case b.out <- x:
+		default:
+			b.resync = true
+		}
+	}
+}
+
+func (b *BMP) established(p peerinfo, sent, received pdu) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	peer := &bmppeer{info: p, rib: map[netip.Addr]bool{}}
+	peer.up = b.peerUp(p, sent, received)
+	b.peers[p.peer] = peer
+	b.send(peer.up)
+}
+
+func (b *BMP) advertised(p peerinfo, a advert, nlri map[netip.Addr]bool, total int) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	peer, ok := b.peers[p.peer]
+
+	if !ok {
+		return
+	}
+
+	for k, v := range nlri {
+		if v {
+			peer.rib[k] = true
+		} else {
+			delete(peer.rib, k)
+		}
+	}
+
+	peer.tmpl = a
+	peer.total = total
+
+	b.send(b.routes(peer, nlri)...)
+}
+
+func (b *BMP) closed(p peerinfo, n notification, received bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if _, ok := b.peers[p.peer]; !ok {
+		return
+	}
+
+	delete(b.peers, p.peer)
+	b.send(b.peerDown(p, n, received))
+}
+
+func (b *BMP) message(peerinfo, pdu, bool) {}
+
+func bmpMessage(t byte, body ...[]byte) (m []byte) {
+	var l int
+	for _, b := range body {
+		l += len(b)
+	}
+
+	l += 6
+	m = []byte{BMP_VERSION, byte(l >> 24), byte(l >> 16), byte(l >> 8), byte(l), t}
+
+	for _, b := range body {
+		m = append(m, b...)
+	}
+
+	return m
+}
+
+func bmpTLV(t uint16, v []byte) []byte {
+	tl := htons(t)
+	ll := htons(uint16(len(v)))
+	return append([]byte{tl[0], tl[1], ll[0], ll[1]}, v...)
+}
+
+// IPv4 addresses are stored in the last four bytes of the 16 byte field
+func bmpAddr(a netip.Addr) []byte {
+	var r [16]byte
+	if a.Is4() {
+		ip := a.As4()
+		copy(r[12:], ip[:])
+	} else if a.Is6() {
+		r = a.As16()
+	}
+	return r[:]
+}
+
+func (b *BMP) peerHeader(p peerinfo, flags byte) []byte {
+
+	if p.remote.Addr().Is6() && !p.remote.Addr().Is4In6() {
+		flags |= BMP_PEER_V
+	}
+
+	now := time.Now()
+	as := htonl(uint32(p.remoteASN))
+	sec := htonl(uint32(now.Unix()))
+	usec := htonl(uint32(now.Nanosecond() / 1000))
+
+	h := []byte{0, flags, 0, 0, 0, 0, 0, 0, 0, 0} // global instance peer, flags, peer distinguisher
+	h = append(h, bmpAddr(p.remote.Addr().Unmap())...)
+	h = append(h, as[:]...)
+	h = append(h, p.remoteID[:]...)
+	h = append(h, sec[:]...)
+	h = append(h, usec[:]...)
+
+	return h
+}
+
+func (b *BMP) initiation() []byte {
+	return bmpMessage(BMP_INITIATION, bmpTLV(BMP_INFO_SYSDESCR, []byte(b.descr)), bmpTLV(BMP_INFO_SYSNAME, []byte(b.name)))
+}
+
+func (b *BMP) termination() []byte {
+	return bmpMessage(BMP_TERMINATION, bmpTLV(BMP_INFO_REASON, []byte{0, 0})) // administratively closed
+}
+
+func (b *BMP) peerUp(p peerinfo, sent, received pdu) []byte {
+	lp := htons(p.local.Port())
+	rp := htons(p.remote.Port())
+	ports := []byte{lp[0], lp[1], rp[0], rp[1]}
+	return bmpMessage(BMP_PEER_UP, b.peerHeader(p, 0), bmpAddr(p.local.Addr().Unmap()), ports, sent, received)
+}
+
+func (b *BMP) peerDown(p peerinfo, n notification, received bool) []byte {
+
+	var reason []byte
+
+	switch {
+	case n.code == 0 && n.sub == REMOTE_SHUTDOWN:
+		reason = []byte{BMP_REMOTE_NO_DATA}
+	case n.code == 0:
+		reason = []byte{BMP_LOCAL_NO_DATA, 0, 0} // FSM event code not available
+	case received:
+		reason = append([]byte{BMP_REMOTE_NOTIFICATION}, frame(M_NOTIFICATION, n.message())...)
+	default:
+		reason = append([]byte{BMP_LOCAL_NOTIFICATION}, frame(M_NOTIFICATION, n.message())...)
+	}
+
+	return bmpMessage(BMP_PEER_DOWN, b.peerHeader(p, 0), reason)
+}
+
+// Route Monitoring messages for the post-policy Adj-RIB-Out (RFC 8671)
+func (b *BMP) routes(p *bmppeer, nlri map[netip.Addr]bool) (r [][]byte) {
+
+	if len(nlri) < 1 {
+		return nil
+	}
+
+	flags := byte(BMP_PEER_L | BMP_PEER_O)
+
+	if !p.info.as4 {
+		flags |= BMP_PEER_A
+	}
+
+	header := b.peerHeader(p.info, flags)
+
+	for _, m := range p.tmpl.updates(nlri, MAX_MESSAGE_LENGTH) {
+		r = append(r, bmpMessage(BMP_ROUTE_MONITORING, header, frame(m.Type(), m.Body())))
+	}
+
+	return r
+}
+
+func (b *BMP) statistics(p *bmppeer) []byte {
+
+	gauge := func(t uint16, v uint64) []byte {
+		h, l := htonl(uint32(v>>32)), htonl(uint32(v))
+		return bmpTLV(t, append(h[:], l[:]...))
+	}
+
+	count := htonl(2)
+
+	return bmpMessage(BMP_STATISTICS, b.peerHeader(p.info, 0), count[:],
+		gauge(BMP_STAT_ADJ_RIB_OUT_PRE, uint64(p.total)),
+		gauge(BMP_STAT_ADJ_RIB_OUT_POST, uint64(len(p.rib))))
+}
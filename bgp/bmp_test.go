@@ -0,0 +1,130 @@
+/*
+ * VC5 load balancer. Copyright (C) 2021-present David Coles
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package bgp
+
+import (
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestBMP(t *testing.T) {
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer l.Close()
+
+	b := NewBMP(l.Addr().String(), "test", time.Hour)
+
+	l.(*net.TCPListener).SetDeadline(time.Now().Add(5 * time.Second))
+
+	conn, err := l.Accept()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	read := func() (byte, []byte) {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+		var h [6]byte
+		if _, err := io.ReadFull(conn, h[:]); err != nil {
+			t.Fatal(err)
+		}
+
+		if h[0] != BMP_VERSION {
+			t.Fatal("Bad BMP version", h[0])
+		}
+
+		l := int(h[1])<<24 | int(h[2])<<16 | int(h[3])<<8 | int(h[4])
+		body := make([]byte, l-6)
+
+		if _, err := io.ReadFull(conn, body); err != nil {
+			t.Fatal(err)
+		}
+
+		return h[5], body
+	}
+
+	if typ, _ := read(); typ != BMP_INITIATION {
+		t.Fatal("Expected initiation", typ)
+	}
+
+	p := peerinfo{
+		peer:      "10.0.0.1",
+		local:     netip.MustParseAddrPort("10.0.0.2:54321"),
+		remote:    netip.MustParseAddrPort("10.0.0.1:179"),
+		localASN:  65001,
+		remoteASN: 65000,
+		remoteID:  IP{10, 0, 0, 1},
+	}
+
+	o := open{asNumber: 65001, holdTime: 10, routerID: IP{10, 0, 0, 2}}
+	sent := frame(M_OPEN, o.message())
+
+	b.established(p, sent, sent)
+
+	typ, body := read()
+
+	if typ != BMP_PEER_UP {
+		t.Fatal("Expected peer up", typ)
+	}
+
+	// per-peer header (42), local address (16), local port, remote port, sent OPEN, received OPEN
+	if len(body) != 42+16+4+2*len(sent) {
+		t.Fatal("Peer up has unexpected length", len(body))
+	}
+
+	if addr, _ := netip.AddrFromSlice(body[10:26]); body[1]&BMP_PEER_V != 0 || addr != netip.MustParseAddr("::10.0.0.1") {
+		t.Error("Peer address incorrectly encoded", body[:42])
+	}
+
+	a := advert{ASNumber: 65001}
+	b.advertised(p, a.withParameters(Parameters{}, 65000), map[netip.Addr]bool{netip.MustParseAddr("192.168.101.1"): true}, 1)
+
+	typ, body = read()
+
+	if typ != BMP_ROUTE_MONITORING {
+		t.Fatal("Expected route monitoring", typ)
+	}
+
+	if body[1] != BMP_PEER_L|BMP_PEER_A|BMP_PEER_O || body[42+18] != M_UPDATE {
+		t.Error("Route monitoring message incorrectly encoded", body)
+	}
+
+	b.closed(p, notification{code: HOLD_TIMER_EXPIRED}, false)
+
+	if typ, body = read(); typ != BMP_PEER_DOWN || body[42] != BMP_LOCAL_NOTIFICATION {
+		t.Fatal("Expected peer down", typ)
+	}
+
+	b.Close()
+
+	if typ, _ = read(); typ != BMP_TERMINATION {
+		t.Fatal("Expected termination", typ)
+	}
+}
@@ -0,0 +1,173 @@
+/*
+ * VC5 load balancer. Copyright (C) 2021-present David Coles
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package bgp
+
+import (
+	"net/netip"
+	"sync"
+)
+
+// A condition for advertising prefixes to a peer, based on the routes
+// received from this or another peer (the Adj-RIB-In). For example,
+// only advertise VIPs while the upstream router is sending a default
+// route.
+type Condition struct {
+	Prefix netip.Prefix `json:"prefix"`           // exact prefix which must have been received, eg. 0.0.0.0/0
+	Absent bool         `json:"absent,omitempty"` // the condition is met only if the prefix has NOT been received
+	Peer   string       `json:"peer,omitempty"`   // peer (as configured in a pool) to check - this session's peer if empty
+}
+
+// Returns true if any conditions refer to the routes received from the peer.
+func (p *Parameters) watches(peer string) bool {
+	for _, c := range p.Conditions {
+		if c.Peer == "" || c.Peer == peer {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if all of the conditions are met - if any are not then
+// no prefixes should be advertised to the peer.
+func (p *Parameters) conditionsMet(peer string, a *adjRIBsIn) bool {
+	for _, c := range p.Conditions {
+		from := c.Peer
+
+		if from == "" {
+			from = peer
+		}
+
+		if a.has(from, c.Prefix) == c.Absent {
+			return false
+		}
+	}
+
+	return true
+}
+
+// The routes received from each peer, which may be shared between the
+// sessions in a pool. C is signalled (without blocking) when any
+// routes, or the peers which conditions refer to, change. Routes are
+// only kept for peers which conditions refer to.
+type adjRIBsIn struct {
+	C     chan bool
+	mutex sync.Mutex
+	rib   map[string]map[netip.Prefix]bool
+	peers map[string]bool // peers referred to by the conditions of other sessions in a pool
+}
+
+// Record which peers are referred to by conditions in the pool's configuration.
+func (a *adjRIBsIn) watch(config map[string]Parameters) {
+	peers := map[string]bool{}
+
+	for _, p := range config {
+		for _, c := range p.Conditions {
+			if c.Peer != "" {
+				peers[c.Peer] = true
+			}
+		}
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	changed := len(peers) != len(a.peers)
+
+	for p, _ := range peers {
+		if !a.peers[p] {
+			changed = true
+		}
+	}
+
+	a.peers = peers
+
+	if changed {
+		a.signal()
+	}
+}
+
+func (a *adjRIBsIn) watched(peer string) bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.peers[peer]
+}
+
+func newAdjRIBsIn() *adjRIBsIn {
+	return &adjRIBsIn{C: make(chan bool, 1), rib: map[string]map[netip.Prefix]bool{}}
+}
+
+func (a *adjRIBsIn) signal() {
+	select {
+	case a.C <- true:
+	default:
+	}
+}
+
+// apply received advertisements and withdrawals, returning the number of prefixes now held for the peer
+func (a *adjRIBsIn) update(peer string, advertised, withdrawn []netip.Prefix) int {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	rib, ok := a.rib[peer]
+
+	if !ok {
+		rib = map[netip.Prefix]bool{}
+		a.rib[peer] = rib
+	}
+
+	var changed bool
+
+	for _, p := range withdrawn {
+		if rib[p] {
+			delete(rib, p)
+			changed = true
+		}
+	}
+
+	for _, p := range advertised {
+		if !rib[p] {
+			rib[p] = true
+			changed = true
+		}
+	}
+
+	if changed {
+		a.signal()
+	}
+
+	return len(rib)
+}
+
+// forget all routes from the peer, eg. when the session goes down
+func (a *adjRIBsIn) clear(peer string) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if len(a.rib[peer]) > 0 {
+		a.signal()
+	}
+
+	delete(a.rib, peer)
+}
+
+func (a *adjRIBsIn) has(peer string, p netip.Prefix) bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.rib[peer][p.Masked()]
+}
@@ -0,0 +1,61 @@
+/*
+ * VC5 load balancer. Copyright (C) 2021-present David Coles
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package bgp
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestConditionsMet(t *testing.T) {
+	def := netip.MustParsePrefix("0.0.0.0/0")
+	a := newAdjRIBsIn()
+
+	p := Parameters{Conditions: []Condition{{Prefix: def, Peer: "10.0.0.1"}, {Prefix: def, Peer: "10.0.0.2", Absent: true}}}
+
+	if p.conditionsMet("10.0.0.3", a) {
+		t.Error("Conditions met with no routes")
+	}
+
+	if n := a.update("10.0.0.1", []netip.Prefix{def}, nil); n != 1 {
+		t.Error("Unexpected prefix count:", n)
+	}
+
+	select {
+	case <-a.C:
+	default:
+		t.Error("Change not signalled")
+	}
+
+	if !p.conditionsMet("10.0.0.3", a) {
+		t.Error("Conditions not met")
+	}
+
+	a.update("10.0.0.2", []netip.Prefix{def}, nil)
+
+	if p.conditionsMet("10.0.0.3", a) {
+		t.Error("Conditions met with prefix present")
+	}
+
+	a.clear("10.0.0.2")
+
+	if !p.conditionsMet("10.0.0.3", a) || !(&Parameters{}).conditionsMet("10.0.0.3", a) {
+		t.Error("Conditions not met")
+	}
+}
@@ -19,9 +19,13 @@
 package bgp
 
 import (
+	"errors"
+	"fmt"
 	"io"
 	"net"
+	"net/netip"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -38,9 +42,31 @@ type connection struct {
 	conn        net.Conn
 	mutex       sync.Mutex
 	out         []pdu
+	max         atomic.Int32
+	tap         func(pdu, bool)
 }
 
-func newConnection(local IP4, peer string) (*connection, error) {
+// add the 19 byte header to a message body
+func frame(t byte, d []byte) pdu {
+	l := 19 + len(d)
+	p := make([]byte, l)
+	for n := 0; n < 16; n++ {
+		p[n] = 0xff
+	}
+	hl := htons(uint16(l))
+	p[16] = hl[0]
+	p[17] = hl[1]
+	p[18] = t
+
+	copy(p[19:], d)
+
+	return p
+}
+
+// The peer may be given as host:port, otherwise port 179 is used. If
+// tap is not nil then it is called with every message sent (true) or
+// received (false) on the connection.
+func newConnection(local IP4, peer string, tap func(pdu, bool)) (*connection, error) {
 	var nul IP4
 
 	dialer := net.Dialer{
@@ -57,7 +83,12 @@ func newConnection(local IP4, peer string) (*connection, error) {
 		}
 	}
 
-	conn, err := dialer.Dial("tcp", peer+":179")
+	// the peer may include a port (eg. for testing), otherwise use the standard BGP port
+	if _, _, err := net.SplitHostPort(peer); err != nil {
+		peer += ":179"
+	}
+
+	conn, err := dialer.Dial("tcp", peer)
 
 	if err != nil {
 		return nil, err
@@ -70,14 +101,30 @@ func newConnection(local IP4, peer string) (*connection, error) {
 		reader_exit: make(chan bool),
 		pending:     make(chan bool, 1),
 		conn:        conn,
+		tap:         tap,
 	}
 
+	c.max.Store(MAX_MESSAGE_LENGTH)
+
 	go c.writer()
 	go c.reader()
 
 	return c, nil
 }
 
+// local and remote transport addresses of the connection
+func (c *connection) addrs() (local, remote netip.AddrPort) {
+	if a, ok := c.conn.LocalAddr().(*net.TCPAddr); ok {
+		local = a.AddrPort()
+	}
+
+	if a, ok := c.conn.RemoteAddr().(*net.TCPAddr); ok {
+		remote = a.AddrPort()
+	}
+
+	return
+}
+
 func (c *connection) local() ([]byte, bool) {
 
 	if a, ok := c.conn.LocalAddr().(*net.TCPAddr); ok {
@@ -87,6 +134,20 @@ func (c *connection) local() ([]byte, bool) {
 	return nil, false
 }
 
+// Accept messages up to the RFC 8654 extended message size. This must
+// be called before the KEEPALIVE acknowledging the peer's OPEN is sent
+// as the peer may start sending large UPDATEs once it receives it.
+func (c *connection) extended() {
+	c.max.Store(MAX_EXTENDED_MESSAGE_LENGTH)
+}
+
+// queue a NOTIFICATION for the peer and record it as the reason for the connection closing
+func (c *connection) fail(code, sub byte, data ...byte) {
+	n := notification{code: code, sub: sub, data: data}
+	c.Error = fmt.Sprintf("Sent notification[%d:%d]: %s", n.code, n.sub, n.note())
+	c.queue(&n)
+}
+
 func (c *connection) close() {
 	close(c.closed)
 }
@@ -114,27 +175,17 @@ func (c *connection) shift() (pdu, bool) {
 
 func (c *connection) queue(ms ...message) {
 
-	addHeader := func(t byte, d []byte) pdu {
-		l := 19 + len(d)
-		p := make([]byte, l)
-		for n := 0; n < 16; n++ {
-			p[n] = 0xff
-		}
-		hl := htons(uint16(l))
-		p[16] = hl[0]
-		p[17] = hl[1]
-		p[18] = t
-
-		copy(p[19:], d)
-
-		return p
-	}
-
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 
 	for _, m := range ms {
-		c.out = append(c.out, addHeader(m.Type(), m.Body()))
+		p := frame(m.Type(), m.Body())
+
+		if c.tap != nil {
+			c.tap(p, true)
+		}
+
+		c.out = append(c.out, p)
 	}
 
 	select {
@@ -186,6 +237,75 @@ func (c *connection) writer() {
 	}
 }
 
+// A malformed message header, to be reported with a MESSAGE_HEADER_ERROR
+// notification
+type messageError struct {
+	code byte
+	sub  byte
+	data []byte
+}
+
+func (m *messageError) Error() string {
+	return fmt.Sprintf("Message error %d:%d", m.code, m.sub)
+}
+
+// Read a single message of up to max bytes (including the header) from
+// r, returning the raw PDU and the parsed message. I/O errors are
+// returned as-is, and malformed messages which should be answered with
+// a NOTIFICATION as a *messageError.
+func read(r io.Reader, max int) (pdu, message, error) {
+
+	var header [19]byte
+
+	if _, e := io.ReadFull(r, header[:]); e != nil {
+		return nil, nil, e
+	}
+
+	for _, b := range header[0:16] {
+		if b != 0xff {
+			return nil, nil, &messageError{code: MESSAGE_HEADER_ERROR, sub: CONNECTION_NOT_SYNCHRONIZED}
+		}
+	}
+
+	length := int(header[16])<<8 + int(header[17])
+	mtype := header[18]
+
+	if length < 19 || length > max {
+		return nil, nil, &messageError{code: MESSAGE_HEADER_ERROR, sub: BAD_MESSAGE_LENGTH, data: []byte{header[16], header[17]}}
+	}
+
+	p := make(pdu, length)
+	copy(p, header[:])
+
+	if _, e := io.ReadFull(r, p[19:]); e != nil {
+		return nil, nil, e
+	}
+
+	body := p[19:]
+
+	var m message
+
+	switch mtype {
+	case M_OPEN:
+		var o open
+		if e := o.parse(body); e != nil {
+			return nil, nil, e
+		}
+		m = &o
+	case M_NOTIFICATION:
+		var n notification
+		if !n.parse(body) {
+			// a NOTIFICATION cannot be sent in response to an erroneous NOTIFICATION
+			return nil, nil, errors.New("Malformed NOTIFICATION")
+		}
+		m = &n
+	default:
+		m = &other{mtype: mtype, body: body}
+	}
+
+	return p, m, nil
+}
+
 func (c *connection) reader() {
 
 	defer close(c.reader_exit)
@@ -196,50 +316,20 @@ func (c *connection) reader() {
 		// if the writer side encounders an error, it will exit and close the connction, causing an error here
 		// if the user asks to close the connection upstream then writer will exit, closing the net connection (error here)
 
-		var header [19]byte
-
-		n, e := io.ReadFull(c.conn, header[:])
-		if n != len(header) || e != nil {
-			c.Error = e.Error()
-			return
-		}
-
-		for _, b := range header[0:16] {
-			if b != 0xff {
-				return
-			}
-		}
-
-		length := int(header[16])<<8 + int(header[17])
-		mtype := header[18]
+		p, m, err := read(c.conn, int(c.max.Load()))
 
-		if length < 19 || length > 4096 {
+		if e, ok := err.(*messageError); ok {
+			c.fail(e.code, e.sub, e.data...)
 			return
 		}
 
-		length -= 19
-
-		body := make([]byte, length)
-
-		n, e = io.ReadFull(c.conn, body[:])
-		if n != len(body) || e != nil {
-			c.Error = e.Error()
+		if err != nil {
+			c.Error = err.Error()
 			return
 		}
 
-		var m message
-
-		switch mtype {
-		case M_OPEN:
-			var o open
-			o.parse(body) // todo - handle failed parse better (connection gets killed anyway)
-			m = &o
-		case M_NOTIFICATION:
-			var n notification
-			n.parse(body) // todo - handle failed parse better (connection gets killed anyway)
-			m = &n
-		default:
-			m = &other{mtype: mtype, body: body}
+		if c.tap != nil {
+			c.tap(p, false)
 		}
 
 		select {
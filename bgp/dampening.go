@@ -0,0 +1,179 @@
+/*
+ * VC5 load balancer. Copyright (C) 2021-present David Coles
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+// https://datatracker.ietf.org/doc/html/rfc2439 - BGP Route Flap Damping
+
+package bgp
+
+import (
+	"math"
+	"net/netip"
+	"time"
+)
+
+// Flap dampening parameters. When health checks cause an address to
+// be repeatedly withdrawn and re-advertised it accumulates a penalty
+// which decays exponentially over time. Once the penalty exceeds the
+// suppress threshold the address is held in a fixed state until the
+// penalty has decayed below the reuse threshold.
+type Dampening struct {
+	HalfLife    uint16 `json:"half_life,omitempty"`    // seconds for the penalty to decay by half (default 900)
+	Penalty     uint32 `json:"penalty,omitempty"`      // added to the penalty each time an address is withdrawn (default 1000)
+	Suppress    uint32 `json:"suppress,omitempty"`     // penalty above which an address is suppressed (default 2000)
+	Reuse       uint32 `json:"reuse,omitempty"`        // penalty below which a suppressed address is released (default 750)
+	MaxSuppress uint16 `json:"max_suppress,omitempty"` // maximum time in seconds that an address can be suppressed (default 4 x half-life)
+	Advertise   bool   `json:"advertise,omitempty"`    // hold suppressed addresses advertised rather than withdrawn
+}
+
+// Dampening state of an address, as reported by Pool.Dampened()
+type Penalty struct {
+	Penalty    uint32    `json:"penalty"`
+	Flaps      uint64    `json:"flaps"`
+	Suppressed bool      `json:"suppressed"`
+	Healthy    bool      `json:"healthy"`         // current state of the address in the RIB supplied by the user
+	Reuse      time.Time `json:"reuse,omitempty"` // estimated time that a suppressed address will be released
+}
+
+func (d Dampening) defaults() Dampening {
+	if d.HalfLife == 0 {
+		d.HalfLife = 900
+	}
+
+	if d.Penalty == 0 {
+		d.Penalty = 1000
+	}
+
+	if d.Suppress == 0 {
+		d.Suppress = 2000
+	}
+
+	if d.Reuse == 0 {
+		d.Reuse = 750
+	}
+
+	if d.MaxSuppress == 0 {
+		d.MaxSuppress = math.MaxUint16 // 4 x half-life would overflow for long half-lives
+		if m := 4 * uint32(d.HalfLife); m < math.MaxUint16 {
+			d.MaxSuppress = uint16(m)
+		}
+	}
+
+	return d
+}
+
+type flap struct {
+	penalty    float64
+	updated    time.Time
+	flaps      uint64
+	present    bool
+	suppressed bool
+}
+
+type damper struct {
+	config Dampening
+	state  map[netip.Addr]*flap
+}
+
+func newDamper(d Dampening) *damper {
+	return &damper{config: d.defaults(), state: map[netip.Addr]*flap{}}
+}
+
+func (d *damper) halflife() time.Duration {
+	return time.Duration(d.config.HalfLife) * time.Second
+}
+
+// the penalty is capped so that it will always decay below the reuse
+// threshold within the maximum suppression time
+func (d *damper) ceiling() float64 {
+	return float64(d.config.Reuse) * math.Pow(2, float64(d.config.MaxSuppress)/float64(d.config.HalfLife))
+}
+
+func (d *damper) decay(f *flap, now time.Time) {
+	if t := now.Sub(f.updated); t > 0 {
+		f.penalty *= math.Pow(0.5, float64(t)/float64(d.halflife()))
+	}
+	f.updated = now
+}
+
+// Update the dampening state with the user supplied RIB and return the
+// RIB which should be advertised. This should also be called
+// periodically (with the same RIB) so that suppressed addresses are
+// released as their penalties decay.
+func (d *damper) rib(in []netip.Addr, now time.Time) (out []netip.Addr) {
+
+	present := map[netip.Addr]bool{}
+
+	for _, a := range in {
+		present[a] = true
+
+		if _, ok := d.state[a]; !ok {
+			// first appearance of an address is not a flap
+			d.state[a] = &flap{present: true, updated: now}
+		}
+	}
+
+	for a, f := range d.state {
+		d.decay(f, now)
+
+		was := f.present
+		f.present = present[a]
+
+		if was && !f.present {
+			f.flaps++
+			f.penalty = math.Min(f.penalty+float64(d.config.Penalty), d.ceiling())
+		}
+
+		if !f.suppressed && f.penalty > float64(d.config.Suppress) {
+			f.suppressed = true
+		} else if f.suppressed && f.penalty < float64(d.config.Reuse) {
+			f.suppressed = false
+		}
+
+		if f.suppressed {
+			if d.config.Advertise {
+				out = append(out, a)
+			}
+		} else if f.present {
+			out = append(out, a)
+		} else if f.penalty < 1 {
+			delete(d.state, a) // forget about addresses which have been stable for long enough
+		}
+	}
+
+	return
+}
+
+func (d *damper) status(now time.Time) map[netip.Addr]Penalty {
+	r := map[netip.Addr]Penalty{}
+
+	for a, f := range d.state {
+		d.decay(f, now)
+
+		p := Penalty{Penalty: uint32(f.penalty), Flaps: f.flaps, Suppressed: f.suppressed, Healthy: f.present}
+
+		if f.suppressed {
+			// solve penalty * 0.5^(t/halflife) = reuse for t
+			t := math.Log2(f.penalty/float64(d.config.Reuse)) * float64(d.halflife())
+			p.Reuse = now.Add(time.Duration(t)).Round(time.Second)
+		}
+
+		r[a] = p
+	}
+
+	return r
+}
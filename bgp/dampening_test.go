@@ -0,0 +1,93 @@
+/*
+ * VC5 load balancer. Copyright (C) 2021-present David Coles
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package bgp
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestDampening(t *testing.T) {
+	a := netip.MustParseAddr("192.168.101.1")
+	b := netip.MustParseAddr("192.168.101.2")
+
+	up := []netip.Addr{a, b}
+	down := []netip.Addr{b}
+
+	for _, hold := range []bool{false, true} {
+
+		d := newDamper(Dampening{HalfLife: 60, Advertise: hold})
+		now := time.Now()
+
+		held := 1 // suppressed address is withdrawn
+		if hold {
+			held = 2 // suppressed address is advertised
+		}
+
+		if r := d.rib(up, now); len(r) != 2 {
+			t.Fatal("Initial advertisement should not be dampened", r)
+		}
+
+		// two withdrawals take the penalty to 2000 - not yet above the suppress threshold
+		for n := 0; n < 2; n++ {
+			d.rib(down, now)
+			d.rib(up, now)
+		}
+
+		if s := d.status(now); s[a].Suppressed || s[a].Flaps != 2 {
+			t.Fatal("Address should not be suppressed", s[a])
+		}
+
+		if r := d.rib(down, now); len(r) != held {
+			t.Fatal("Suppressed address state unexpected", hold, r)
+		}
+
+		// address is stable but suppressed - should be held until the penalty decays
+		if r := d.rib(up, now); len(r) != held {
+			t.Fatal("Suppressed address state unexpected", hold, r)
+		}
+
+		if s := d.status(now); !s[a].Suppressed || s[b].Suppressed {
+			t.Fatal("Address should be suppressed", s[a])
+		}
+
+		// 3000 -> 750 takes two half-lives
+		now = now.Add(121 * time.Second)
+
+		if r := d.rib(up, now); len(r) != 2 {
+			t.Fatal("Address should have been released", r)
+		}
+	}
+}
+
+func TestDampeningDefaults(t *testing.T) {
+	if d := (Dampening{}).defaults(); d.MaxSuppress != 3600 {
+		t.Error("Unexpected default maximum suppression:", d.MaxSuppress)
+	}
+
+	// 4 x half-life does not fit in a uint16
+	if d := (Dampening{HalfLife: 20000}).defaults(); d.MaxSuppress != 65535 {
+		t.Error("Default maximum suppression overflowed:", d.MaxSuppress)
+	}
+
+	if c := newDamper(Dampening{HalfLife: 20000}).ceiling(); c <= 750 {
+		t.Error("Penalty ceiling below the reuse threshold:", c)
+	}
+}
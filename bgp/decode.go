@@ -0,0 +1,616 @@
+/*
+ * VC5 load balancer. Copyright (C) 2021-present David Coles
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+// https://datatracker.ietf.org/doc/html/rfc4760 - Multiprotocol Extensions for BGP-4
+// https://datatracker.ietf.org/doc/html/rfc6793 - BGP Support for Four-Octet Autonomous System (AS) Number Space
+
+package bgp
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/netip"
+)
+
+// Raw bytes which are rendered as a hex string in JSON
+type Hex []byte
+
+func (h Hex) MarshalText() ([]byte, error) {
+	return []byte(hex.EncodeToString(h)), nil
+}
+
+// Describes why a message could not be decoded, with the NOTIFICATION
+// error code and subcode which should be sent to the peer
+type DecodeError struct {
+	Code    uint8
+	Subcode uint8
+	Reason  string
+}
+
+func (e *DecodeError) Error() string {
+	return e.Reason
+}
+
+func decodeError(code, sub uint8, format string, a ...any) *DecodeError {
+	return &DecodeError{Code: code, Subcode: sub, Reason: fmt.Sprintf(format, a...)}
+}
+
+// A decoded BGP message. Exactly one of the message type fields will be
+// set, depending on the type in the header (unrecognised types have
+// only the header and body).
+type Message struct {
+	Header       Header        `json:"header"`
+	Open         *Open         `json:"open,omitempty"`
+	Update       *Update       `json:"update,omitempty"`
+	Notification *Notification `json:"notification,omitempty"`
+	Keepalive    *Keepalive    `json:"keepalive,omitempty"`
+	RouteRefresh *RouteRefresh `json:"route_refresh,omitempty"`
+	Body         Hex           `json:"body,omitempty"`
+}
+
+type Header struct {
+	Length uint16 `json:"length"`
+	Type   uint8  `json:"type"`
+	Name   string `json:"name"`
+}
+
+type Keepalive struct{}
+
+type RouteRefresh struct {
+	AFI  uint16 `json:"afi"`
+	SAFI uint8  `json:"safi"`
+}
+
+type Open struct {
+	Version      uint8        `json:"version"`
+	ASNumber     uint16       `json:"as_number"`
+	HoldTime     uint16       `json:"hold_time"`
+	RouterID     netip.Addr   `json:"router_id"`
+	Capabilities []Capability `json:"capabilities,omitempty"`
+}
+
+type Capability struct {
+	Code  uint8  `json:"code"`
+	Name  string `json:"name"`
+	Value Hex    `json:"value,omitempty"`
+
+	// decoded values for Multiprotocol and 4-octet AS number capabilities
+	AFI      uint16 `json:"afi,omitempty"`
+	SAFI     uint8  `json:"safi,omitempty"`
+	ASNumber uint32 `json:"as_number,omitempty"`
+}
+
+type Notification struct {
+	Code          uint8  `json:"code"`
+	Subcode       uint8  `json:"subcode"`
+	Data          Hex    `json:"data,omitempty"`
+	Text          string `json:"text"`
+	Communication string `json:"communication,omitempty"` // RFC 9003 shutdown communication
+}
+
+type Update struct {
+	Withdrawn  []netip.Prefix `json:"withdrawn,omitempty"`
+	Attributes []Attribute    `json:"attributes,omitempty"`
+	NLRI       []netip.Prefix `json:"nlri,omitempty"`
+}
+
+type Attribute struct {
+	Flags uint8  `json:"flags"`
+	Type  uint8  `json:"type"`
+	Name  string `json:"name"`
+	Value Hex    `json:"value,omitempty"`
+
+	// decoded values, depending on the type of attribute
+	Origin      string          `json:"origin,omitempty"`
+	ASPath      []ASPathSegment `json:"as_path,omitempty"`
+	NextHop     []netip.Addr    `json:"next_hop,omitempty"`
+	MED         *uint32         `json:"med,omitempty"`
+	LocalPref   *uint32         `json:"local_pref,omitempty"`
+	Communities []Community     `json:"communities,omitempty"`
+	MPReach     *MPReach        `json:"mp_reach,omitempty"`
+	MPUnreach   *MPUnreach      `json:"mp_unreach,omitempty"`
+}
+
+type ASPathSegment struct {
+	Type uint8    `json:"type"` // AS_SET or AS_SEQUENCE
+	ASNs []uint32 `json:"asns"`
+}
+
+type MPReach struct {
+	AFI     uint16         `json:"afi"`
+	SAFI    uint8          `json:"safi"`
+	NextHop []netip.Addr   `json:"next_hop"`
+	NLRI    []netip.Prefix `json:"nlri,omitempty"`
+}
+
+type MPUnreach struct {
+	AFI       uint16         `json:"afi"`
+	SAFI      uint8          `json:"safi"`
+	Withdrawn []netip.Prefix `json:"withdrawn,omitempty"`
+}
+
+// Returns all prefixes advertised and withdrawn by the UPDATE,
+// including those in multiprotocol attributes.
+func (u *Update) Routes() (advertised, withdrawn []netip.Prefix) {
+	advertised = append(advertised, u.NLRI...)
+	withdrawn = append(withdrawn, u.Withdrawn...)
+
+	for _, a := range u.Attributes {
+		if a.MPReach != nil {
+			advertised = append(advertised, a.MPReach.NLRI...)
+		}
+		if a.MPUnreach != nil {
+			withdrawn = append(withdrawn, a.MPUnreach.Withdrawn...)
+		}
+	}
+
+	return
+}
+
+// Returns the attribute of the given type, if present
+func (u *Update) Attribute(t uint8) (Attribute, bool) {
+	for _, a := range u.Attributes {
+		if a.Type == t {
+			return a, true
+		}
+	}
+	return Attribute{}, false
+}
+
+// Decodes BGP messages. AS4 should be set if 4-byte AS numbers were
+// negotiated for the session, in which case AS_PATH attributes are
+// decoded with 4-byte AS numbers.
+type Decoder struct {
+	AS4 bool
+}
+
+// Decode a single message (with a 2-byte AS_PATH encoding) from the
+// start of b, returning the number of bytes consumed.
+func Decode(b []byte) (Message, int, error) {
+	var d Decoder
+	return d.Decode(b)
+}
+
+// Decode a single message from the start of b, returning the number of
+// bytes consumed. Messages up to the RFC 8654 extended message length
+// are accepted.
+func (d *Decoder) Decode(b []byte) (m Message, n int, err error) {
+
+	if len(b) < 19 {
+		return m, 0, decodeError(MESSAGE_HEADER_ERROR, BAD_MESSAGE_LENGTH, "Message too short for header: %d bytes", len(b))
+	}
+
+	for _, x := range b[0:16] {
+		if x != 0xff {
+			return m, 0, decodeError(MESSAGE_HEADER_ERROR, CONNECTION_NOT_SYNCHRONIZED, "Bad marker")
+		}
+	}
+
+	length := int(b[16])<<8 | int(b[17])
+
+	if length < 19 {
+		return m, 0, decodeError(MESSAGE_HEADER_ERROR, BAD_MESSAGE_LENGTH, "Bad message length: %d", length)
+	}
+
+	if len(b) < length {
+		return m, 0, decodeError(MESSAGE_HEADER_ERROR, BAD_MESSAGE_LENGTH, "Message truncated: %d of %d bytes", len(b), length)
+	}
+
+	m.Header = Header{Length: uint16(length), Type: b[18], Name: messageName(b[18])}
+
+	body := b[19:length]
+
+	switch m.Header.Type {
+	case M_OPEN:
+		m.Open, err = decodeOpen(body)
+	case M_UPDATE:
+		m.Update, err = d.decodeUpdate(body)
+	case M_NOTIFICATION:
+		m.Notification, err = decodeNotification(body)
+	case M_KEEPALIVE:
+		if len(body) != 0 {
+			err = decodeError(MESSAGE_HEADER_ERROR, BAD_MESSAGE_LENGTH, "KEEPALIVE with body")
+		}
+		m.Keepalive = &Keepalive{}
+	case M_ROUTE_REFRESH:
+		if len(body) != 4 {
+			err = decodeError(ROUTE_REFRESH_MESSAGE_ERROR, INVALID_MESSAGE_LENGTH, "Bad ROUTE-REFRESH length: %d", len(body))
+		} else {
+			m.RouteRefresh = &RouteRefresh{AFI: uint16(body[0])<<8 | uint16(body[1]), SAFI: body[3]}
+		}
+	default:
+		m.Body = body
+		err = decodeError(MESSAGE_HEADER_ERROR, BAD_MESSAGE_TYPE, "Bad message type: %d", m.Header.Type)
+	}
+
+	return m, length, err
+}
+
+func messageName(t uint8) string {
+	switch t {
+	case M_OPEN:
+		return "OPEN"
+	case M_UPDATE:
+		return "UPDATE"
+	case M_NOTIFICATION:
+		return "NOTIFICATION"
+	case M_KEEPALIVE:
+		return "KEEPALIVE"
+	case M_ROUTE_REFRESH:
+		return "ROUTE-REFRESH"
+	}
+	return "UNKNOWN"
+}
+
+func decodeOpen(b []byte) (*Open, error) {
+
+	if len(b) < 10 {
+		return nil, decodeError(MESSAGE_HEADER_ERROR, BAD_MESSAGE_LENGTH, "OPEN too short: %d bytes", len(b))
+	}
+
+	o := &Open{
+		Version:  b[0],
+		ASNumber: uint16(b[1])<<8 | uint16(b[2]),
+		HoldTime: uint16(b[3])<<8 | uint16(b[4]),
+		RouterID: netip.AddrFrom4([4]byte{b[5], b[6], b[7], b[8]}),
+	}
+
+	l := int(b[9])
+
+	if len(b) != 10+l {
+		return nil, decodeError(MESSAGE_HEADER_ERROR, BAD_MESSAGE_LENGTH, "OPEN optional parameters length mismatch")
+	}
+
+	caps, ok := capabilities(b[10:])
+
+	if !ok {
+		return nil, decodeError(OPEN_MESSAGE_ERROR, 0, "Malformed optional parameters")
+	}
+
+	for _, c := range caps {
+		x := Capability{Code: c.code, Name: capabilityName(c.code), Value: c.value}
+
+		switch {
+		case c.code == BGP4_MP && len(c.value) == 4:
+			x.AFI = uint16(c.value[0])<<8 | uint16(c.value[1])
+			x.SAFI = c.value[3]
+		case c.code == AS4_CAPABILITY && len(c.value) == 4:
+			x.ASNumber = uint32(c.value[0])<<24 | uint32(c.value[1])<<16 | uint32(c.value[2])<<8 | uint32(c.value[3])
+		}
+
+		o.Capabilities = append(o.Capabilities, x)
+	}
+
+	return o, nil
+}
+
+// https://www.iana.org/assignments/capability-codes/capability-codes.xhtml
+func capabilityName(c uint8) string {
+	switch c {
+	case BGP4_MP:
+		return "Multiprotocol Extensions"
+	case 2:
+		return "Route Refresh"
+	case EXTENDED_MESSAGE:
+		return "Extended Message"
+	case 64:
+		return "Graceful Restart"
+	case AS4_CAPABILITY:
+		return "4-octet AS number"
+	case 69:
+		return "ADD-PATH"
+	case 70:
+		return "Enhanced Route Refresh"
+	case 73:
+		return "FQDN"
+	}
+	return "Unknown"
+}
+
+func decodeNotification(b []byte) (*Notification, error) {
+
+	var n notification
+
+	if !n.parse(b) {
+		return nil, decodeError(MESSAGE_HEADER_ERROR, BAD_MESSAGE_LENGTH, "NOTIFICATION too short: %d bytes", len(b))
+	}
+
+	r := &Notification{Code: n.code, Subcode: n.sub, Data: n.data, Text: n.note()}
+
+	if text, ok := n.communication(); ok {
+		r.Communication = text
+	}
+
+	return r, nil
+}
+
+func (d *Decoder) decodeUpdate(b []byte) (*Update, error) {
+
+	malformed := func(format string, a ...any) error {
+		return decodeError(UPDATE_MESSAGE_ERROR, MALFORMED_ATTRIBUTE_LIST, format, a...)
+	}
+
+	u := &Update{}
+
+	if len(b) < 4 {
+		return nil, malformed("UPDATE too short: %d bytes", len(b))
+	}
+
+	wl := int(b[0])<<8 | int(b[1])
+
+	if len(b) < 2+wl+2 {
+		return nil, malformed("Withdrawn routes length exceeds message")
+	}
+
+	var err error
+
+	if u.Withdrawn, err = prefixes(b[2:2+wl], 1); err != nil {
+		return nil, decodeError(UPDATE_MESSAGE_ERROR, INVALID_NETWORK_FIELD, "Withdrawn routes: %s", err)
+	}
+
+	b = b[2+wl:]
+
+	al := int(b[0])<<8 | int(b[1])
+
+	if len(b) < 2+al {
+		return nil, malformed("Total path attribute length exceeds message")
+	}
+
+	attrs := b[2 : 2+al]
+
+	if u.NLRI, err = prefixes(b[2+al:], 1); err != nil {
+		return nil, decodeError(UPDATE_MESSAGE_ERROR, INVALID_NETWORK_FIELD, "NLRI: %s", err)
+	}
+
+	for len(attrs) > 0 {
+		if len(attrs) < 3 {
+			return nil, malformed("Truncated attribute")
+		}
+
+		flags, t := attrs[0], attrs[1]
+		var l, h int
+
+		if flags&0x10 != 0 { // extended length
+			if len(attrs) < 4 {
+				return nil, malformed("Truncated attribute")
+			}
+			l, h = int(attrs[2])<<8|int(attrs[3]), 4
+		} else {
+			l, h = int(attrs[2]), 3
+		}
+
+		if len(attrs) < h+l {
+			return nil, decodeError(UPDATE_MESSAGE_ERROR, ATTRIBUTE_LENGTH_ERROR, "Attribute %d length exceeds path attributes", t)
+		}
+
+		a, err := d.attribute(flags, t, attrs[h:h+l])
+
+		if err != nil {
+			return nil, err
+		}
+
+		u.Attributes = append(u.Attributes, a)
+		attrs = attrs[h+l:]
+	}
+
+	return u, nil
+}
+
+func attributeName(t uint8) string {
+	switch t {
+	case ORIGIN:
+		return "ORIGIN"
+	case AS_PATH:
+		return "AS_PATH"
+	case NEXT_HOP:
+		return "NEXT_HOP"
+	case MULTI_EXIT_DISC:
+		return "MULTI_EXIT_DISC"
+	case LOCAL_PREF:
+		return "LOCAL_PREF"
+	case 6:
+		return "ATOMIC_AGGREGATE"
+	case 7:
+		return "AGGREGATOR"
+	case COMMUNITIES:
+		return "COMMUNITIES"
+	case MP_REACH_NLRI:
+		return "MP_REACH_NLRI"
+	case MP_UNREACH_NLRI:
+		return "MP_UNREACH_NLRI"
+	case 16:
+		return "EXTENDED_COMMUNITIES"
+	case AS4_PATH:
+		return "AS4_PATH"
+	case 18:
+		return "AS4_AGGREGATOR"
+	case 32:
+		return "LARGE_COMMUNITY"
+	}
+	return "UNKNOWN"
+}
+
+func (d *Decoder) attribute(flags, t uint8, v []byte) (a Attribute, err error) {
+
+	a = Attribute{Flags: flags, Type: t, Name: attributeName(t), Value: v}
+
+	length := func(n int) error {
+		if len(v) != n {
+			return decodeError(UPDATE_MESSAGE_ERROR, ATTRIBUTE_LENGTH_ERROR, "%s length %d", a.Name, len(v))
+		}
+		return nil
+	}
+
+	u32 := func(b []byte) uint32 {
+		return uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3])
+	}
+
+	switch t {
+	case ORIGIN:
+		if err = length(1); err != nil {
+			return
+		}
+
+		switch v[0] {
+		case IGP:
+			a.Origin = "IGP"
+		case EGP:
+			a.Origin = "EGP"
+		case 2:
+			a.Origin = "INCOMPLETE"
+		default:
+			err = decodeError(UPDATE_MESSAGE_ERROR, INVALID_ORIGIN_ATTRIBUTE, "Invalid ORIGIN %d", v[0])
+		}
+
+	case AS_PATH, AS4_PATH:
+		size := 2
+		if d.AS4 || t == AS4_PATH {
+			size = 4
+		}
+
+		for b := v; len(b) > 0; {
+			if len(b) < 2 || len(b) < 2+int(b[1])*size {
+				return a, decodeError(UPDATE_MESSAGE_ERROR, MALFORMED_AS_PATH, "Malformed %s", a.Name)
+			}
+
+			s := ASPathSegment{Type: b[0]}
+
+			for n := 0; n < int(b[1]); n++ {
+				x := b[2+n*size:]
+				if size == 2 {
+					s.ASNs = append(s.ASNs, uint32(x[0])<<8|uint32(x[1]))
+				} else {
+					s.ASNs = append(s.ASNs, u32(x))
+				}
+			}
+
+			a.ASPath = append(a.ASPath, s)
+			b = b[2+int(b[1])*size:]
+		}
+
+	case NEXT_HOP:
+		if err = length(4); err != nil {
+			return
+		}
+		a.NextHop = []netip.Addr{netip.AddrFrom4([4]byte{v[0], v[1], v[2], v[3]})}
+
+	case MULTI_EXIT_DISC:
+		if err = length(4); err != nil {
+			return
+		}
+		med := u32(v)
+		a.MED = &med
+
+	case LOCAL_PREF:
+		if err = length(4); err != nil {
+			return
+		}
+		lp := u32(v)
+		a.LocalPref = &lp
+
+	case COMMUNITIES:
+		if len(v)%4 != 0 {
+			return a, decodeError(UPDATE_MESSAGE_ERROR, ATTRIBUTE_LENGTH_ERROR, "COMMUNITIES length %d", len(v))
+		}
+		for n := 0; n < len(v); n += 4 {
+			a.Communities = append(a.Communities, Community(u32(v[n:])))
+		}
+
+	case MP_REACH_NLRI:
+		if len(v) < 5 || len(v) < 5+int(v[3]) {
+			return a, decodeError(UPDATE_MESSAGE_ERROR, OPTIONAL_ATTRIBUTE_ERROR, "Malformed MP_REACH_NLRI")
+		}
+
+		r := &MPReach{AFI: uint16(v[0])<<8 | uint16(v[1]), SAFI: v[2]}
+		nh := v[4 : 4+int(v[3])]
+
+		for len(nh) >= 4 {
+			if r.AFI == 2 && len(nh) >= 16 {
+				r.NextHop = append(r.NextHop, netip.AddrFrom16(*(*[16]byte)(nh[:16])))
+				nh = nh[16:]
+			} else {
+				r.NextHop = append(r.NextHop, netip.AddrFrom4([4]byte{nh[0], nh[1], nh[2], nh[3]}))
+				nh = nh[4:]
+			}
+		}
+
+		// 1 reserved octet (formerly the number of SNPAs) follows the next hop
+		if r.NLRI, err = prefixes(v[5+int(v[3]):], r.AFI); err != nil {
+			return a, decodeError(UPDATE_MESSAGE_ERROR, OPTIONAL_ATTRIBUTE_ERROR, "MP_REACH_NLRI: %s", err)
+		}
+
+		a.MPReach = r
+
+	case MP_UNREACH_NLRI:
+		if len(v) < 3 {
+			return a, decodeError(UPDATE_MESSAGE_ERROR, OPTIONAL_ATTRIBUTE_ERROR, "Malformed MP_UNREACH_NLRI")
+		}
+
+		r := &MPUnreach{AFI: uint16(v[0])<<8 | uint16(v[1]), SAFI: v[2]}
+
+		if r.Withdrawn, err = prefixes(v[3:], r.AFI); err != nil {
+			return a, decodeError(UPDATE_MESSAGE_ERROR, OPTIONAL_ATTRIBUTE_ERROR, "MP_UNREACH_NLRI: %s", err)
+		}
+
+		a.MPUnreach = r
+	}
+
+	return a, err
+}
+
+// decode a sequence of <length, prefix> tuples for an address family (1: IPv4, 2: IPv6)
+func prefixes(b []byte, afi uint16) (r []netip.Prefix, err error) {
+
+	size := 4
+	if afi == 2 {
+		size = 16
+	} else if afi != 1 {
+		return nil, fmt.Errorf("Unsupported address family %d", afi)
+	}
+
+	for len(b) > 0 {
+		bits := int(b[0])
+		n := (bits + 7) / 8
+
+		if bits > size*8 || len(b) < 1+n {
+			return nil, fmt.Errorf("Invalid prefix")
+		}
+
+		var ip [16]byte
+		copy(ip[:], b[1:1+n])
+
+		var addr netip.Addr
+
+		if size == 4 {
+			addr = netip.AddrFrom4([4]byte{ip[0], ip[1], ip[2], ip[3]})
+		} else {
+			addr = netip.AddrFrom16(ip)
+		}
+
+		p, err := addr.Prefix(bits)
+
+		if err != nil {
+			return nil, err
+		}
+
+		r = append(r, p)
+		b = b[1+n:]
+	}
+
+	return r, nil
+}
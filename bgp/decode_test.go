@@ -0,0 +1,139 @@
+/*
+ * VC5 load balancer. Copyright (C) 2021-present David Coles
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package bgp
+
+import (
+	"bytes"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestDecodeUpdates(t *testing.T) {
+
+	a := advert{ASNumber: 65000, NextHop: [4]byte{10, 0, 0, 1}, Multiprotocol: true, MED: 10, Communities: []Community{1, 2}, external: true}
+
+	nlri := map[netip.Addr]bool{}
+
+	for n := 0; n < 1000; n++ {
+		nlri[netip.AddrFrom4([4]byte{10, 1, byte(n >> 8), byte(n)})] = n%2 == 0
+		nlri[netip.AddrFrom16([16]byte{0xfd, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, byte(n >> 8), byte(n)})] = n%3 == 0
+	}
+
+	found := map[netip.Addr]bool{}
+
+	for _, u := range a.updates(nlri, MAX_MESSAGE_LENGTH) {
+		m, n, err := Decode(append(frame(u.Type(), u.Body()), 0xff))
+
+		if err != nil || m.Update == nil || n != 19+len(u.Body()) {
+			t.Fatal("Decode failed:", err, n)
+		}
+
+		if _, ok := m.Update.Attribute(MULTI_EXIT_DISC); !ok {
+			t.Error("Missing MED")
+		}
+
+		advertised, withdrawn := m.Update.Routes()
+
+		for _, p := range advertised {
+			found[p.Addr()] = true
+		}
+
+		for _, p := range withdrawn {
+			found[p.Addr()] = false
+		}
+	}
+
+	if len(found) != len(nlri) {
+		t.Fatal("Decoded", len(found), "prefixes, expected", len(nlri))
+	}
+
+	for k, v := range nlri {
+		if found[k] != v {
+			t.Error("Mismatch for", k)
+		}
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+
+	keepalive := frame(M_KEEPALIVE, nil)
+
+	for _, b := range [][]byte{
+		nil,
+		keepalive[:18],
+		append([]byte{0}, keepalive[1:]...),
+		frame(M_OPEN, []byte{4, 0, 1}),
+		frame(M_UPDATE, []byte{0, 9, 0, 0}),
+		frame(M_UPDATE, []byte{0, 0, 0, 4, WTCR, ORIGIN, 2, 0}),
+	} {
+		if _, _, err := Decode(b); err == nil {
+			t.Errorf("Expected an error for %x", b)
+		} else if _, ok := err.(*DecodeError); !ok {
+			t.Errorf("Expected a DecodeError for %x", b)
+		}
+	}
+}
+
+func TestMRTReader(t *testing.T) {
+
+	p := peerinfo{
+		local:     netip.MustParseAddrPort("10.0.0.1:12345"),
+		remote:    netip.MustParseAddrPort("10.0.0.2:179"),
+		localASN:  65000,
+		remoteASN: 65001,
+	}
+
+	o := open{asNumber: 65000, holdTime: 240, routerID: [4]byte{10, 0, 0, 1}, multiprotocol: true}
+	now := time.Unix(1700000000, 123000)
+
+	var buf bytes.Buffer
+	buf.Write(mrtRecord(now, p, frame(M_OPEN, o.message()), true))
+	buf.Write(mrtRecord(now, p, frame(M_KEEPALIVE, nil), false))
+
+	r := NewMRTReader(&buf)
+
+	rec, err := r.Next()
+
+	if err != nil || !rec.Sent || rec.PeerAS != 65001 || rec.Peer != p.remote.Addr() || !rec.Time.Equal(now) {
+		t.Fatal("Bad record:", rec, err)
+	}
+
+	m, err := rec.Decode()
+
+	if err != nil || m.Open == nil || m.Open.ASNumber != 65000 || m.Open.HoldTime != 240 {
+		t.Fatal("Bad OPEN:", m, err)
+	}
+
+	if len(m.Open.Capabilities) != 2 || m.Open.Capabilities[0].AFI != 2 || m.Open.Capabilities[1].AFI != 1 {
+		t.Error("Bad capabilities:", m.Open.Capabilities)
+	}
+
+	if rec, err = r.Next(); err != nil || rec.Sent {
+		t.Fatal("Bad record:", rec, err)
+	}
+
+	if m, err = rec.Decode(); err != nil || m.Keepalive == nil {
+		t.Error("Bad KEEPALIVE:", m, err)
+	}
+
+	if _, err = r.Next(); err == nil {
+		t.Error("Expected EOF")
+	}
+}
@@ -0,0 +1,268 @@
+/*
+ * VC5 load balancer. Copyright (C) 2021-present David Coles
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package bgp
+
+import (
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+)
+
+type EventType string
+
+const (
+	EVENT_PEER_ADDED   EventType = "peer_added"   // a peer was added to a pool (Parameters)
+	EVENT_PEER_REMOVED EventType = "peer_removed" // a peer was removed from a pool
+	EVENT_PEER_UPDATED EventType = "peer_updated" // a peer's parameters were changed (Parameters, Reason lists the changes)
+	EVENT_STATE        EventType = "state"        // the session changed state (From, To, Reason)
+	EVENT_NOTIFICATION EventType = "notification" // a NOTIFICATION was sent or received (Notification, Sent)
+	EVENT_UPDATE       EventType = "update"       // UPDATE messages were queued for the peer (Advertised, Withdrawn, Messages)
+	EVENT_TIMER        EventType = "timer"        // a timer expired (Timer)
+	EVENT_VERIFIED     EventType = "verified"     // the peer's AS number/router ID matched the expected values (Reason)
+	EVENT_CLOSED       EventType = "closed"       // the session was closed or a connection attempt failed (Local, Reason)
+)
+
+const (
+	TIMER_CONNECT_RETRY = "connect_retry" // a connection attempt is about to be made
+	TIMER_HOLD          = "hold"          // nothing was received from the peer within the hold time
+	TIMER_MRAI          = "mrai"          // the MinRouteAdvertisementInterval elapsed
+)
+
+// An event in the life of a session. Which fields are set depends on
+// the type of the event.
+type Event struct {
+	Type EventType `json:"type"`
+	Peer string    `json:"peer"`
+	Time time.Time `json:"time"`
+
+	From   string `json:"from,omitempty"`
+	To     string `json:"to,omitempty"`
+	Reason string `json:"reason,omitempty"`
+	Local  bool   `json:"local,omitempty"` // the session was closed at our end
+
+	Notification *Notification `json:"notification,omitempty"`
+	Sent         bool          `json:"sent,omitempty"` // the notification was sent to the peer
+
+	Advertised []netip.Prefix `json:"advertised,omitempty"`
+	Withdrawn  []netip.Prefix `json:"withdrawn,omitempty"`
+	Messages   int            `json:"messages,omitempty"` // number of UPDATE messages
+
+	Timer string `json:"timer,omitempty"`
+
+	Parameters *Parameters `json:"parameters,omitempty"`
+
+	Dropped uint64 `json:"dropped,omitempty"` // events discarded before this one because handlers were not keeping up
+}
+
+// Receives events from sessions. Events are delivered in order from a
+// separate goroutine, so a slow handler does not hold up sessions, but
+// if handlers fall too far behind then events are discarded (see
+// Event.Dropped). The BGPNotify given to a pool or session only
+// receives the events that it is interested in, and never misses a peer
+// being added or removed or a session closing.
+type BGPEvents interface {
+	BGPEvent(Event)
+}
+
+// Returns an event handler which passes peer additions/removals and
+// session closures on to a BGPNotify, as the pool and sessions did
+// before events were introduced.
+func NotifyEvents(n BGPNotify) BGPEvents {
+	return &notifyEvents{n: n}
+}
+
+type notifyEvents struct {
+	n BGPNotify
+}
+
+func (a *notifyEvents) BGPEvent(e Event) {
+	switch e.Type {
+	case EVENT_PEER_ADDED:
+		var p Parameters
+		if e.Parameters != nil {
+			p = *e.Parameters
+		}
+		a.n.BGPPeer(e.Peer, p, true)
+	case EVENT_PEER_REMOVED:
+		a.n.BGPPeer(e.Peer, Parameters{}, false)
+	case EVENT_TIMER:
+		if e.Timer == TIMER_CONNECT_RETRY {
+			a.n.BGPSession(e.Peer, true, "Connecting ...")
+		}
+	case EVENT_VERIFIED:
+		a.n.BGPSession(e.Peer, true, e.Reason)
+	case EVENT_CLOSED:
+		a.n.BGPSession(e.Peer, e.Local, e.Reason)
+	}
+}
+
+// Whether notifyEvents passes an event on, and whether it must not be
+// discarded if the queue is full.
+func notifies(e Event) (wanted, essential bool) {
+	switch e.Type {
+	case EVENT_PEER_ADDED, EVENT_PEER_REMOVED, EVENT_CLOSED:
+		return true, true
+	case EVENT_VERIFIED:
+		return true, false
+	case EVENT_TIMER:
+		return e.Timer == TIMER_CONNECT_RETRY, false
+	}
+	return false, false
+}
+
+// maximum number of events waiting to be delivered to handlers
+const event_queue = 1000
+
+// A set of event handlers which may be shared between the sessions in
+// a pool. Events are queued and delivered by a goroutine which runs
+// while the queue is not empty.
+type events struct {
+	mutex   sync.Mutex
+	h       []BGPEvents
+	n       BGPEvents // adapter for a BGPNotify
+	queue   []queued
+	dropped uint64
+	running bool
+}
+
+type queued struct {
+	event    Event
+	handlers bool // deliver to h
+	notify   bool // deliver to n
+}
+
+func (e *events) add(h BGPEvents) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.h = append(e.h, h)
+}
+
+// set (or remove, if nil) the BGPNotify which receives events
+func (e *events) notify(n BGPNotify) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.n = nil
+	if n != nil {
+		e.n = NotifyEvents(n)
+	}
+}
+
+func (e *events) emit(x Event) {
+	if e == nil {
+		return
+	}
+
+	if x.Time.IsZero() {
+		x.Time = time.Now()
+	}
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	wanted, essential := notifies(x)
+
+	q := queued{handlers: len(e.h) > 0, notify: e.n != nil && wanted}
+
+	if !q.handlers && !q.notify {
+		return
+	}
+
+	if len(e.queue) >= event_queue && !(q.notify && essential) {
+		if q.handlers {
+			e.dropped++
+		}
+		return
+	}
+
+	if q.handlers {
+		x.Dropped = e.dropped
+		e.dropped = 0
+	}
+
+	q.event = x
+	e.queue = append(e.queue, q)
+
+	if !e.running {
+		e.running = true
+		go e.deliver()
+	}
+}
+
+func (e *events) deliver() {
+	for {
+		e.mutex.Lock()
+
+		if len(e.queue) == 0 {
+			e.queue = nil
+			e.running = false
+			e.mutex.Unlock()
+			return
+		}
+
+		q := e.queue[0]
+		e.queue = e.queue[1:]
+		h := e.h
+		n := e.n
+		e.mutex.Unlock()
+
+		if n != nil && q.notify {
+			n.BGPEvent(q.event)
+		}
+
+		if q.handlers {
+			for _, h := range h {
+				h.BGPEvent(q.event)
+			}
+		}
+	}
+}
+
+// the prefixes in an UPDATE batch, sorted
+func updateEvent(peer string, nlri map[netip.Addr]bool, messages int) Event {
+	e := Event{Type: EVENT_UPDATE, Peer: peer, Messages: messages}
+
+	for a, v := range nlri {
+		p := netip.PrefixFrom(a, a.BitLen())
+		if v {
+			e.Advertised = append(e.Advertised, p)
+		} else {
+			e.Withdrawn = append(e.Withdrawn, p)
+		}
+	}
+
+	less := func(p []netip.Prefix) func(i, j int) bool {
+		return func(i, j int) bool { return p[i].Addr().Less(p[j].Addr()) }
+	}
+
+	sort.Slice(e.Advertised, less(e.Advertised))
+	sort.Slice(e.Withdrawn, less(e.Withdrawn))
+
+	return e
+}
+
+func notificationEvent(peer string, n notification, sent bool) Event {
+	x := &Notification{Code: n.code, Subcode: n.sub, Data: n.data, Text: n.note()}
+
+	if text, ok := n.communication(); ok {
+		x.Communication = text
+	}
+
+	return Event{Type: EVENT_NOTIFICATION, Peer: peer, Notification: x, Sent: sent}
+}
@@ -0,0 +1,205 @@
+/*
+ * VC5 load balancer. Copyright (C) 2021-present David Coles
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package bgp
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+type slow struct {
+	mutex  sync.Mutex
+	block  chan bool
+	events []Event
+}
+
+func (s *slow) BGPEvent(e Event) {
+	<-s.block
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.events = append(s.events, e)
+}
+
+func (s *slow) received() []Event {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]Event{}, s.events...)
+}
+
+type sessions struct {
+	mutex   sync.Mutex
+	reasons []string
+}
+
+func (s *sessions) BGPPeer(string, Parameters, bool) {}
+func (s *sessions) BGPSession(peer string, local bool, reason string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.reasons = append(s.reasons, reason)
+}
+
+func TestEventQueue(t *testing.T) {
+	h := &slow{block: make(chan bool)}
+
+	var e events
+	e.add(h)
+
+	// emitting must not wait for the handler
+	done := make(chan bool)
+	go func() {
+		for n := 0; n < event_queue+10; n++ {
+			e.emit(Event{Type: EVENT_TIMER, Messages: n})
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Emit blocked by a slow handler")
+	}
+
+	close(h.block)
+
+	for n := 0; n < 500 && len(h.received()) < event_queue; n++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	e.emit(Event{Type: EVENT_CLOSED})
+
+	var r []Event
+	for n := 0; n < 500; n++ {
+		if r = h.received(); len(r) > 0 && r[len(r)-1].Type == EVENT_CLOSED {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if len(r) < 2 || r[len(r)-1].Type != EVENT_CLOSED {
+		t.Fatal("Events not delivered:", len(r))
+	}
+
+	// delivered in order, with the overflow reported on the first event after it
+	for i, x := range r[:len(r)-1] {
+		if x.Messages != i {
+			t.Fatal("Events out of order:", i, x.Messages)
+		}
+	}
+
+	if last := r[len(r)-1]; last.Dropped == 0 || uint64(len(r)-1)+last.Dropped != event_queue+10 {
+		t.Error("Unexpected dropped count:", last.Dropped, len(r))
+	}
+}
+
+func TestEventNotifyReplaced(t *testing.T) {
+	var e events
+	var a, b sessions
+
+	e.notify(&a)
+	e.notify(&b) // eg. a session restarted with a new BGPNotify
+	e.emit(Event{Type: EVENT_CLOSED, Reason: "test"})
+
+	for n := 0; n < 500; n++ {
+		b.mutex.Lock()
+		l := len(b.reasons)
+		b.mutex.Unlock()
+		if l > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+
+	if len(a.reasons) != 0 || len(b.reasons) != 1 {
+		t.Error("Unexpected notifications:", a.reasons, b.reasons)
+	}
+}
+
+type blocked struct {
+	sessions
+	block chan bool
+	peers []bool
+}
+
+func (b *blocked) BGPPeer(peer string, p Parameters, add bool) {
+	<-b.block
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.peers = append(b.peers, add)
+}
+
+func (b *blocked) BGPSession(peer string, local bool, reason string) {
+	<-b.block
+	b.sessions.BGPSession(peer, local, reason)
+}
+
+// events that a BGPNotify ignores are not queued for it, and peer
+// changes and closures are never dropped
+func TestEventNotifyNotDropped(t *testing.T) {
+	var e events
+	b := &blocked{block: make(chan bool)}
+
+	e.notify(b)
+
+	for n := 0; n < 2*event_queue; n++ {
+		e.emit(Event{Type: EVENT_UPDATE})
+	}
+
+	e.mutex.Lock()
+	queued := len(e.queue)
+	e.mutex.Unlock()
+
+	if queued != 0 {
+		t.Error("Unwanted events queued:", queued)
+	}
+
+	for n := 0; n < 2*event_queue; n++ {
+		e.emit(Event{Type: EVENT_VERIFIED, Reason: "verified"})
+	}
+
+	e.emit(Event{Type: EVENT_PEER_ADDED})
+	e.emit(Event{Type: EVENT_PEER_REMOVED})
+	e.emit(Event{Type: EVENT_CLOSED, Reason: "closed"})
+
+	close(b.block)
+
+	for n := 0; n < 500; n++ {
+		b.mutex.Lock()
+		l := len(b.reasons)
+		done := l > 0 && b.reasons[l-1] == "closed"
+		b.mutex.Unlock()
+		if done {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if len(b.peers) != 2 || !b.peers[0] || b.peers[1] {
+		t.Error("Unexpected peer notifications:", b.peers)
+	}
+
+	if l := len(b.reasons); l < 2 || l > event_queue+1 || b.reasons[l-1] != "closed" {
+		t.Error("Unexpected session notifications:", l)
+	}
+}
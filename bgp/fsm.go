@@ -0,0 +1,149 @@
+/*
+ * VC5 load balancer. Copyright (C) 2021-present David Coles
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+// https://datatracker.ietf.org/doc/html/rfc4271#section-8 - BGP Finite State Machine
+// https://datatracker.ietf.org/doc/html/rfc6608 - Subcodes for BGP Finite State Machine Error
+
+package bgp
+
+import (
+	"fmt"
+	"time"
+)
+
+const fsm_history = 32 // number of transitions retained
+
+type Transition struct {
+	From   string    `json:"from"`
+	To     string    `json:"to"`
+	When   time.Time `json:"when"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+// The state of a session, driven by the messages received from the
+// peer. Only the outbound (connecting) side of the RFC 4271 FSM is
+// implemented - we never accept connections, so there is no collision
+// detection.
+type fsm struct {
+	state   string
+	history []Transition
+
+	// used to validate the peer's OPEN
+	routerID IP4
+	peerAS   uint32 // 0 to accept any AS
+	peerID   IP4    // 0.0.0.0 to accept any router ID
+}
+
+func newFSM() fsm {
+	return fsm{state: IDLE}
+}
+
+func (f *fsm) transition(state, reason string, when time.Time) {
+	if len(f.history) >= fsm_history {
+		f.history = append(f.history[:0], f.history[1:]...)
+	}
+
+	f.history = append(f.history, Transition{From: f.state, To: state, When: when, Reason: reason})
+	f.state = state
+}
+
+// Process a message received from the peer. If the message is not
+// acceptable in the current state then the notification which should
+// be sent to the peer is returned with ok set to false. NOTIFICATIONs
+// are always acceptable - the session is closed by the caller.
+func (f *fsm) received(m message, when time.Time) (n notification, ok bool) {
+
+	unexpected := func() (notification, bool) {
+		switch f.state {
+		case OPEN_SENT:
+			return notification{code: FSM_ERROR, sub: UNEXPECTED_IN_OPEN_SENT}, false
+		case OPEN_CONFIRM:
+			return notification{code: FSM_ERROR, sub: UNEXPECTED_IN_OPEN_CONFIRM}, false
+		case ESTABLISHED:
+			return notification{code: FSM_ERROR, sub: UNEXPECTED_IN_ESTABLISHED}, false
+		}
+		return notification{code: FSM_ERROR}, false
+	}
+
+	switch m.Type() {
+	case M_NOTIFICATION:
+		return n, true
+
+	case M_OPEN:
+		o, ok := m.(*open)
+
+		if !ok || f.state != OPEN_SENT {
+			return unexpected()
+		}
+
+		if n, ok := f.open(o); !ok {
+			return n, false
+		}
+
+		f.transition(OPEN_CONFIRM, fmt.Sprintf("OPEN received from AS %d", o.peerAS()), when)
+
+	case M_KEEPALIVE:
+		switch f.state {
+		case OPEN_CONFIRM:
+			f.transition(ESTABLISHED, "KEEPALIVE received", when)
+		case ESTABLISHED:
+		default:
+			return unexpected()
+		}
+
+	case M_UPDATE:
+		if f.state != ESTABLISHED {
+			return unexpected()
+		}
+
+	default:
+		return notification{code: MESSAGE_HEADER_ERROR, sub: BAD_MESSAGE_TYPE, data: []byte{m.Type()}}, false
+	}
+
+	return n, true
+}
+
+// validate the peer's OPEN message
+func (f *fsm) open(o *open) (notification, bool) {
+
+	if o.version != 4 {
+		return notification{code: OPEN_MESSAGE_ERROR, sub: UNSUPPORTED_VERSION_NUMBER, data: []byte{0, 4}}, false
+	}
+
+	// a peer with a 4-octet AS number sends AS_TRANS in the OPEN, with
+	// the real AS number in a capability
+	if f.peerAS != 0 && o.peerAS() != f.peerAS {
+		reason := fmt.Sprintf("Expected AS %d, peer sent AS %d", f.peerAS, o.peerAS())
+		return notification{code: OPEN_MESSAGE_ERROR, sub: BAD_PEER_AS, reason: reason}, false
+	}
+
+	if o.holdTime < 3 { // zero is permitted by RFC 4271, but we always want keepalives
+		return notification{code: OPEN_MESSAGE_ERROR, sub: UNNACEPTABLE_HOLD_TIME}, false
+	}
+
+	if o.routerID == f.routerID || o.routerID == [4]byte{} {
+		return notification{code: OPEN_MESSAGE_ERROR, sub: BAD_BGP_ID}, false
+	}
+
+	if f.peerID != [4]byte{} && o.routerID != f.peerID {
+		reason := fmt.Sprintf("Expected router ID %s, peer sent %s", ip_string(f.peerID), ip_string(o.routerID))
+		return notification{code: OPEN_MESSAGE_ERROR, sub: BAD_BGP_ID, reason: reason}, false
+	}
+
+	return notification{}, true
+}
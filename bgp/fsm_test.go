@@ -0,0 +1,119 @@
+/*
+ * VC5 load balancer. Copyright (C) 2021-present David Coles
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package bgp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFSM(t *testing.T) {
+
+	peer := open{version: 4, asNumber: 65001, holdTime: 90, routerID: [4]byte{10, 0, 0, 2}}
+	update := &other{mtype: M_UPDATE}
+
+	start := func() *fsm {
+		f := newFSM()
+		f.routerID = [4]byte{10, 0, 0, 1}
+		f.peerAS = 65001
+		f.peerID = [4]byte{10, 0, 0, 2}
+		f.transition(OPEN_SENT, "OPEN sent", time.Now())
+		return &f
+	}
+
+	f := start()
+
+	for _, x := range []struct {
+		m     message
+		state string
+	}{
+		{&peer, OPEN_CONFIRM},
+		{&keepalive{}, ESTABLISHED},
+		{update, ESTABLISHED},
+		{&keepalive{}, ESTABLISHED},
+	} {
+		if n, ok := f.received(x.m, time.Now()); !ok || f.state != x.state {
+			t.Fatalf("Expected %s, got %s (%d:%d)", x.state, f.state, n.code, n.sub)
+		}
+	}
+
+	if len(f.history) != 3 || f.history[1].To != OPEN_CONFIRM || f.history[2].From != OPEN_CONFIRM {
+		t.Error("Unexpected history:", f.history)
+	}
+
+	bad := func(o open) *open { return &o }
+
+	for _, x := range []struct {
+		name      string
+		ms        []message
+		code, sub uint8
+	}{
+		{"keepalive in OpenSent", []message{&keepalive{}}, FSM_ERROR, UNEXPECTED_IN_OPEN_SENT},
+		{"update in OpenSent", []message{update}, FSM_ERROR, UNEXPECTED_IN_OPEN_SENT},
+		{"open in OpenConfirm", []message{&peer, &peer}, FSM_ERROR, UNEXPECTED_IN_OPEN_CONFIRM},
+		{"update in OpenConfirm", []message{&peer, update}, FSM_ERROR, UNEXPECTED_IN_OPEN_CONFIRM},
+		{"open in Established", []message{&peer, &keepalive{}, &peer}, FSM_ERROR, UNEXPECTED_IN_ESTABLISHED},
+		{"bad type", []message{&other{mtype: 99}}, MESSAGE_HEADER_ERROR, BAD_MESSAGE_TYPE},
+		{"version", []message{bad(open{version: 3, asNumber: 65001, holdTime: 90, routerID: [4]byte{10, 0, 0, 2}})}, OPEN_MESSAGE_ERROR, UNSUPPORTED_VERSION_NUMBER},
+		{"peer AS", []message{bad(open{version: 4, asNumber: 65002, holdTime: 90, routerID: [4]byte{10, 0, 0, 2}})}, OPEN_MESSAGE_ERROR, BAD_PEER_AS},
+		{"hold time", []message{bad(open{version: 4, asNumber: 65001, holdTime: 2, routerID: [4]byte{10, 0, 0, 2}})}, OPEN_MESSAGE_ERROR, UNNACEPTABLE_HOLD_TIME},
+		{"router ID", []message{bad(open{version: 4, asNumber: 65001, holdTime: 90, routerID: [4]byte{10, 0, 0, 1}})}, OPEN_MESSAGE_ERROR, BAD_BGP_ID},
+		{"peer ID", []message{bad(open{version: 4, asNumber: 65001, holdTime: 90, routerID: [4]byte{10, 0, 0, 3}})}, OPEN_MESSAGE_ERROR, BAD_BGP_ID},
+		{"AS4", []message{bad(open{version: 4, asNumber: 65001, holdTime: 90, routerID: [4]byte{10, 0, 0, 2}, as4: true, asNumber4: 65537})}, OPEN_MESSAGE_ERROR, BAD_PEER_AS},
+	} {
+		f := start()
+
+		var n notification
+		var ok bool
+
+		for _, m := range x.ms {
+			if n, ok = f.received(m, time.Now()); !ok {
+				break
+			}
+		}
+
+		if ok || n.code != x.code || n.sub != x.sub {
+			t.Errorf("%s: expected %d:%d, got %d:%d", x.name, x.code, x.sub, n.code, n.sub)
+		}
+	}
+
+	// a 4-octet AS number is taken from the capability
+	f = start()
+	f.peerAS = 4200000001
+
+	if _, ok := f.received(bad(open{version: 4, asNumber: AS_TRANS, holdTime: 90, routerID: [4]byte{10, 0, 0, 2}, as4: true, asNumber4: 4200000001}), time.Now()); !ok {
+		t.Error("OPEN rejected")
+	}
+
+	// any AS is acceptable if none is configured
+	f = start()
+	f.peerAS = 0
+
+	if _, ok := f.received(bad(open{version: 4, asNumber: 64999, holdTime: 90, routerID: [4]byte{10, 0, 0, 2}}), time.Now()); !ok {
+		t.Error("OPEN rejected")
+	}
+
+	for n := 0; n < fsm_history*2; n++ {
+		f.transition(IDLE, "", time.Now())
+	}
+
+	if len(f.history) != fsm_history {
+		t.Error("History not bounded:", len(f.history))
+	}
+}
@@ -0,0 +1,241 @@
+/*
+ * VC5 load balancer. Copyright (C) 2021-present David Coles
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package bgp
+
+import (
+	"bytes"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func FuzzRead(f *testing.F) {
+	o := open{asNumber: 65000, holdTime: 90, routerID: [4]byte{10, 0, 0, 1}, multiprotocol: true, extended: true}
+	n := notification{code: CEASE, sub: ADMINISTRATIVE_SHUTDOWN, data: shutdownCommunication("maintenance")}
+
+	f.Add([]byte(append(frame(M_OPEN, o.message()), frame(M_KEEPALIVE, nil)...)), false)
+	f.Add([]byte(frame(M_NOTIFICATION, n.Body())), true)
+	f.Add([]byte(frame(M_UPDATE, []byte{0, 0, 0, 0})), false)
+
+	f.Fuzz(func(t *testing.T, b []byte, extended bool) {
+		max := MAX_MESSAGE_LENGTH
+
+		if extended {
+			max = MAX_EXTENDED_MESSAGE_LENGTH
+		}
+
+		r := bytes.NewReader(b)
+
+		for {
+			p, m, err := read(r, max)
+
+			if err != nil {
+				return
+			}
+
+			if len(p) < 19 || len(p) > max {
+				t.Fatal("Bad PDU length", len(p))
+			}
+
+			if m.Type() != p[18] {
+				t.Fatal("Type mismatch", m.Type(), p[18])
+			}
+
+			if n, ok := m.(*notification); ok {
+				n.note()
+			}
+		}
+	})
+}
+
+func FuzzOpen(f *testing.F) {
+	o := open{asNumber: 65000, holdTime: 90, routerID: [4]byte{10, 0, 0, 1}, multiprotocol: true, extended: true}
+
+	f.Add(o.message())
+	f.Add([]byte{4, 0, 1, 0, 90, 10, 0, 0, 1, 255})
+	f.Add([]byte{4, 0, 1, 0, 90, 10, 0, 0, 1, 4, 2, 2, 1, 9})
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		if len(b) > MAX_MESSAGE_LENGTH-19 {
+			return
+		}
+
+		_, m, err := read(bytes.NewReader(frame(M_OPEN, b)), MAX_MESSAGE_LENGTH)
+
+		var o open
+
+		if e := o.parse(b); e != nil {
+			// malformed OPENs must be rejected with a NOTIFICATION
+			x, ok := err.(*messageError)
+
+			if !ok || x.code != e.code || x.sub != e.sub {
+				t.Fatal("Malformed OPEN not rejected", err)
+			}
+
+			if x.code != OPEN_MESSAGE_ERROR && !(x.code == MESSAGE_HEADER_ERROR && len(b) < 10) {
+				t.Fatal("Unexpected error", x)
+			}
+
+			return
+		}
+
+		if err != nil || m.Type() != M_OPEN {
+			t.Fatal("Valid OPEN rejected", err)
+		}
+
+		// the exported decoder should accept anything the session does
+		// (bar trailing data after the optional parameters)
+		if len(b) == 10+int(b[9]) {
+			if _, err := decodeOpen(b); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// round trip the parsed values
+		var x open
+
+		if x.parse(o.message()) != nil {
+			t.Fatal("Failed to parse re-encoded OPEN")
+		}
+
+		if x.asNumber != o.asNumber || x.holdTime != o.holdTime || x.routerID != o.routerID || x.multiprotocol != o.multiprotocol || x.extended != o.extended {
+			t.Fatal("Round trip mismatch", o, x)
+		}
+	})
+}
+
+func FuzzDecode(f *testing.F) {
+	a := advert{ASNumber: 65000, Multiprotocol: true, Communities: []Community{1}, external: true}
+	rib := map[netip.Addr]bool{netip.MustParseAddr("10.0.0.1"): true, netip.MustParseAddr("fd00::1"): false}
+	u := a.message(rib)
+
+	f.Add([]byte(frame(M_UPDATE, u.Body())), false)
+	f.Add([]byte(frame(M_NOTIFICATION, []byte{CEASE, ADMINISTRATIVE_SHUTDOWN, 2, 'h', 'i'})), true)
+
+	f.Fuzz(func(t *testing.T, b []byte, as4 bool) {
+		d := Decoder{AS4: as4}
+
+		m, n, err := d.Decode(b)
+
+		if n > len(b) {
+			t.Fatal("Consumed more than the input", n, len(b))
+		}
+
+		if err == nil && m.Update != nil {
+			m.Update.Routes()
+		}
+	})
+}
+
+// prefixes encoded with advert.message must survive a round trip through the decoder
+func FuzzAdvert(f *testing.F) {
+	f.Add(uint8(0), []byte{10, 0, 0, 1, 1})
+	f.Add(uint8(7), []byte{0xfd, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 192, 168, 0, 1, 1})
+
+	f.Fuzz(func(t *testing.T, flags uint8, b []byte) {
+		a := advert{
+			ASNumber:      65000,
+			NextHop:       [4]byte{10, 0, 0, 1},
+			Multiprotocol: flags&1 != 0,
+			IPv6:          flags&2 != 0,
+			external:      flags&4 != 0,
+			MED:           uint32(flags),
+			Communities:   []Community{Community(flags)},
+		}
+
+		rib := map[netip.Addr]bool{}
+
+		// consume 4 or 16 byte addresses, each followed by a reachability flag
+		for len(rib) < 1000 {
+			if len(b) >= 17 && b[0]&0xf0 == 0xf0 {
+				rib[netip.AddrFrom16(*(*[16]byte)(b[:16]))] = b[16]&1 != 0
+				b = b[17:]
+			} else if len(b) >= 5 {
+				rib[netip.AddrFrom4([4]byte{b[0], b[1], b[2], b[3]})] = b[4]&1 != 0
+				b = b[5:]
+			} else {
+				break
+			}
+		}
+
+		u := a.message(rib)
+
+		m, _, err := Decode(frame(M_UPDATE, u.Body()))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		advertised, withdrawn := m.Update.Routes()
+
+		got := map[netip.Addr]bool{}
+
+		for _, p := range advertised {
+			got[p.Addr()] = true
+		}
+
+		for _, p := range withdrawn {
+			if _, ok := got[p.Addr()]; ok {
+				t.Fatal("Prefix both advertised and withdrawn", p)
+			}
+			got[p.Addr()] = false
+		}
+
+		if len(got) != len(rib) {
+			t.Fatal("Prefix count mismatch", len(got), len(rib))
+		}
+
+		for k, v := range rib {
+			if r, ok := got[k]; !ok || r != v {
+				t.Fatal("Prefix mismatch", k, v)
+			}
+		}
+	})
+}
+
+func FuzzMRTReader(f *testing.F) {
+	p := peerinfo{
+		local:     netip.MustParseAddrPort("[fd00::1]:12345"),
+		remote:    netip.MustParseAddrPort("[fd00::2]:179"),
+		localASN:  65000,
+		remoteASN: 65001,
+		as4:       true,
+	}
+
+	f.Add(mrtRecord(time.Unix(1700000000, 0), p, frame(M_KEEPALIVE, nil), true))
+	f.Add([]byte{0, 0, 0, 0, 0, MRT_BGP4MP_ET, 0, BGP4MP_MESSAGE, 0xff, 0xff, 0xff, 0xff})
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		r := NewMRTReader(bytes.NewReader(b))
+
+		for {
+			rec, err := r.Next()
+
+			if err != nil {
+				return
+			}
+
+			if len(rec.Message) > MAX_EXTENDED_MESSAGE_LENGTH {
+				t.Fatal("Message too long", len(rec.Message))
+			}
+
+			rec.Decode()
+		}
+	})
+}
@@ -20,6 +20,8 @@ package bgp
 
 import (
 	"net/netip"
+	"sort"
+	"unicode/utf8"
 )
 
 type message interface {
@@ -33,6 +35,8 @@ type notification struct {
 	code uint8
 	sub  uint8
 	data []byte
+
+	reason string // local explanation for logs - not sent to the peer
 }
 
 func (n notification) message() []byte {
@@ -71,26 +75,144 @@ func (n *notification) parse(d []byte) bool {
 	return true
 }
 
+// RFC 9003: a CEASE notification with the Administrative Shutdown or
+// Administrative Reset subcode may carry a length octet followed by up
+// to 255 octets of UTF-8 text explaining why the session was closed
+func shutdownCommunication(reason string) []byte {
+	if len(reason) < 1 {
+		return nil
+	}
+
+	text := []byte(reason)
+
+	for len(text) > 255 {
+		_, n := utf8.DecodeLastRune(text) // truncate on a character boundary
+		text = text[:len(text)-n]
+	}
+
+	return append([]byte{byte(len(text))}, text...)
+}
+
+// returns the text of a shutdown communication, if the notification carries one
+func (n *notification) communication() (string, bool) {
+	if n.code != CEASE || (n.sub != ADMINISTRATIVE_SHUTDOWN && n.sub != ADMINISTRATIVE_RESET) {
+		return "", false
+	}
+
+	if len(n.data) < 1 {
+		return "", false
+	}
+
+	l := int(n.data[0])
+
+	if l+1 > len(n.data) || !utf8.Valid(n.data[1:l+1]) {
+		return "", false
+	}
+
+	return string(n.data[1 : l+1]), true
+}
+
 type open struct {
 	asNumber      uint16
 	holdTime      uint16
 	routerID      [4]byte
 	multiprotocol bool
+	extended      bool
+	as4           bool   // 4-octet AS number capability
+	asNumber4     uint32 // the AS number from the capability
+	refresh       bool   // route refresh capability
 
 	version byte
 	op      []byte
+	raw     []byte // message body as received
 }
 
-func (o *open) parse(d []byte) bool {
+// Parse the body of an OPEN message. If it is malformed then the
+// error describes the NOTIFICATION which should be sent in response.
+func (o *open) parse(d []byte) *messageError {
 	if len(d) < 10 {
-		return false
+		l := htons(uint16(19 + len(d)))
+		return &messageError{code: MESSAGE_HEADER_ERROR, sub: BAD_MESSAGE_LENGTH, data: l[:]}
 	}
+	o.raw = d
 	o.version = d[0]
 	o.asNumber = (uint16(d[1]) << 8) | uint16(d[2])
 	o.holdTime = (uint16(d[3]) << 8) | uint16(d[4])
 	copy(o.routerID[:], d[5:9])
-	o.op = d[10:]
-	return true
+
+	l := int(d[9]) // optional parameters length
+
+	if len(d) < 10+l {
+		return &messageError{code: OPEN_MESSAGE_ERROR, sub: UNSPECIFIC}
+	}
+
+	o.op = d[10 : 10+l]
+
+	caps, ok := capabilities(o.op)
+
+	if !ok {
+		return &messageError{code: OPEN_MESSAGE_ERROR, sub: UNSPECIFIC}
+	}
+
+	// capabilities are the only optional parameter in use [RFC5492]
+	for p := o.op; len(p) > 0; p = p[2+int(p[1]):] {
+		if p[0] != CAPABILITIES_OPTIONAL_PARAMETER {
+			return &messageError{code: OPEN_MESSAGE_ERROR, sub: UNSUPPORTED_OPTIONAL_PARAMETER}
+		}
+	}
+
+	for _, c := range caps {
+		switch c.code {
+		case BGP4_MP:
+			o.multiprotocol = true
+		case EXTENDED_MESSAGE:
+			o.extended = true
+		case ROUTE_REFRESH:
+			o.refresh = true
+		case AS4_CAPABILITY:
+			if len(c.value) == 4 {
+				o.as4 = true
+				o.asNumber4 = uint32(c.value[0])<<24 | uint32(c.value[1])<<16 | uint32(c.value[2])<<8 | uint32(c.value[3])
+			}
+		}
+	}
+
+	return nil
+}
+
+type capability struct {
+	code  byte
+	value []byte
+}
+
+// extract the capabilities from an OPEN message's optional parameters
+func capabilities(op []byte) (caps []capability, ok bool) {
+
+	// Optional Parameters: Parm.Type[1], Parm.Length[1], Parm.Value[...]
+	for len(op) > 0 {
+		if len(op) < 2 || len(op) < 2+int(op[1]) {
+			return nil, false
+		}
+
+		t, v := op[0], op[2:2+int(op[1])]
+		op = op[2+int(op[1]):]
+
+		if t != CAPABILITIES_OPTIONAL_PARAMETER {
+			continue
+		}
+
+		// Capability Code (1 octet), Capability Length (1 octet), Capability Value (variable)
+		for len(v) > 0 {
+			if len(v) < 2 || len(v) < 2+int(v[1]) {
+				return nil, false
+			}
+
+			caps = append(caps, capability{code: v[0], value: v[2 : 2+int(v[1])]})
+			v = v[2+int(v[1]):]
+		}
+	}
+
+	return caps, true
 }
 
 func (o *open) message() []byte {
@@ -118,11 +240,30 @@ func (o *open) message() []byte {
 		params = append(params, param_ipv4...)
 	}
 
+	// https://datatracker.ietf.org/doc/html/rfc8654 - Extended Message Support for BGP
+	if o.extended {
+		params = append(params, CAPABILITIES_OPTIONAL_PARAMETER, 2, EXTENDED_MESSAGE, 0)
+	}
+
+	// https://datatracker.ietf.org/doc/html/rfc6793 - BGP Support for Four-Octet Autonomous System (AS) Number Space
+	if o.as4 {
+		as4 := htonl(o.asNumber4)
+		params = append(params, CAPABILITIES_OPTIONAL_PARAMETER, 6, AS4_CAPABILITY, 4, as4[0], as4[1], as4[2], as4[3])
+	}
+
 	params = append([]byte{byte(len(params))}, params...)
 
 	return append(open, params...)
 }
 
+// The peer's AS number - taken from the 4-octet AS number capability if present
+func (o *open) peerAS() uint32 {
+	if o.as4 {
+		return o.asNumber4
+	}
+	return uint32(o.asNumber)
+}
+
 type advert struct {
 	NextHop       [4]byte
 	NextHop6      [16]byte
@@ -135,64 +276,102 @@ type advert struct {
 	IPv6          bool
 
 	external bool
+	as4      bool   // encode AS_PATH with 4-octet AS numbers
+	policy   Policy // may set attributes per prefix
 }
 
-func (a *advert) withParameters(p Parameters, remoteASNumber uint16) (r advert) {
+func (a *advert) withParameters(p Parameters, remoteASNumber uint32) (r advert) {
 	r = *a
 	r.Communities = p.Communities
 	r.LocalPref = p.LocalPref
 	r.MED = p.MED
-	r.external = a.ASNumber != remoteASNumber
+	r.external = uint32(a.ASNumber) != remoteASNumber
+	r.policy = p.Policy
 	return
 }
 
-func (a *advert) updates(m map[netip.Addr]bool) (ret []message) {
+// Pack the prefixes into as few UPDATE messages as possible without
+// any exceeding the maximum message size negotiated with the peer
+// (4096, or 65535 with RFC 8654 extended messages). The size of each
+// message is tracked as prefixes are added, using the worst case
+// (extended length) encoding for the multiprotocol attributes.
+func (a *advert) updates(m map[netip.Addr]bool, max int) (ret []message) {
 
 	if len(m) < 1 {
 		return nil
 	}
 
-	msg := a.message(m)
-
-	if len(msg) < 4000 {
-		return append(ret, &msg)
+	if len(a.policy) > 0 {
+		return a.exported(m, max)
 	}
 
-	if len(m) == 1 {
-		// couldn't fit a singe prefix into one UPDATE message extremely
-		// suspect - maybe the communities list is ridiculously long
-		return nil
+	// header, withdrawn routes length, total path attribute length and common attributes
+	base := 19 + 2 + 2 + len(a.attributes())
+
+	// flags, type, extended length, AFI/SAFI, next hop length, next hop, SNPAs
+	mp_reach := 4 + 3 + 1 + len(a.NextHop6) + 1
+	mp_unreach := 4 + 3
+
+	var prefixes []netip.Addr
+	for k, _ := range m {
+		prefixes = append(prefixes, k)
 	}
 
-	// split the set of prefixes in half and try each recursively -
-	// indicates a fairly pathological usage of the library!
-	l := len(m) / 2
+	sort.Slice(prefixes, func(i, j int) bool { return prefixes[i].Less(prefixes[j]) })
 
-	m1 := map[netip.Addr]bool{}
-	m2 := map[netip.Addr]bool{}
+	var size int
+	var reach6, unreach6 bool
+	chunk := map[netip.Addr]bool{}
 
-	var n int
-	for k, v := range m {
-		if n < l {
-			m1[k] = v
-		} else {
-			m2[k] = v
+	cost := func(p netip.Addr) int {
+		if p.Is4() {
+			return 5 // length octet and 4 bytes of prefix
 		}
-		n++
-	}
 
-	if m := a.updates(m1); len(m) < 1 {
-		return nil
-	} else {
-		ret = append(ret, m...)
+		c := 17 // length octet and 16 bytes of prefix
+
+		if m[p] && !reach6 {
+			c += mp_reach
+		}
+
+		if !m[p] && !unreach6 {
+			c += mp_unreach
+		}
+
+		return c
 	}
 
-	if m := a.updates(m2); len(m) < 1 {
-		return nil
-	} else {
-		ret = append(ret, m...)
+	for _, p := range prefixes {
+
+		if len(chunk) > 0 && base+size+cost(p) > max {
+			msg := a.message(chunk)
+			ret = append(ret, &msg)
+			chunk = map[netip.Addr]bool{}
+			size = 0
+			reach6, unreach6 = false, false
+		}
+
+		if base+size+cost(p) > max {
+			// couldn't fit a singe prefix into one UPDATE message extremely
+			// suspect - maybe the communities list is ridiculously long
+			return nil
+		}
+
+		size += cost(p)
+		chunk[p] = m[p]
+
+		if p.Is6() {
+			if m[p] {
+				reach6 = true
+			} else {
+				unreach6 = true
+			}
+		}
 	}
 
+	msg := a.message(chunk)
+	ret = append(ret, &msg)
+
 	return ret
 }
 
@@ -200,7 +379,6 @@ func (a *advert) updates(m map[netip.Addr]bool) (ret []message) {
 func (a *advert) message(rib map[netip.Addr]bool) update {
 
 	next_hop_address6 := a.NextHop6[:] // should be 16 or 32 bytes - a global adddress or global+link-local pair
-	next_hop_address4 := a.NextHop
 
 	var withdrawn []byte
 	var advertise []byte
@@ -232,11 +410,84 @@ func (a *advert) message(rib map[netip.Addr]bool) update {
 		}
 	}
 
+	path_attributes := a.attributes()
+
+	if len(advertise6) > 0 {
+		// https://datatracker.ietf.org/doc/html/rfc2545
+		mp_reach_nlri := []byte{0, 2, 1} // IPv6 unicast AFI 2, SAFI 1
+		mp_reach_nlri = append(mp_reach_nlri, byte(len(next_hop_address6)))
+		mp_reach_nlri = append(mp_reach_nlri, next_hop_address6...)
+		mp_reach_nlri = append(mp_reach_nlri, 0) // Number of SNPAs (1 octet) - none
+		mp_reach_nlri = append(mp_reach_nlri, advertise6...)
+
+		if len(mp_reach_nlri) > 255 {
+			hilo := htons(uint16(len(mp_reach_nlri)))
+			attr := append([]byte{ONCE, MP_REACH_NLRI, hilo[0], hilo[1]}, mp_reach_nlri...)
+			path_attributes = append(path_attributes, attr...)
+		} else {
+			attr := append([]byte{ONCR, MP_REACH_NLRI, byte(len(mp_reach_nlri))}, mp_reach_nlri...)
+			path_attributes = append(path_attributes, attr...)
+		}
+	}
+
+	if len(withdrawn6) > 0 {
+		mp_unreach_nlri := []byte{0, 2, 1} // IPv6 unicast AFI 2, SAFI 1
+		mp_unreach_nlri = append(mp_unreach_nlri, withdrawn6...)
+
+		if len(mp_unreach_nlri) > 255 {
+			hilo := htons(uint16(len(mp_unreach_nlri)))
+			attr := append([]byte{ONCE, MP_UNREACH_NLRI, hilo[0], hilo[1]}, mp_unreach_nlri...)
+			path_attributes = append(path_attributes, attr...)
+		} else {
+			attr := append([]byte{ONCR, MP_UNREACH_NLRI, byte(len(mp_unreach_nlri))}, mp_unreach_nlri...)
+			path_attributes = append(path_attributes, attr...)
+		}
+	}
+
+	//   +-----------------------------------------------------+
+	//   |   Withdrawn Routes Length (2 octets)                |
+	//   +-----------------------------------------------------+
+	//   |   Withdrawn Routes (variable)                       |
+	//   +-----------------------------------------------------+
+	//   |   Total Path Attribute Length (2 octets)            |
+	//   +-----------------------------------------------------+
+	//   |   Path Attributes (variable)                        |
+	//   +-----------------------------------------------------+
+	//   |   Network Layer Reachability Information (variable) |
+	//   +-----------------------------------------------------+
+
+	var update []byte
+
+	wd := htons(uint16(len(withdrawn)))
+
+	//update = append(update, htons(uint16(len(withdrawn)))...)
+	update = append(update, wd[:]...)
+	update = append(update, withdrawn...)
+
+	if len(advertise) > 0 || len(advertise6) > 0 || len(withdrawn6) > 0 {
+		pa := htons(uint16(len(path_attributes)))
+		//update = append(update, htons(uint16(len(path_attributes)))...)
+		update = append(update, pa[:]...)
+		update = append(update, path_attributes...)
+		update = append(update, advertise...)
+	} else {
+		update = append(update, 0, 0) // total path attribute length 0
+	}
+
+	return update
+}
+
+// path attributes common to all prefixes in an UPDATE message -
+// multiprotocol NLRI attributes are added per message
+func (a *advert) attributes() []byte {
+
+	next_hop_address4 := a.NextHop
+
 	// <attribute type, attribute length, attribute value> [data ...]
 	// (Well-known, Mandatory, Transitive, Complete, Regular length), 1(ORIGIN), 1(byte), 0(IGP)
 	origin := []byte{WTCR, ORIGIN, 1, IGP}
 
-	as_path := asPath(a.ASNumber, a.external) // Well-known, Mandatory
+	as_path := asPath(a.ASNumber, a.external, a.as4) // Well-known, Mandatory
 
 	// (Well-known, Mandatory, Transitive, Complete, Regular length). 2(AS_PATH), 0(bytes, if iBGP - may get updated)
 	/*
@@ -314,72 +565,10 @@ func (a *advert) message(rib map[netip.Addr]bool) update {
 		path_attributes = append(path_attributes, attr...)
 	}
 
-	if len(advertise6) > 0 {
-		// https://datatracker.ietf.org/doc/html/rfc2545
-		mp_reach_nlri := []byte{0, 2, 1} // IPv6 unicast AFI 2, SAFI 1
-		mp_reach_nlri = append(mp_reach_nlri, byte(len(next_hop_address6)))
-		mp_reach_nlri = append(mp_reach_nlri, next_hop_address6...)
-		mp_reach_nlri = append(mp_reach_nlri, 0) // Number of SNPAs (1 octet) - none
-		mp_reach_nlri = append(mp_reach_nlri, advertise6...)
-
-		if len(mp_reach_nlri) > 255 {
-			hilo := htons(uint16(len(mp_reach_nlri)))
-			attr := append([]byte{ONCE, MP_REACH_NLRI, hilo[0], hilo[1]}, mp_reach_nlri...)
-			path_attributes = append(path_attributes, attr...)
-		} else {
-			attr := append([]byte{ONCR, MP_REACH_NLRI, byte(len(mp_reach_nlri))}, mp_reach_nlri...)
-			path_attributes = append(path_attributes, attr...)
-		}
-	}
-
-	if len(withdrawn6) > 0 {
-		mp_unreach_nlri := []byte{0, 2, 1} // IPv6 unicast AFI 2, SAFI 1
-		mp_unreach_nlri = append(mp_unreach_nlri, withdrawn6...)
-
-		if len(mp_unreach_nlri) > 255 {
-			hilo := htons(uint16(len(mp_unreach_nlri)))
-			attr := append([]byte{ONCE, MP_UNREACH_NLRI, hilo[0], hilo[1]}, mp_unreach_nlri...)
-			path_attributes = append(path_attributes, attr...)
-		} else {
-			attr := append([]byte{ONCR, MP_UNREACH_NLRI, byte(len(mp_unreach_nlri))}, mp_unreach_nlri...)
-			path_attributes = append(path_attributes, attr...)
-		}
-	}
-
-	//   +-----------------------------------------------------+
-	//   |   Withdrawn Routes Length (2 octets)                |
-	//   +-----------------------------------------------------+
-	//   |   Withdrawn Routes (variable)                       |
-	//   +-----------------------------------------------------+
-	//   |   Total Path Attribute Length (2 octets)            |
-	//   +-----------------------------------------------------+
-	//   |   Path Attributes (variable)                        |
-	//   +-----------------------------------------------------+
-	//   |   Network Layer Reachability Information (variable) |
-	//   +-----------------------------------------------------+
-
-	var update []byte
-
-	wd := htons(uint16(len(withdrawn)))
-
-	//update = append(update, htons(uint16(len(withdrawn)))...)
-	update = append(update, wd[:]...)
-	update = append(update, withdrawn...)
-
-	if len(advertise) > 0 || len(advertise6) > 0 || len(withdrawn6) > 0 {
-		pa := htons(uint16(len(path_attributes)))
-		//update = append(update, htons(uint16(len(path_attributes)))...)
-		update = append(update, pa[:]...)
-		update = append(update, path_attributes...)
-		update = append(update, advertise...)
-	} else {
-		update = append(update, 0, 0) // total path attribute length 0
-	}
-
-	return update
+	return path_attributes
 }
 
-func asPath(asn uint16, external bool) (as_path []byte) {
+func asPath(asn uint16, external, as4 bool) (as_path []byte) {
 
 	as_path = []byte{WTCR, AS_PATH, 0} // (Well-known, Mandatory, Transitive, Complete, Regular length)
 
@@ -399,12 +588,27 @@ func asPath(asn uint16, external bool) (as_path []byte) {
 	//    attribute is one whose length field contains the value zero).
 
 	if external { // as per the above we only add a single AS_SEQUENCE path segment if eBGP - leave the as_path empty otherwise
-		as_number := htons(asn)
 		as_sequence := []byte{AS_SEQUENCE, 1} // Each AS path segment is represented by a triple <segment type, segment length, value>
-		as_sequence = append(as_sequence, as_number[:]...)
+
+		if as4 { // both speakers support 4-octet AS numbers (RFC 6793)
+			as_number := htonl(uint32(asn))
+			as_sequence = append(as_sequence, as_number[:]...)
+		} else {
+			as_number := htons(asn)
+			as_sequence = append(as_sequence, as_number[:]...)
+		}
 		as_path = append(as_path, as_sequence...)
 		as_path[2] = byte(len(as_sequence)) // update length field
 	}
 
 	return
 }
+
+// Ask the peer to re-send its routes for an address family [RFC2918]
+type routeRefresh struct {
+	afi  uint16
+	safi uint8
+}
+
+func (r *routeRefresh) Type() uint8  { return M_ROUTE_REFRESH }
+func (r *routeRefresh) Body() []byte { return []byte{byte(r.afi >> 8), byte(r.afi), 0, r.safi} }
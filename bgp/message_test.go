@@ -0,0 +1,64 @@
+/*
+ * VC5 load balancer. Copyright (C) 2021-present David Coles
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package bgp
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestUpdatePacking(t *testing.T) {
+
+	a := advert{ASNumber: 65000, Multiprotocol: true, Communities: []Community{1, 2, 3}}
+
+	nlri := map[netip.Addr]bool{}
+
+	for n := 0; n < 3000; n++ {
+		ip4 := [4]byte{10, 0, byte(n >> 8), byte(n)}
+		ip6 := [16]byte{0xfd, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, byte(n >> 8), byte(n)}
+		nlri[netip.AddrFrom4(ip4)] = n%2 == 0
+		nlri[netip.AddrFrom16(ip6)] = n%3 == 0
+	}
+
+	for _, max := range []int{MAX_MESSAGE_LENGTH, MAX_EXTENDED_MESSAGE_LENGTH} {
+
+		updates := a.updates(nlri, max)
+
+		var total int
+
+		for _, u := range updates {
+			l := 19 + len(u.Body())
+
+			if l > max {
+				t.Fatalf("Message length %d exceeds maximum %d", l, max)
+			}
+
+			total += l
+		}
+
+		// messages should be well filled - allow one partially filled message
+		if n := len(updates); total < (n-1)*max*9/10 {
+			t.Errorf("Poorly packed: %d messages, %d bytes, max %d", n, total, max)
+		}
+	}
+
+	if u := a.updates(nlri, 50); u != nil {
+		t.Error("Prefixes should not fit in a tiny message")
+	}
+}
@@ -0,0 +1,151 @@
+/*
+ * VC5 load balancer. Copyright (C) 2021-present David Coles
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package bgp
+
+import (
+	"net/netip"
+	"sync"
+)
+
+// Transport and identity details of a session, passed to monitors
+// along with session activity
+type peerinfo struct {
+	peer      string
+	local     netip.AddrPort
+	remote    netip.AddrPort
+	localASN  uint16
+	remoteASN uint32
+	localID   IP
+	remoteID  IP
+	as4       bool // 4-byte AS numbers negotiated
+}
+
+// Exporters of session activity (eg. BMP, MRT) implement this
+// interface. Methods are called from session goroutines and so must
+// not block for long.
+type monitor interface {
+	established(p peerinfo, sent, received pdu)                         // OPEN messages exchanged
+	advertised(p peerinfo, a advert, nlri map[netip.Addr]bool, rib int) // NLRI changes to the Adj-RIB-Out, and pre-policy RIB size
+	closed(p peerinfo, n notification, received bool)                   // session ended
+	message(p peerinfo, m pdu, sent bool)                               // every message sent or received
+}
+
+// A set of monitors which may be shared between the sessions in a pool.
+// The state of established sessions is kept so that it can be replayed
+// to monitors which are added later.
+type monitors struct {
+	mutex sync.Mutex
+	m     []monitor
+	up    map[string]*upstate
+}
+
+type upstate struct {
+	info           peerinfo
+	sent, received pdu
+	tmpl           advert
+	rib            map[netip.Addr]bool
+	total          int
+}
+
+func (m *monitors) add(n monitor) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.m = append(m.m, n)
+
+	for _, u := range m.up {
+		n.established(u.info, u.sent, u.received)
+
+		if len(u.rib) > 0 {
+			rib := map[netip.Addr]bool{}
+			for k, _ := range u.rib {
+				rib[k] = true
+			}
+			n.advertised(u.info, u.tmpl, rib, u.total)
+		}
+	}
+}
+
+func (m *monitors) list() []monitor {
+	if m == nil {
+		return nil
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.m
+}
+
+// update the saved state of a session and return the current monitors
+func (m *monitors) record(f func(map[string]*upstate)) []monitor {
+	if m == nil {
+		return nil
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.up == nil {
+		m.up = map[string]*upstate{}
+	}
+	f(m.up)
+	return m.m
+}
+
+func (m *monitors) established(p peerinfo, sent, received pdu) {
+	list := m.record(func(up map[string]*upstate) {
+		up[p.peer] = &upstate{info: p, sent: sent, received: received, rib: map[netip.Addr]bool{}}
+	})
+
+	for _, n := range list {
+		n.established(p, sent, received)
+	}
+}
+
+func (m *monitors) advertised(p peerinfo, a advert, nlri map[netip.Addr]bool, rib int) {
+	list := m.record(func(up map[string]*upstate) {
+		if u, ok := up[p.peer]; ok {
+			for k, v := range nlri {
+				if v {
+					u.rib[k] = true
+				} else {
+					delete(u.rib, k)
+				}
+			}
+			u.tmpl = a
+			u.total = rib
+		}
+	})
+
+	for _, n := range list {
+		n.advertised(p, a, nlri, rib)
+	}
+}
+
+func (m *monitors) closed(p peerinfo, n notification, received bool) {
+	list := m.record(func(up map[string]*upstate) {
+		delete(up, p.peer)
+	})
+
+	for _, x := range list {
+		x.closed(p, n, received)
+	}
+}
+
+func (m *monitors) message(p peerinfo, x pdu, sent bool) {
+	for _, n := range m.list() {
+		n.message(p, x, sent)
+	}
+}
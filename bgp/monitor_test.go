@@ -0,0 +1,73 @@
+/*
+ * VC5 load balancer. Copyright (C) 2021-present David Coles
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package bgp
+
+import (
+	"net/netip"
+	"testing"
+)
+
+type recorder struct {
+	ups   int
+	rib   map[netip.Addr]bool
+	downs int
+}
+
+func (r *recorder) established(peerinfo, pdu, pdu) { r.ups++ }
+func (r *recorder) advertised(_ peerinfo, _ advert, nlri map[netip.Addr]bool, _ int) {
+	for k, v := range nlri {
+		r.rib[k] = v
+	}
+}
+func (r *recorder) closed(peerinfo, notification, bool) { r.downs++ }
+func (r *recorder) message(peerinfo, pdu, bool)         {}
+
+func TestMonitorReplay(t *testing.T) {
+	a := netip.MustParseAddr("192.168.101.1")
+	b := netip.MustParseAddr("192.168.101.2")
+
+	var m monitors
+	p := peerinfo{peer: "10.0.0.1"}
+
+	m.established(p, nil, nil)
+	m.advertised(p, advert{}, map[netip.Addr]bool{a: true, b: true}, 2)
+	m.advertised(p, advert{}, map[netip.Addr]bool{b: false}, 1)
+
+	// a monitor added to an established session is sent its current state
+	r := &recorder{rib: map[netip.Addr]bool{}}
+	m.add(r)
+
+	if r.ups != 1 || len(r.rib) != 1 || !r.rib[a] {
+		t.Error("Established session not replayed:", r)
+	}
+
+	m.closed(p, notification{}, false)
+
+	if r.downs != 1 {
+		t.Error("Close not reported")
+	}
+
+	// nothing to replay once the session has closed
+	r = &recorder{rib: map[netip.Addr]bool{}}
+	m.add(r)
+
+	if r.ups != 0 || len(r.rib) != 0 {
+		t.Error("Closed session replayed:", r)
+	}
+}
@@ -0,0 +1,345 @@
+/*
+ * VC5 load balancer. Copyright (C) 2021-present David Coles
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+// https://datatracker.ietf.org/doc/html/rfc6396 - Multi-Threaded Routing Toolkit (MRT) Routing Information Export Format
+// https://datatracker.ietf.org/doc/html/rfc8050 - MRT Routing Information Export Format with BGP Additional Path Extensions
+
+package bgp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	MRT_BGP4MP    = 16
+	MRT_BGP4MP_ET = 17 // extended timestamp - microsecond resolution
+
+	// received messages, and locally generated messages [RFC8050] - the
+	// AS4 variants are used when 4-byte AS numbers were negotiated
+	BGP4MP_MESSAGE           = 1
+	BGP4MP_MESSAGE_AS4       = 4
+	BGP4MP_MESSAGE_LOCAL     = 6
+	BGP4MP_MESSAGE_AS4_LOCAL = 7
+
+	// the largest BGP4MP_ET record: microsecond timestamp, AS4 message
+	// header with IPv6 addresses and an extended BGP message
+	MAX_MRT_RECORD_LENGTH = 4 + 8 + 4 + 2*16 + MAX_EXTENDED_MESSAGE_LENGTH
+)
+
+// Records every message sent and received by sessions to a file in MRT
+// BGP4MP format, which can be decoded with standard tools such as
+// bgpdump. When the file grows beyond the size limit it is rotated,
+// with previous files renamed with a numeric suffix (.1 being the most
+// recent).
+type MRT struct {
+	mutex   sync.Mutex
+	path    string
+	size    int64
+	keep    int
+	file    *os.File
+	written int64
+	err     error
+}
+
+// Open a recorder writing to the file at path. If size is greater than
+// zero then the file is rotated when it would exceed this many bytes,
+// and up to keep previous files are retained.
+func NewMRT(path string, size int64, keep int) (*MRT, error) {
+	m := &MRT{path: path, size: size, keep: keep}
+
+	if err := m.open(); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// Returns the last error encountered when writing to the file, if any.
+func (m *MRT) Error() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.err
+}
+
+func (m *MRT) Close() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.file == nil {
+		return nil
+	}
+
+	err := m.file.Close()
+	m.file = nil
+	return err
+}
+
+func (m *MRT) open() error {
+	f, err := os.OpenFile(m.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+
+	if err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	m.file = f
+	m.written = info.Size()
+
+	return nil
+}
+
+func (m *MRT) rotate() error {
+	m.file.Close()
+	m.file = nil
+
+	if m.keep < 1 {
+		os.Remove(m.path)
+	} else {
+		for n := m.keep - 1; n > 0; n-- {
+			os.Rename(fmt.Sprintf("%s.%d", m.path, n), fmt.Sprintf("%s.%d", m.path, n+1))
+		}
+
+		if err := os.Rename(m.path, m.path+".1"); err != nil {
+			return err
+		}
+	}
+
+	return m.open()
+}
+
+func (m *MRT) write(r []byte) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.file == nil {
+		return // closed, or failed to rotate
+	}
+
+	if m.size > 0 && m.written > 0 && m.written+int64(len(r)) > m.size {
+		if m.err = m.rotate(); m.err != nil {
+			return
+		}
+	}
+
+	n, err := m.file.Write(r)
+	m.written += int64(n)
+
+	if err != nil {
+		m.err = err
+	}
+}
+
+// Encode a BGP4MP_ET record. For locally generated messages the
+// "peer" fields still refer to the remote system (RFC 8050).
+func mrtRecord(t time.Time, p peerinfo, msg []byte, sent bool) []byte {
+
+	peer := p.remote.Addr().Unmap()
+	local := p.local.Addr().Unmap()
+
+	afi := []byte{0, 1}
+
+	if peer.Is6() {
+		afi = []byte{0, 2}
+	}
+
+	var subtype uint16
+	var body []byte
+
+	// AS4 subtypes must only be used if the AS_PATH in messages is encoded with 4-byte AS numbers
+	if p.as4 {
+		subtype = BGP4MP_MESSAGE_AS4
+		if sent {
+			subtype = BGP4MP_MESSAGE_AS4_LOCAL
+		}
+		pas := htonl(uint32(p.remoteASN))
+		las := htonl(uint32(p.localASN))
+		body = append(body, pas[:]...)
+		body = append(body, las[:]...)
+	} else {
+		subtype = BGP4MP_MESSAGE
+		if sent {
+			subtype = BGP4MP_MESSAGE_LOCAL
+		}
+		pas := htons(uint16(p.remoteASN))
+		las := htons(uint16(p.localASN))
+		body = append(body, pas[:]...)
+		body = append(body, las[:]...)
+	}
+	body = append(body, 0, 0) // interface index
+	body = append(body, afi...)
+	body = append(body, peer.AsSlice()...)
+	body = append(body, local.AsSlice()...)
+	body = append(body, msg...)
+
+	sec := htonl(uint32(t.Unix()))
+	typ := htons(MRT_BGP4MP_ET)
+	sub := htons(subtype)
+	length := htonl(uint32(4 + len(body))) // length includes the microsecond timestamp
+	usec := htonl(uint32(t.Nanosecond() / 1000))
+
+	var r []byte
+	r = append(r, sec[:]...)
+	r = append(r, typ[:]...)
+	r = append(r, sub[:]...)
+	r = append(r, length[:]...)
+	r = append(r, usec[:]...)
+	r = append(r, body...)
+
+	return r
+}
+
+func (m *MRT) message(p peerinfo, msg pdu, sent bool) {
+	m.write(mrtRecord(time.Now(), p, msg, sent))
+}
+
+func (m *MRT) established(peerinfo, pdu, pdu)                        {}
+func (m *MRT) advertised(peerinfo, advert, map[netip.Addr]bool, int) {}
+func (m *MRT) closed(peerinfo, notification, bool)                   {}
+
+// A BGP4MP message record read from an MRT file.
+type MRTRecord struct {
+	Time    time.Time  `json:"time"`
+	Subtype uint16     `json:"subtype"`
+	PeerAS  uint32     `json:"peer_as"`
+	LocalAS uint32     `json:"local_as"`
+	Peer    netip.Addr `json:"peer"`
+	Local   netip.Addr `json:"local"`
+	Sent    bool       `json:"sent"` // locally generated message
+	AS4     bool       `json:"as4"`  // AS_PATH uses 4-byte AS numbers
+	Message Hex        `json:"message"`
+}
+
+// Reads BGP4MP message records from an MRT file. Records of other
+// types and subtypes (eg. state changes, or table dumps) are skipped.
+type MRTReader struct {
+	r io.Reader
+}
+
+func NewMRTReader(r io.Reader) *MRTReader {
+	return &MRTReader{r: r}
+}
+
+// Returns the next message record, or io.EOF at the end of the input.
+func (m *MRTReader) Next() (MRTRecord, error) {
+	for {
+		var hdr [12]byte
+
+		if _, err := io.ReadFull(m.r, hdr[:]); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				return MRTRecord{}, errors.New("Truncated MRT header")
+			}
+			return MRTRecord{}, err
+		}
+
+		typ := binary.BigEndian.Uint16(hdr[4:])
+		sub := binary.BigEndian.Uint16(hdr[6:])
+		length := binary.BigEndian.Uint32(hdr[8:])
+
+		if length > MAX_MRT_RECORD_LENGTH {
+			return MRTRecord{}, fmt.Errorf("MRT record length too long: %d", length)
+		}
+
+		body := make([]byte, length)
+
+		if _, err := io.ReadFull(m.r, body); err != nil {
+			return MRTRecord{}, errors.New("Truncated MRT record")
+		}
+
+		if typ != MRT_BGP4MP && typ != MRT_BGP4MP_ET {
+			continue
+		}
+
+		r := MRTRecord{Time: time.Unix(int64(binary.BigEndian.Uint32(hdr[0:])), 0), Subtype: sub}
+
+		if typ == MRT_BGP4MP_ET {
+			if len(body) < 4 {
+				return r, errors.New("Truncated MRT record")
+			}
+			r.Time = r.Time.Add(time.Duration(binary.BigEndian.Uint32(body)) * time.Microsecond)
+			body = body[4:]
+		}
+
+		switch sub {
+		case BGP4MP_MESSAGE, BGP4MP_MESSAGE_LOCAL:
+			if len(body) < 4 {
+				return r, errors.New("Truncated BGP4MP record")
+			}
+			r.PeerAS = uint32(binary.BigEndian.Uint16(body[0:]))
+			r.LocalAS = uint32(binary.BigEndian.Uint16(body[2:]))
+			body = body[4:]
+		case BGP4MP_MESSAGE_AS4, BGP4MP_MESSAGE_AS4_LOCAL:
+			if len(body) < 8 {
+				return r, errors.New("Truncated BGP4MP record")
+			}
+			r.PeerAS = binary.BigEndian.Uint32(body[0:])
+			r.LocalAS = binary.BigEndian.Uint32(body[4:])
+			r.AS4 = true
+			body = body[8:]
+		default:
+			continue
+		}
+
+		r.Sent = sub == BGP4MP_MESSAGE_LOCAL || sub == BGP4MP_MESSAGE_AS4_LOCAL
+
+		if len(body) < 4 {
+			return r, errors.New("Truncated BGP4MP record")
+		}
+
+		size := 4
+
+		switch binary.BigEndian.Uint16(body[2:]) {
+		case 1:
+		case 2:
+			size = 16
+		default:
+			return r, errors.New("Unsupported BGP4MP address family")
+		}
+
+		body = body[4:] // interface index, address family
+
+		if len(body) < 2*size {
+			return r, errors.New("Truncated BGP4MP record")
+		}
+
+		r.Peer, _ = netip.AddrFromSlice(body[:size])
+		r.Local, _ = netip.AddrFromSlice(body[size : 2*size])
+		r.Message = body[2*size:]
+
+		return r, nil
+	}
+}
+
+// Decode the BGP message in the record.
+func (r *MRTRecord) Decode() (Message, error) {
+	d := Decoder{AS4: r.AS4}
+	m, _, err := d.Decode(r.Message)
+	return m, err
+}
@@ -0,0 +1,188 @@
+/*
+ * VC5 load balancer. Copyright (C) 2021-present David Coles
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package bgp
+
+import (
+	"bytes"
+	"io"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func readMRT(t *testing.T, path string) (records []MRTRecord) {
+	t.Helper()
+
+	f, err := os.Open(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer f.Close()
+
+	r := NewMRTReader(f)
+
+	for {
+		rec, err := r.Next()
+
+		if err == io.EOF {
+			return
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		records = append(records, rec)
+	}
+}
+
+func TestMRTRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bgp.mrt")
+
+	m, err := NewMRT(path, 0, 0)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v4 := peerinfo{
+		local:     netip.MustParseAddrPort("10.0.0.1:12345"),
+		remote:    netip.MustParseAddrPort("10.0.0.2:179"),
+		localASN:  65000,
+		remoteASN: 65001,
+	}
+
+	v6 := peerinfo{
+		local:     netip.MustParseAddrPort("[fd00::1]:12345"),
+		remote:    netip.MustParseAddrPort("[fd00::2]:179"),
+		localASN:  65000,
+		remoteASN: 4200000000,
+		as4:       true,
+	}
+
+	keepalive := frame(M_KEEPALIVE, nil)
+
+	m.message(v4, keepalive, true)
+	m.message(v6, keepalive, false)
+	m.message(v6, keepalive, true)
+
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	type expect struct {
+		subtype uint16
+		peer    netip.Addr
+		local   netip.Addr
+		peerAS  uint32
+		sent    bool
+		as4     bool
+	}
+
+	expected := []expect{
+		{BGP4MP_MESSAGE_LOCAL, v4.remote.Addr(), v4.local.Addr(), 65001, true, false},
+		{BGP4MP_MESSAGE_AS4, v6.remote.Addr(), v6.local.Addr(), 4200000000, false, true},
+		{BGP4MP_MESSAGE_AS4_LOCAL, v6.remote.Addr(), v6.local.Addr(), 4200000000, true, true},
+	}
+
+	records := readMRT(t, path)
+
+	if len(records) != len(expected) {
+		t.Fatal("Unexpected number of records:", len(records))
+	}
+
+	for i, e := range expected {
+		r := records[i]
+
+		if r.Subtype != e.subtype || r.Peer != e.peer || r.Local != e.local || r.PeerAS != e.peerAS || r.LocalAS != 65000 || r.Sent != e.sent || r.AS4 != e.as4 {
+			t.Errorf("Record %d: unexpected %+v", i, r)
+		}
+
+		if msg, err := r.Decode(); err != nil || msg.Keepalive == nil {
+			t.Errorf("Record %d: bad message %v %v", i, msg, err)
+		}
+	}
+}
+
+func TestMRTRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bgp.mrt")
+
+	p := peerinfo{
+		local:  netip.MustParseAddrPort("10.0.0.1:12345"),
+		remote: netip.MustParseAddrPort("10.0.0.2:179"),
+	}
+
+	record := func(n int) []byte {
+		return mrtRecord(time.Unix(int64(n), 0), p, frame(M_KEEPALIVE, nil), true)
+	}
+
+	size := len(record(0))
+
+	// room for two records per file, and two previous files retained
+	m, err := NewMRT(path, int64(size*5/2), 2)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for n := 1; n <= 7; n++ {
+		m.write(record(n))
+	}
+
+	if err := m.Close(); err != nil || m.Error() != nil {
+		t.Fatal(err, m.Error())
+	}
+
+	check := func(file string, times ...int64) {
+		t.Helper()
+
+		records := readMRT(t, file)
+
+		if len(records) != len(times) {
+			t.Fatalf("%s: expected %d records, got %d", file, len(times), len(records))
+		}
+
+		for i, r := range records {
+			if r.Time.Unix() != times[i] {
+				t.Errorf("%s: unexpected record %d", file, r.Time.Unix())
+			}
+		}
+	}
+
+	check(path, 7)
+	check(path+".1", 5, 6)
+	check(path+".2", 3, 4)
+
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Error("Too many files retained")
+	}
+}
+
+func TestMRTRecordLength(t *testing.T) {
+	// a corrupt length must not cause a huge allocation
+	hdr := []byte{0, 0, 0, 0, 0, MRT_BGP4MP, 0, BGP4MP_MESSAGE, 0xff, 0xff, 0xff, 0xff}
+
+	if _, err := NewMRTReader(bytes.NewReader(hdr)).Next(); err == nil || err == io.EOF {
+		t.Error("Expected an error for an oversized record:", err)
+	}
+}
@@ -0,0 +1,216 @@
+/*
+ * VC5 load balancer. Copyright (C) 2021-present David Coles
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package bgp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"sort"
+)
+
+// What to do with a prefix once a term in a policy matches.
+type Action string
+
+const (
+	NEXT   Action = ""       // apply any attributes and continue with the next term
+	ACCEPT Action = "accept" // apply any attributes and advertise the prefix
+	REJECT Action = "reject" // do not advertise the prefix
+)
+
+func (a *Action) UnmarshalText(data []byte) error {
+	switch x := Action(data); x {
+	case NEXT, ACCEPT, REJECT:
+		*a = x
+		return nil
+	}
+	return errors.New("Unknown policy action: " + string(data))
+}
+
+// An export policy, applied to prefixes which pass the Accept/Reject
+// lists. Terms are evaluated in order until one accepts or rejects the
+// prefix; prefixes which fall through all of the terms are accepted
+// with any attributes that were set along the way. For example:
+//
+//	[
+//	  {"match": {"prefixes": ["10.1.0.0/16"]}, "set": {"communities": ["65000:100"], "med": 50}},
+//	  {"match": {"le": 32}, "action": "accept"},
+//	  {"action": "reject"}
+//	]
+type Policy []Term
+
+type Term struct {
+	Name   string `json:"name,omitempty"` // for documentation only
+	Match  Match  `json:"match,omitempty"`
+	Set    Set    `json:"set,omitempty"`
+	Action Action `json:"action,omitempty"`
+}
+
+// All conditions which are specified must be satisfied for a term to
+// match - an empty Match matches every prefix.
+type Match struct {
+	Prefixes []netip.Prefix `json:"prefixes,omitempty"` // address is within any of these prefixes
+	Family   string         `json:"family,omitempty"`   // "ipv4" or "ipv6"
+	Ge       uint8          `json:"ge,omitempty"`       // route prefix length (32 for IPv4 VIPs, 128 for IPv6) is at least this
+	Le       uint8          `json:"le,omitempty"`       // route prefix length is at most this
+}
+
+// Attributes to set on a matching prefix. Zero values leave the
+// attribute unchanged.
+type Set struct {
+	MED         uint32      `json:"med,omitempty"`
+	LocalPref   uint32      `json:"local_pref,omitempty"`
+	Communities []Community `json:"communities,omitempty"` // added to the communities for the session
+}
+
+func (m *Match) UnmarshalJSON(data []byte) error {
+	type match Match
+	var x match
+
+	if err := json.Unmarshal(data, &x); err != nil {
+		return err
+	}
+
+	switch x.Family {
+	case "", "ipv4", "ipv6":
+	default:
+		return errors.New("Unknown address family: " + x.Family)
+	}
+
+	*m = Match(x)
+	return nil
+}
+
+func (m *Match) matches(ip netip.Addr) bool {
+	bits := uint8(ip.BitLen())
+
+	switch {
+	case m.Family == "ipv4" && !ip.Is4():
+		return false
+	case m.Family == "ipv6" && !ip.Is6():
+		return false
+	case m.Ge > 0 && bits < m.Ge:
+		return false
+	case m.Le > 0 && bits > m.Le:
+		return false
+	}
+
+	if len(m.Prefixes) == 0 {
+		return true
+	}
+
+	for _, p := range m.Prefixes {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Evaluate the policy for an address, returning the attributes which
+// it should be advertised with and whether it should be advertised at
+// all.
+func (p Policy) apply(a advert, ip netip.Addr) (advert, bool) {
+	for _, t := range p {
+		if !t.Match.matches(ip) {
+			continue
+		}
+
+		if t.Action == REJECT {
+			return a, false
+		}
+
+		if t.Set.MED != 0 {
+			a.MED = t.Set.MED
+		}
+
+		if t.Set.LocalPref != 0 {
+			a.LocalPref = t.Set.LocalPref
+		}
+
+		if len(t.Set.Communities) > 0 {
+			// copy so that the session's list is not modified
+			a.Communities = append(append([]Community{}, a.Communities...), t.Set.Communities...)
+		}
+
+		if t.Action == ACCEPT {
+			break
+		}
+	}
+
+	return a, true
+}
+
+// UPDATE messages for prefixes which may have had different attributes
+// set by the policy - prefixes which share the same attributes are
+// grouped together. Withdrawals carry no attributes and so are sent
+// with the session's defaults.
+func (a *advert) exported(m map[netip.Addr]bool, max int) (ret []message) {
+
+	type group struct {
+		advert advert
+		nlri   map[netip.Addr]bool
+	}
+
+	base := *a
+	base.policy = nil
+
+	groups := map[string]*group{}
+
+	for ip, v := range m {
+		x := base
+
+		if v {
+			x, _ = a.policy.apply(base, ip)
+		}
+
+		key := fmt.Sprint(x.MED, x.LocalPref, x.Communities)
+
+		g, ok := groups[key]
+
+		if !ok {
+			g = &group{advert: x, nlri: map[netip.Addr]bool{}}
+			groups[key] = g
+		}
+
+		g.nlri[ip] = v
+	}
+
+	var keys []string
+	for k, _ := range groups {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		g := groups[k]
+		u := g.advert.updates(g.nlri, max)
+
+		if len(u) < 1 {
+			return nil
+		}
+
+		ret = append(ret, u...)
+	}
+
+	return ret
+}
@@ -0,0 +1,124 @@
+/*
+ * VC5 load balancer. Copyright (C) 2021-present David Coles
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package bgp
+
+import (
+	"encoding/json"
+	"net/netip"
+	"testing"
+)
+
+const testPolicy = `[
+  {"match": {"prefixes": ["10.1.0.0/16"]}, "set": {"communities": ["65000:100"], "med": 50}},
+  {"match": {"family": "ipv6"}, "action": "reject"},
+  {"match": {"le": 32}, "action": "accept"},
+  {"action": "reject"}
+]`
+
+func TestPolicy(t *testing.T) {
+	var p Policy
+
+	if err := json.Unmarshal([]byte(testPolicy), &p); err != nil {
+		t.Fatal(err)
+	}
+
+	base := advert{MED: 10, Communities: []Community{1}}
+
+	a, ok := p.apply(base, netip.MustParseAddr("10.1.2.3"))
+
+	if !ok || a.MED != 50 || len(a.Communities) != 2 || a.Communities[1] != 65000<<16|100 {
+		t.Error("Unexpected attributes:", ok, a.MED, a.Communities)
+	}
+
+	if len(base.Communities) != 1 {
+		t.Error("Session communities modified")
+	}
+
+	if a, ok := p.apply(base, netip.MustParseAddr("10.2.0.1")); !ok || a.MED != 10 || len(a.Communities) != 1 {
+		t.Error("Unexpected attributes:", ok, a.MED, a.Communities)
+	}
+
+	if _, ok := p.apply(base, netip.MustParseAddr("fd00::1")); ok {
+		t.Error("IPv6 address accepted")
+	}
+
+	params := Parameters{Multiprotocol: true, Reject: []netip.Prefix{netip.MustParsePrefix("10.3.0.0/16")}, Policy: p}
+	rib := []netip.Addr{netip.MustParseAddr("10.1.0.1"), netip.MustParseAddr("10.3.0.1"), netip.MustParseAddr("fd00::1")}
+
+	if pass := params.filter(false, rib); len(pass) != 1 || pass[0] != rib[0] {
+		t.Error("Unexpected filter result:", pass)
+	}
+
+	for _, bad := range []string{`[{"action": "drop"}]`, `[{"match": {"family": "ipx"}}]`} {
+		if err := json.Unmarshal([]byte(bad), &p); err == nil {
+			t.Error("Invalid policy accepted:", bad)
+		}
+	}
+}
+
+func TestPolicyUpdates(t *testing.T) {
+	var p Policy
+
+	if err := json.Unmarshal([]byte(testPolicy), &p); err != nil {
+		t.Fatal(err)
+	}
+
+	a := advert{ASNumber: 65000, NextHop: [4]byte{10, 0, 0, 1}, MED: 10, external: true}
+	a = a.withParameters(Parameters{MED: 10, Policy: p}, 65001)
+
+	nlri := map[netip.Addr]bool{
+		netip.MustParseAddr("10.1.0.1"): true,
+		netip.MustParseAddr("10.1.0.2"): true,
+		netip.MustParseAddr("10.2.0.1"): true,
+		netip.MustParseAddr("10.2.0.2"): false,
+	}
+
+	updates := a.updates(nlri, MAX_MESSAGE_LENGTH)
+
+	if len(updates) != 2 {
+		t.Fatal("Expected 2 UPDATEs, got", len(updates))
+	}
+
+	found := map[netip.Addr]uint32{}
+
+	for _, u := range updates {
+		m, _, err := Decode(frame(u.Type(), u.Body()))
+
+		if err != nil || m.Update == nil {
+			t.Fatal("Decode failed:", err)
+		}
+
+		med, _ := m.Update.Attribute(MULTI_EXIT_DISC)
+		advertised, withdrawn := m.Update.Routes()
+
+		for _, r := range advertised {
+			found[r.Addr()] = *med.MED
+		}
+
+		for _, r := range withdrawn {
+			found[r.Addr()] = 0
+		}
+	}
+
+	for k, v := range map[string]uint32{"10.1.0.1": 50, "10.1.0.2": 50, "10.2.0.1": 10, "10.2.0.2": 0} {
+		if med, ok := found[netip.MustParseAddr(k)]; !ok || med != v {
+			t.Error("Unexpected MED for", k, med)
+		}
+	}
+}
@@ -19,33 +19,71 @@
 package bgp
 
 import (
+	"errors"
+	"net"
 	"net/netip"
+	"strings"
+	"time"
 )
 
+var (
+	ErrPeerExists  = errors.New("Peer already exists")
+	ErrNoSuchPeer  = errors.New("No such peer")
+	ErrInvalidPeer = errors.New("Peer must be an IP address, optionally with a port")
+)
+
+// Simple notifications of peers being added/removed and sessions
+// closing. See BGPEvents for a more detailed, structured alternative.
 type BGPNotify interface {
 	BGPPeer(peer string, params Parameters, add bool)  // Peer added if "add" is true, peer was removed if not
 	BGPSession(peer string, local bool, reason string) // Session shutdown was locally requested if "local" is true
 }
 
-type nul struct{}
+type status = map[string]Status
 
-func (nul) BGPPeer(string, Parameters, bool) {}
-func (nul) BGPSession(string, bool, string)  {}
+type configuration struct {
+	peers  map[string]Parameters
+	reason string // shutdown communication sent to peers which are removed
+}
 
-type status = map[string]Status
+const (
+	PEER_ADD = iota
+	PEER_REMOVE
+	PEER_UPDATE
+)
+
+type peerRequest struct {
+	op     int
+	peer   string
+	params Parameters
+	reason string
+	done   chan peerResult
+}
+
+type peerResult struct {
+	reset bool
+	err   error
+}
 
 type Pool struct {
-	c chan map[string]Parameters
+	c chan configuration
+	p chan peerRequest
+	q chan chan map[string]Parameters
 	r chan []IP
 	s chan chan status
-	l BGPNotify
+	x chan string
+	d chan *Dampening
+	v chan chan map[netip.Addr]Penalty
+	m *monitors
+	e *events
+	a *adjRIBsIn
 }
 
-func (p *Pool) log() BGPNotify {
-	if l := p.l; l != nil {
-		return l
-	}
-	return &nul{}
+// Add a handler to receive events from the pool and all of its
+// sessions. Events which occurred before the handler was added are not
+// replayed.
+func (p *Pool) Events(h BGPEvents) {
+	p.e.add(h)
 }
 
 func (p *Pool) Status() status {
@@ -54,8 +92,102 @@ func (p *Pool) Status() status {
 	return <-c
 }
 
-func (p *Pool) Configure(c map[string]Parameters) {
-	p.c <- c
+// Configure the set of peers. Sessions which do not appear in the map
+// are closed, and the reason is sent to the peer as an administrative
+// shutdown communication.
+func (p *Pool) Configure(c map[string]Parameters, reason string) {
+	p.c <- configuration{peers: c, reason: reason}
+}
+
+// Add a session with a new peer, which is an IP address with an
+// optional port.
+func (p *Pool) AddPeer(peer string, params Parameters) error {
+	return p.peer(peerRequest{op: PEER_ADD, peer: peer, params: params}).err
+}
+
+// Close the session with a peer, sending the reason as an
+// administrative shutdown communication, and remove it from the pool.
+func (p *Pool) RemovePeer(peer string, reason string) error {
+	return p.peer(peerRequest{op: PEER_REMOVE, peer: peer, reason: reason}).err
+}
+
+// Change the parameters for a peer. Changes which only take effect at
+// session start (see Parameters.Changes) cause the session to be reset,
+// in which case reset is true; others are applied to the running
+// session.
+func (p *Pool) UpdatePeer(peer string, params Parameters) (reset bool, err error) {
+	r := p.peer(peerRequest{op: PEER_UPDATE, peer: peer, params: params})
+	return r.reset, r.err
+}
+
+// Returns the current parameters for each peer in the pool.
+func (p *Pool) Peers() map[string]Parameters {
+	c := make(chan map[string]Parameters)
+	p.q <- c
+	return <-c
+}
+
+func (p *Pool) peer(r peerRequest) peerResult {
+
+	if r.op != PEER_REMOVE {
+		if err := validPeer(r.peer); err != nil {
+			return peerResult{err: err}
+		}
+
+		if err := r.params.Validate(); err != nil {
+			return peerResult{err: err}
+		}
+	}
+
+	r.done = make(chan peerResult)
+	p.p <- r
+	return <-r.done
+}
+
+func validPeer(peer string) error {
+	host := peer
+
+	if h, _, err := net.SplitHostPort(peer); err == nil {
+		host = h
+	}
+
+	if _, err := netip.ParseAddr(host); err != nil {
+		return ErrInvalidPeer
+	}
+
+	return nil
+}
+
+// Reset the session with a peer and attempt to reconnect immediately.
+func (p *Pool) Reset(peer string) {
+	p.x <- peer
+}
+
+// Enable flap dampening of addresses in the RIB with the supplied
+// parameters, or disable dampening if nil.
+func (p *Pool) Dampening(d *Dampening) {
+	p.d <- d
+}
+
+// Returns the flap dampening state of addresses in the RIB, or nil if
+// dampening is not enabled.
+func (p *Pool) Dampened() map[netip.Addr]Penalty {
+	c := make(chan map[netip.Addr]Penalty)
+	p.v <- c
+	return <-c
+}
+
+// Stream the activity of all sessions in the pool to a BMP
+// collector. Sessions which are already established are reported
+// (Peer Up and Adj-RIB-Out) immediately.
+func (p *Pool) BMP(b *BMP) {
+	p.m.add(b)
+}
+
+// Record all messages sent and received by sessions in the pool to an
+// MRT file.
+func (p *Pool) MRT(m *MRT) {
+	p.m.add(m)
 }
 
 func (p *Pool) RIB(r []netip.Addr) {
@@ -81,6 +213,15 @@ func dup(i []IP) (o []IP) {
 	return
 }
 
+func fromaddr(in []netip.Addr) (out []IP) {
+	for _, a := range in {
+		if a.Is4() {
+			out = append(out, a.As4())
+		}
+	}
+	return
+}
+
 func NewPool(routerid IP, peers map[string]Parameters, rib_ []IP, log BGPNotify) *Pool {
 	const F = "pool"
 
@@ -92,18 +233,87 @@ func NewPool(routerid IP, peers map[string]Parameters, rib_ []IP, log BGPNotify)
 		return nil
 	}
 
-	pool := &Pool{c: make(chan map[string]Parameters), r: make(chan []IP), s: make(chan chan status), l: log}
+	pool := &Pool{c: make(chan configuration), p: make(chan peerRequest), q: make(chan chan map[string]Parameters), r: make(chan []IP), s: make(chan chan status), x: make(chan string),
+		d: make(chan *Dampening), v: make(chan chan map[netip.Addr]Penalty), m: &monitors{}, e: &events{}, a: newAdjRIBsIn()}
+
+	pool.e.notify(log) // BGPNotify is now a consumer of events
 
 	go func() {
 
 		sessions := map[string]*Session{}
+		config := map[string]Parameters{}
+
+		add := func(peer string, params Parameters) {
+			p := params
+			config[peer] = params
+			pool.e.emit(Event{Type: EVENT_PEER_ADDED, Peer: peer, Parameters: &p})
+			sessions[peer] = newSession(routerid, peer, params, rib, pool.e, pool.m, pool.a)
+			pool.a.watch(config)
+		}
+
+		remove := func(peer string, reason string) {
+			sessions[peer].Close(reason)
+			delete(sessions, peer)
+			delete(config, peer)
+			pool.a.watch(config)
+			pool.e.emit(Event{Type: EVENT_PEER_REMOVED, Peer: peer})
+		}
+
+		update := func(peer string, params Parameters) bool {
+			old := config[peer]
+			reset, live := old.Changes(params)
+			config[peer] = params
+			pool.a.watch(config)
+
+			if len(reset) > 0 || len(live) > 0 {
+				var changes []string
+
+				if len(reset) > 0 {
+					changes = append(changes, "reset: "+strings.Join(reset, ", "))
+				}
+
+				if len(live) > 0 {
+					changes = append(changes, "live: "+strings.Join(live, ", "))
+				}
+
+				p := params
+				pool.e.emit(Event{Type: EVENT_PEER_UPDATED, Peer: peer, Parameters: &p, Reason: strings.Join(changes, "; ")})
+			}
+
+			sessions[peer].Configure(params) // resets the session if necessary
+
+			return len(reset) > 0
+		}
 
 		defer func() {
 			for _, session := range sessions {
-				session.Close()
+				session.Close("")
 			}
 		}()
 
+		// the RIB supplied by the user is passed through the flap
+		// dampening filter, if enabled, to get the RIB to advertise
+		var damper *damper
+		input := rib
+
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+
+		damp := func() {
+			out := input
+
+			if damper != nil {
+				out = fromaddr(damper.rib(toaddr(input), time.Now()))
+			}
+
+			if RIBSDiffer(out, rib) {
+				rib = out
+				for _, session := range sessions {
+					session.RIB(rib)
+				}
+			}
+		}
+
 		for {
 			select {
 			case c := <-pool.s:
@@ -113,12 +323,64 @@ func NewPool(routerid IP, peers map[string]Parameters, rib_ []IP, log BGPNotify)
 				}
 				c <- s
 
+			case r := <-pool.p:
+				_, exists := sessions[r.peer]
+
+				switch {
+				case r.op == PEER_ADD && exists:
+					r.done <- peerResult{err: ErrPeerExists}
+				case r.op != PEER_ADD && !exists:
+					r.done <- peerResult{err: ErrNoSuchPeer}
+				case r.op == PEER_ADD:
+					add(r.peer, r.params)
+					r.done <- peerResult{}
+				case r.op == PEER_REMOVE:
+					remove(r.peer, r.reason)
+					r.done <- peerResult{}
+				default:
+					r.done <- peerResult{reset: update(r.peer, r.params)}
+				}
+
+			case c := <-pool.q:
+				m := map[string]Parameters{}
+				for peer, params := range config {
+					m[peer] = params
+				}
+				c <- m
+
+			case peer := <-pool.x:
+				if session, ok := sessions[peer]; ok {
+					session.Reset()
+				}
+
 			case r := <-pool.r:
+				input = dup(r)
+				damp()
+
+			case d := <-pool.d:
+				if d == nil {
+					damper = nil
+				} else {
+					damper = newDamper(*d)
+				}
+				damp()
 
-				rib = dup(r)
+			case c := <-pool.v:
+				if damper == nil {
+					c <- nil
+				} else {
+					c <- damper.status(time.Now())
+				}
 
+			case <-pool.a.C:
+				// routes received from a peer changed - conditions for advertising to any peer may be affected
 				for _, session := range sessions {
-					session.RIB(rib)
+					session.evaluate()
+				}
+
+			case <-ticker.C:
+				if damper != nil {
+					damp()
 				}
 
 			case i, ok := <-pool.c:
@@ -127,28 +389,25 @@ func NewPool(routerid IP, peers map[string]Parameters, rib_ []IP, log BGPNotify)
 					return
 				}
 
-				for peer, params := range i {
-					if session, ok := sessions[peer]; ok {
-						session.Configure(params)
+				for peer, params := range i.peers {
+					if _, ok := sessions[peer]; ok {
+						update(peer, params)
 					} else {
-						pool.log().BGPPeer(peer, params, true)
-						sessions[peer] = NewSession(routerid, peer, params, rib, pool.log())
+						add(peer, params)
 					}
 				}
 
 				// if any sessions don't appear in the config map then close and remove them
-				for peer, session := range sessions {
-					if _, ok := i[peer]; !ok {
-						session.Close()
-						delete(sessions, peer)
-						pool.log().BGPPeer(peer, Parameters{}, false)
+				for peer, _ := range sessions {
+					if _, ok := i.peers[peer]; !ok {
+						remove(peer, i.reason)
 					}
 				}
 			}
 		}
 	}()
 
-	pool.c <- peers
+	pool.c <- configuration{peers: peers}
 
 	return pool
 }
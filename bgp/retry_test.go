@@ -0,0 +1,94 @@
+/*
+ * VC5 load balancer. Copyright (C) 2021-present David Coles
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package bgp
+
+import (
+	"testing"
+	"time"
+)
+
+// delays are jittered down by up to a quarter
+func jittered(d, base time.Duration) bool {
+	return d <= base && d >= base-base/4
+}
+
+func TestRetryBackoff(t *testing.T) {
+	var r retry
+
+	connect := 10 * time.Second
+	idle := 60 * time.Second
+
+	// failed connection attempts double the delay up to the limit
+	for i, m := range []time.Duration{1, 2, 4, 8, 16, 16, 16} {
+		if d := r.next(connect, idle, 0, false); !jittered(d, m*connect) {
+			t.Errorf("attempt %d: delay %v, expected ~%v", i, d, m*connect)
+		}
+	}
+
+	// an established session which drops reconnects promptly and clears the failures
+	if d := r.next(connect, idle, time.Minute, false); !jittered(d, connect) {
+		t.Error("delay after drop:", d)
+	}
+
+	if d := r.next(connect, idle, 0, false); !jittered(d, connect) {
+		t.Error("failures not cleared:", d)
+	}
+
+	// sessions torn down by NOTIFICATIONs apply the idle hold time, doubling each time
+	for i, m := range []time.Duration{1, 2, 4, 8, 16, 16} {
+		if d := r.next(connect, idle, time.Minute, true); !jittered(d, m*idle) {
+			t.Errorf("notification %d: delay %v, expected ~%v", i, d, m*idle)
+		}
+	}
+
+	// a session which was stable clears all penalties
+	if d := r.next(connect, idle, stable_time, true); !jittered(d, idle) {
+		t.Error("idle hold not reset after stable session:", d)
+	}
+
+	if d := r.next(connect, idle, 0, false); !jittered(d, connect) {
+		t.Error("failures not reset after stable session:", d)
+	}
+
+	r.reset()
+
+	if d := r.next(connect, idle, 0, false); !jittered(d, connect) {
+		t.Error("reset did not clear failures:", d)
+	}
+}
+
+func TestRetryTimes(t *testing.T) {
+	var p Parameters
+
+	if c, i := p.retryTimes(); c != 30*time.Second || i != 30*time.Second {
+		t.Error("defaults:", c, i)
+	}
+
+	p.ConnectRetry = 5
+
+	if c, i := p.retryTimes(); c != 5*time.Second || i != 5*time.Second {
+		t.Error("idle hold should default to connect retry:", c, i)
+	}
+
+	p.IdleHoldTime = 20
+
+	if c, i := p.retryTimes(); c != 5*time.Second || i != 20*time.Second {
+		t.Error("configured:", c, i)
+	}
+}
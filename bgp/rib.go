@@ -21,11 +21,13 @@ package bgp
 import (
 	//"net"
 	"net/netip"
+	"sort"
 )
 
 type _update struct {
 	RIB        []netip.Addr
 	Parameters Parameters
+	reset      []string // parameters which are only used at session start which have changed
 }
 
 type _rib []netip.Addr
@@ -37,6 +39,38 @@ func (r _rib) dup() (ret []netip.Addr) {
 	return
 }
 
+// RIBSDiffer returns true if the two lists do not contain the same set
+// of addresses - ordering and repeated elements are ignored
+func RIBSDiffer(a, b []IP) bool {
+	return AddrsDiffer(toaddr(a), toaddr(b))
+}
+
+// AddrsDiffer is RIBSDiffer for lists of IPv4 and IPv6 addresses.
+func AddrsDiffer(a, b []netip.Addr) bool {
+	x := map[netip.Addr]bool{}
+	y := map[netip.Addr]bool{}
+
+	for _, i := range a {
+		x[i] = true
+	}
+
+	for _, i := range b {
+		y[i] = true
+	}
+
+	if len(x) != len(y) {
+		return true
+	}
+
+	for i, _ := range x {
+		if !y[i] {
+			return true
+		}
+	}
+
+	return false
+}
+
 func newupdate(p Parameters, r []netip.Addr) _update {
 	//var rib []netip.Addr // create a seperate copy of the slice
 	//for _, i := range r {
@@ -89,7 +123,9 @@ filter:
 		for _, ipnet := range p.Accept {
 			n := ipnet
 			if n.Contains(ip) {
-				pass = append(pass, i)
+				if _, ok := p.Policy.apply(advert{}, ip); ok {
+					pass = append(pass, i)
+				}
 				continue filter
 			}
 		}
@@ -101,7 +137,9 @@ filter:
 			}
 		}
 
-		pass = append(pass, i)
+		if _, ok := p.Policy.apply(advert{}, ip); ok {
+			pass = append(pass, i)
+		}
 	}
 
 	return pass
@@ -116,8 +154,8 @@ filter:
 //}
 
 //func _nlri(curr, prev []netip.Addr, force bool) (list []netip.Addr, nlri map[netip.Addr]bool) {
-func (u *_update) nlri(prev []netip.Addr, ipv6, force bool) ([]netip.Addr, map[netip.Addr]bool) {
-	curr := u.adjRIBOut(ipv6)
+func (u *_update) nlri(prev []netip.Addr, ipv6, force bool) ([]netip.Addr, map[netip.Addr]bool, int) {
+	curr, excess := u.Parameters.limit(u.adjRIBOut(ipv6), prev)
 	var list []netip.Addr
 
 	nlri := map[netip.Addr]bool{}
@@ -147,7 +185,59 @@ func (u *_update) nlri(prev []netip.Addr, ipv6, force bool) ([]netip.Addr, map[n
 		}
 	}
 
-	return list, nlri
+	return list, nlri, excess
+}
+
+// Only the withdrawals from a set of changes, and the prefixes which
+// remain advertised once they have been sent.
+func withdrawals(prev []netip.Addr, nlri map[netip.Addr]bool) ([]netip.Addr, map[netip.Addr]bool) {
+	var list []netip.Addr
+	withdrawn := map[netip.Addr]bool{}
+
+	for _, i := range prev {
+		if advertise, ok := nlri[i]; ok && !advertise {
+			withdrawn[i] = false
+		} else {
+			list = append(list, i)
+		}
+	}
+
+	return list, withdrawn
+}
+
+// Apply the outbound prefix limit, returning the prefixes to advertise
+// and the number by which the limit was exceeded. Prefixes which are
+// already advertised are preferred so that existing routes are not
+// displaced by new ones. If the limit only generates a warning then all
+// prefixes are returned.
+func (p *Parameters) limit(curr, prev []netip.Addr) ([]netip.Addr, int) {
+
+	if p.MaxPrefixes == 0 || len(curr) <= int(p.MaxPrefixes) {
+		return curr, 0
+	}
+
+	excess := len(curr) - int(p.MaxPrefixes)
+
+	if p.MaxPrefixesWarn {
+		return curr, excess
+	}
+
+	old := map[netip.Addr]bool{}
+
+	for _, i := range prev {
+		old[i] = true
+	}
+
+	list := _rib(curr).dup()
+
+	sort.SliceStable(list, func(i, j int) bool {
+		if a, b := old[list[i]], old[list[j]]; a != b {
+			return a
+		}
+		return list[i].Less(list[j])
+	})
+
+	return list[:p.MaxPrefixes], excess
 }
 
 func (c *_update) updates(p _update, ipv6 bool) (uint64, uint64, map[netip.Addr]bool) {
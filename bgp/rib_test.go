@@ -19,6 +19,7 @@
 package bgp
 
 import (
+	"net/netip"
 	"testing"
 )
 
@@ -48,3 +49,54 @@ func TestRIBs(t *testing.T) {
 		}
 	}
 }
+
+func TestPrefixLimit(t *testing.T) {
+	a := netip.MustParseAddr("192.168.101.1")
+	b := netip.MustParseAddr("192.168.101.2")
+	c := netip.MustParseAddr("192.168.101.3")
+
+	p := Parameters{MaxPrefixes: 2}
+
+	// already advertised prefixes are kept in preference to new ones
+	if l, excess := p.limit([]netip.Addr{a, b, c}, []netip.Addr{c}); excess != 1 || len(l) != 2 || l[0] != c || l[1] != a {
+		t.Error("Unexpected limit:", l, excess)
+	}
+
+	if l, excess := p.limit([]netip.Addr{a, b}, nil); excess != 0 || len(l) != 2 {
+		t.Error("Unexpected limit:", l, excess)
+	}
+
+	p.MaxPrefixesWarn = true
+
+	if l, excess := p.limit([]netip.Addr{a, b, c}, nil); excess != 1 || len(l) != 3 {
+		t.Error("Warning only should not limit:", l, excess)
+	}
+}
+
+func TestWithdrawals(t *testing.T) {
+	a := netip.MustParseAddr("192.168.101.1")
+	b := netip.MustParseAddr("192.168.101.2")
+	c := netip.MustParseAddr("192.168.101.3")
+
+	u := newupdate(Parameters{}, []netip.Addr{b, c})
+	_, nlri, _ := u.nlri([]netip.Addr{a, b}, false, false)
+
+	list, w := withdrawals([]netip.Addr{a, b}, nlri)
+
+	if len(w) != 1 || w[a] != false || len(list) != 1 || list[0] != b {
+		t.Error("Unexpected withdrawals:", w, list)
+	}
+}
+
+func TestAddrsDiffer(t *testing.T) {
+	a := netip.MustParseAddr("192.168.101.1")
+	b := netip.MustParseAddr("fd00::1")
+
+	if AddrsDiffer([]netip.Addr{a, b}, []netip.Addr{b, a}) {
+		t.Error("Ordering should be ignored")
+	}
+
+	if !AddrsDiffer([]netip.Addr{a, b}, []netip.Addr{a}) || !AddrsDiffer([]netip.Addr{a}, []netip.Addr{b}) {
+		t.Error("Different sets should differ")
+	}
+}
@@ -20,7 +20,9 @@ package bgp
 
 import (
 	"fmt"
+	"math/rand"
 	"net/netip"
+	"strings"
 	"sync"
 	"time"
 )
@@ -48,9 +50,20 @@ type Status struct {
 	LastError         string        `json:"last_error"`
 	HoldTime          uint16        `json:"hold_time"`
 	LocalASN          uint16        `json:"local_asn"`
-	RemoteASN         uint16        `json:"remote_asn"`
+	RemoteASN         uint32        `json:"remote_asn"`
 	AdjRIBOut         []string      `json:"adj_rib_out"`
 	LocalIP           string        `json:"local_ip"`
+	NextRetry         time.Time     `json:"next_retry"`
+	Suppressed        int           `json:"suppressed_routes"`
+	LimitExceeded     bool          `json:"prefix_limit_exceeded"`
+	Batched           uint64        `json:"batched_updates"`
+	Queued            int           `json:"queued_updates"`
+	ExtendedMessage   bool          `json:"extended_message"`
+	History           []Transition  `json:"history,omitempty"`
+	ReceivedPrefixes  int           `json:"received_prefixes"` // only kept while conditions refer to the peer
+	MalformedUpdates  uint64        `json:"malformed_updates"` // received UPDATEs which could not be decoded, and were ignored
+	ConditionsMet     bool          `json:"conditions_met"`
+	Reconfigured      uint64        `json:"configuration_resets"` // sessions reset to apply new parameters
 }
 
 const (
@@ -67,14 +80,16 @@ type Session struct {
 	status Status
 	mutex  sync.Mutex
 	update _update
-	logs   BGPNotify
-}
-
-func (s *Session) log() BGPNotify {
-	if s.logs == nil {
-		return &nul{}
-	}
-	return s.logs
+	reason string
+	x      chan bool
+	v      chan bool
+	fsm    fsm
+	peer   string
+
+	pending  []Transition // state changes not yet sent as events
+	monitors *monitors
+	events   *events
+	ribs     *adjRIBsIn
 }
 
 func toaddr(in []IP) (out []netip.Addr) {
@@ -85,31 +100,82 @@ func toaddr(in []IP) (out []netip.Addr) {
 }
 
 func NewSession(id IP, peer string, p Parameters, r []IP, l BGPNotify) *Session {
+	e := &events{}
+	e.notify(l)
+
+	return newSession(id, peer, p, r, e, &monitors{}, newAdjRIBsIn())
+}
+
+func newSession(id IP, peer string, p Parameters, r []IP, e *events, m *monitors, a *adjRIBsIn) *Session {
 
 	var rib []netip.Addr
 	for _, i := range r {
 		rib = append(rib, netip.AddrFrom4(i))
 	}
 
-	s := &Session{p: p, rib: toaddr(r), logs: l, status: Status{State: IDLE}, update: newupdate(p, rib)}
+	s := &Session{p: p, rib: toaddr(r), status: Status{State: IDLE}, update: newupdate(p, rib), monitors: m, events: e, ribs: a, fsm: newFSM(), peer: peer}
 	s.c = s.session(id, peer)
 	return s
 }
 
+// Start the session. Event handlers added with Events, and recorders
+// added with MRT, before the session is started will see all activity.
 func (s *Session) Start(id IP, peer string, p Parameters, r []netip.Addr, l BGPNotify) {
 	s.p = p
 	s.rib = r
-	s.logs = l
 	s.status = Status{State: IDLE}
 	s.update = newupdate(p, r)
+	s.ribs = newAdjRIBsIn()
+	s.fsm = newFSM()
+	s.peer = peer
+
+	if s.events == nil {
+		s.events = &events{}
+	}
+
+	if s.monitors == nil {
+		s.monitors = &monitors{}
+	}
+
+	s.events.notify(l) // replaces any from a previous start
+
 	s.c = s.session(id, peer)
 }
 
+// Add a handler to receive events from the session.
+func (s *Session) Events(h BGPEvents) {
+	s.mutex.Lock()
+	if s.events == nil {
+		s.events = &events{}
+	}
+	e := s.events
+	s.mutex.Unlock()
+	e.add(h)
+}
+
+func (s *Session) emit(e Event) {
+	e.Peer = s.peer
+	s.events.emit(e)
+}
+
+// Record all messages sent and received by the session to an MRT file.
+func (s *Session) MRT(m *MRT) {
+	s.mutex.Lock()
+	if s.monitors == nil {
+		s.monitors = &monitors{}
+	}
+	n := s.monitors
+	s.mutex.Unlock()
+	n.add(m)
+}
+
 func (s *Session) Status() Status {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 	s.status.Duration = time.Now().Sub(s.status.When) / time.Second
-	return s.status
+	status := s.status
+	status.History = append([]Transition{}, s.fsm.history...)
+	return status
 }
 
 func (s *Session) RIB(r []IP) {
@@ -122,28 +188,86 @@ func (s *Session) LocRIB(r []netip.Addr) {
 	s.c <- newupdate(s.p, s.rib)
 }
 
+// Apply new parameters. If any which are only used at session start
+// have changed then the session is reset (CEASE, Other Configuration
+// Change) and reconnects immediately with the new values.
 func (s *Session) Configure(p Parameters) {
+	reset, _ := s.p.Changes(p)
 	s.p = p
-	s.c <- newupdate(s.p, s.rib)
+	u := newupdate(s.p, s.rib)
+	u.reset = reset
+	s.c <- u
 }
 
-func (s *Session) Close() {
+// Close the session. If established, the peer is sent a CEASE
+// notification with the reason as an administrative shutdown
+// communication (RFC 9003).
+func (s *Session) Close(reason string) {
+	s.mutex.Lock()
+	s.reason = reason
+	s.mutex.Unlock()
 	close(s.c)
 }
 
 func (s *Session) Stop() {
-	close(s.c)
+	s.Close("")
+}
+
+func (s *Session) shutdown() notification {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return notification{code: CEASE, sub: ADMINISTRATIVE_SHUTDOWN, data: shutdownCommunication(s.reason)}
 }
 
-func (s *Session) state2(state string) {
+func (s *Session) state2(state, reason string) {
+	now := time.Now()
+	s.fsm.transition(state, reason, now)
 	s.status.State = state
-	s.status.When = time.Now().Round(time.Second)
+	s.status.When = now.Round(time.Second)
+	s.pending = append(s.pending, s.fsm.history[len(s.fsm.history)-1])
+}
+
+func (s *Session) state(state, reason string) {
+	s.mutex.Lock()
+	defer s.transitions()
+	defer s.mutex.Unlock()
+	s.state2(state, reason)
+}
+
+// send events for state changes - must be called without the mutex held
+func (s *Session) transitions() {
+	s.mutex.Lock()
+	pending := s.pending
+	s.pending = nil
+	s.mutex.Unlock()
+
+	for _, t := range pending {
+		s.emit(Event{Type: EVENT_STATE, Time: t.When, From: t.From, To: t.To, Reason: t.Reason})
+	}
+}
+
+// pass a message received from the peer to the state machine - the
+// session state is updated if it causes a transition
+func (s *Session) received(m message) (notification, bool) {
+	s.mutex.Lock()
+	defer s.transitions()
+	defer s.mutex.Unlock()
+
+	n, ok := s.fsm.received(m, time.Now())
+
+	if s.fsm.state != s.status.State {
+		s.status.State = s.fsm.state
+		s.status.When = time.Now().Round(time.Second)
+		s.pending = append(s.pending, s.fsm.history[len(s.fsm.history)-1])
+	}
+
+	return n, ok
 }
 
-func (s *Session) state(state string) {
+func (s *Session) current() string {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
-	s.state2(state)
+	return s.fsm.state
 }
 
 func (s *Session) error(error string) string {
@@ -153,37 +277,85 @@ func (s *Session) error(error string) string {
 	return error
 }
 
-func (s *Session) established(ht uint16, local, remote uint16) {
+// the peer's OPEN was accepted (OPEN_CONFIRM)
+func (s *Session) opened(ht uint16, remote uint32, extended bool) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
-	s.state2(ESTABLISHED)
-	s.status.Established++
-	s.status.LastError = ""
+	s.status.ExtendedMessage = extended
 	s.status.HoldTime = ht
-	s.status.LocalASN = local
 	s.status.RemoteASN = remote
 }
 
-func (s *Session) active(ht uint16, local uint16, ip [4]byte) {
+func (s *Session) established() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.status.Established++
+	s.status.LastError = ""
+}
+
+func (s *Session) active(ht uint16, local uint16, ip [4]byte, id IP, peeras uint32, peerid IP4) {
 	s.mutex.Lock()
+	defer s.transitions()
 	defer s.mutex.Unlock()
 
-	s.state2(ACTIVE)
+	s.state2(ACTIVE, "Connecting")
+	s.fsm.routerID = id
+	s.fsm.peerAS = peeras
+	s.fsm.peerID = peerid
 	s.status.Attempts++
+	s.status.NextRetry = time.Time{}
 
 	s.status.AdjRIBOut = nil
 	s.status.Prefixes = 0
+	s.status.Suppressed = 0
+	s.status.LimitExceeded = false
+	s.status.Batched = 0
+	s.status.Queued = 0
 	s.status.Advertised = 0
 	s.status.Withdrawn = 0
 	s.status.HoldTime = ht
 	s.status.LocalASN = local
 	s.status.RemoteASN = 0
+	s.status.ExtendedMessage = false
+	s.status.ReceivedPrefixes = 0
+	s.status.MalformedUpdates = 0
+	s.status.ConditionsMet = false
 	s.status.LocalIP = ip_string(ip)
 }
+
+func (s *Session) reconfigured() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.status.Reconfigured++
+}
+
+// routes received from the peer, and whether conditions for advertising to it are met
+func (s *Session) adjRIBIn(prefixes int, met bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.status.ReceivedPrefixes = prefixes
+	s.status.ConditionsMet = met
+}
+
+func (s *Session) malformed() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.status.MalformedUpdates++
+}
+
+// Re-evaluate conditions for advertisement after received routes have changed.
+func (s *Session) evaluate() {
+	select {
+	case s.v <- true:
+	default:
+	}
+}
+
 func (s *Session) connect() {
 	s.mutex.Lock()
+	defer s.transitions()
 	defer s.mutex.Unlock()
-	s.state2(CONNECT)
+	s.state2(CONNECT, "TCP connection established")
 	s.status.Connections++
 }
 
@@ -213,14 +385,120 @@ func (s *Session) update_stats(d time.Duration, r []netip.Addr, n map[netip.Addr
 	s.status.Prefixes = len(r)
 }
 
+// Record the effect of the outbound prefix limit - prefixes over the
+// limit are withheld unless the limit is only to generate a warning
+func (s *Session) prefix_limit(excess int, warn bool, queued int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.status.LimitExceeded = excess > 0
+	s.status.Suppressed = 0
+	s.status.Queued = queued
+
+	if !warn {
+		s.status.Suppressed = excess
+	}
+}
+
+// changes deferred by the MinRouteAdvertisementInterval timer
+func (s *Session) batched() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.status.Batched++
+}
+
+func (s *Session) queued(n int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.status.Queued = n
+}
+
+// Delays between connection attempts back off exponentially (with
+// jitter) on repeated failures, up to this many doublings
+const retry_doublings = 4
+
+// A session which stays established for this long is considered stable
+// and the backoff and idle hold penalties are cleared when it closes
+const stable_time = 5 * time.Minute
+
+type retry struct {
+	failures uint // consecutive failed connection attempts
+	holds    uint // consecutive sessions torn down by a NOTIFICATION
+}
+
+// Calculate the delay before the next connection attempt. The RFC 4271
+// IdleHoldTimer is applied when a session was torn down by a
+// NOTIFICATION, and doubles each time that this happens in succession
+// to damp peer oscillations.
+func (r *retry) next(connect, idle time.Duration, up time.Duration, notification bool) time.Duration {
+
+	if up >= stable_time {
+		r.failures = 0
+		r.holds = 0
+	}
+
+	var delay time.Duration
+
+	switch {
+	case notification:
+		delay = idle << r.holds
+		if r.holds < retry_doublings {
+			r.holds++
+		}
+	case up > 0:
+		// the connection dropped after the session was established - try again promptly
+		r.failures = 0
+		delay = connect
+	default:
+		delay = connect << r.failures
+		if r.failures < retry_doublings {
+			r.failures++
+		}
+	}
+
+	// RFC 4271 section 10: jitter timers by a random factor between 0.75 and 1.0
+	return delay - time.Duration(rand.Int63n(int64(delay/4)+1))
+}
+
+func (r *retry) reset() {
+	r.failures = 0
+	r.holds = 0
+}
+
+func (p *Parameters) retryTimes() (connect, idle time.Duration) {
+	connect = 30 * time.Second
+	if p.ConnectRetry > 0 {
+		connect = time.Duration(p.ConnectRetry) * time.Second
+	}
+
+	idle = connect
+	if p.IdleHoldTime > 0 {
+		idle = time.Duration(p.IdleHoldTime) * time.Second
+	}
+
+	return
+}
+
+// Reset the session now. If established then the peer is sent a CEASE
+// notification (Administrative Reset), and any pending retry delay is
+// abandoned - a new connection is attempted immediately.
+func (s *Session) Reset() {
+	select {
+	case s.x <- true:
+	default:
+	}
+}
+
 func (s *Session) session(id IP, peer string) chan _update {
 	const F = "session"
 
 	updates := make(chan _update, 10)
+	s.x = make(chan bool, 1)
+	s.v = make(chan bool, 1)
 
 	go func() {
 
-		retry_time := 30 * time.Second
+		var backoff retry
 
 		timer := time.NewTimer(1) // fires immediately
 		defer timer.Stop()
@@ -230,13 +508,19 @@ func (s *Session) session(id IP, peer string) chan _update {
 		for {
 			select {
 			case <-timer.C:
-				s.log().BGPSession(peer, true, "Connecting ...")
-				b, n := s.try(id, peer, updates)
+				s.emit(Event{Type: EVENT_TIMER, Timer: TIMER_CONNECT_RETRY})
+				b, n := s.try(id, peer, updates, s.x, s.v)
 				var e string
 
+				up := s.uptime()
+
+				if n.code != 0 {
+					s.emit(notificationEvent(peer, n, !b))
+				}
+
 				if b {
 					e = fmt.Sprintf("Received notification[%d:%d]: %s", n.code, n.sub, n.note())
-					s.log().BGPSession(peer, false, e)
+					s.emit(Event{Type: EVENT_CLOSED, Reason: e})
 
 				} else {
 					if n.code == 0 {
@@ -244,20 +528,43 @@ func (s *Session) session(id IP, peer string) chan _update {
 					} else {
 						e = fmt.Sprintf("Sent notification[%d:%d]: %s", n.code, n.sub, n.note())
 					}
-					if len(n.data) > 0 {
-						e += " (" + string(n.data) + ")"
+
+					if n.reason != "" {
+						e += " - " + n.reason // eg. which AS number the peer presented
 					}
 
-					if n.code == 0 && n.sub == LOCAL_SHUTDOWN {
-						s.log().BGPSession(peer, true, e)
+					if (n.code == 0 && n.sub == LOCAL_SHUTDOWN) || (n.code == CEASE && (n.sub == ADMINISTRATIVE_SHUTDOWN || n.sub == ADMINISTRATIVE_RESET || n.sub == OTHER_CONFIGURATION_CHANGE)) {
+						s.emit(Event{Type: EVENT_CLOSED, Reason: e, Local: true})
 					} else {
-						s.log().BGPSession(peer, false, e) // treat as "remote" as it was a failed connection, not a local shutdown
+						s.emit(Event{Type: EVENT_CLOSED, Reason: e}) // treat as "remote" as it was a failed connection, not a local shutdown
 					}
 				}
 
+				var delay time.Duration
+
+				if !b && n.code == CEASE && (n.sub == ADMINISTRATIVE_RESET || n.sub == OTHER_CONFIGURATION_CHANGE) {
+					backoff.reset() // manual reset or reconfiguration - reconnect immediately
+				} else {
+					connect, idle := s.update.Parameters.retryTimes()
+					delay = backoff.next(connect, idle, up, n.code != 0)
+				}
+
 				s.error(e)
-				s.idle()
-				timer.Reset(retry_time)
+				s.idle(delay)
+				timer.Reset(delay)
+
+			case <-s.x:
+				backoff.reset()
+
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+
+				s.idle(0)
+				timer.Reset(1)
 
 			case s.update, ok = <-updates: // stores last update
 				if !ok {
@@ -271,13 +578,27 @@ func (s *Session) session(id IP, peer string) chan _update {
 	return updates
 }
 
-func (s *Session) idle() {
+// how long the session had been established for - zero if it never was
+func (s *Session) uptime() time.Duration {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.status.State != ESTABLISHED {
+		return 0
+	}
+
+	return time.Now().Sub(s.status.When)
+}
+
+func (s *Session) idle(delay time.Duration) {
 	s.mutex.Lock()
+	defer s.transitions()
 	defer s.mutex.Unlock()
-	s.state2(IDLE)
+	s.state2(IDLE, s.status.LastError)
+	s.status.NextRetry = time.Now().Add(delay).Round(time.Second)
 }
 
-func (s *Session) try(routerid IP, peer string, updates chan _update) (bool, notification) {
+func (s *Session) try(routerid IP, peer string, updates chan _update, reset, evaluate chan bool) (received bool, n notification) {
 
 	nexthop4 := s.update.Parameters.NextHop4
 	nexthop6 := s.update.Parameters.NextHop6
@@ -289,15 +610,27 @@ func (s *Session) try(routerid IP, peer string, updates chan _update) (bool, not
 	localip := sourceip // may be 0.0.0.0 - in which case network stack chooses address/interface
 
 	//var external bool
-	var remoteasn uint16
+	var remoteasn uint32
 
 	if holdtime < 3 {
 		holdtime = 10
 	}
 
-	s.active(holdtime, asnumber, localip)
+	s.active(holdtime, asnumber, localip, routerid, s.update.Parameters.PeerAS, s.update.Parameters.PeerID)
+
+	defer s.ribs.clear(peer) // received routes are no longer valid when the session ends
+
+	// details of the session for monitors - also read by the connection's goroutines
+	var info peerinfo
+	var imutex sync.Mutex
+
+	current := func() peerinfo {
+		imutex.Lock()
+		defer imutex.Unlock()
+		return info
+	}
 
-	conn, err := newConnection(localip, peer)
+	conn, err := newConnection(localip, peer, func(p pdu, sent bool) { s.monitors.message(current(), p, sent) })
 
 	if err != nil {
 		return false, local(CONNECTION_FAILED, err.Error())
@@ -305,6 +638,22 @@ func (s *Session) try(routerid IP, peer string, updates chan _update) (bool, not
 
 	defer conn.close()
 
+	// a reset requested while dialling has been satisfied by this new
+	// connection and must not tear it down once it is established
+	select {
+	case <-reset:
+	default:
+	}
+
+	imutex.Lock()
+	info.peer = peer
+	info.local, info.remote = conn.addrs()
+	info.localASN = asnumber
+	info.localID = routerid
+	imutex.Unlock()
+
+	defer func() { s.monitors.closed(current(), n, received) }()
+
 	var local6 [16]byte
 
 	loc, ok := conn.local()
@@ -335,10 +684,13 @@ func (s *Session) try(routerid IP, peer string, updates chan _update) (bool, not
 
 	s.connect()
 
-	o := open{asNumber: asnumber, holdTime: holdtime, routerID: routerid, multiprotocol: multiprotocol}
+	o := open{asNumber: asnumber, holdTime: holdtime, routerID: routerid, multiprotocol: multiprotocol, extended: true, as4: true, asNumber4: uint32(asnumber)}
 	conn.queue(&o)
+	sent := frame(M_OPEN, o.Body())
+	var peer_open pdu // OPEN received from the peer
+	var established bool
 
-	s.state(OPEN_SENT)
+	s.state(OPEN_SENT, "OPEN sent")
 
 	hold_time_ns := time.Duration(holdtime) * time.Second
 	hold_timer := time.NewTimer(hold_time_ns)
@@ -365,9 +717,19 @@ func (s *Session) try(routerid IP, peer string, updates chan _update) (bool, not
 		nexthop4 = routerid
 	}
 
-	var nlri map[netip.Addr]bool
 	var adjRIBOut []netip.Addr
 	var parameters Parameters
+	var pace pacer
+
+	maxlen := MAX_MESSAGE_LENGTH // raised if both sides support extended messages
+	defer pace.stop()
+
+	// MinRouteAdvertisementInterval - changes arriving while the timer
+	// is running are batched up and sent when it expires
+	mrai := time.NewTimer(0)
+	defer mrai.Stop()
+	<-mrai.C
+	var mrai_running, mrai_pending bool
 
 	notify := func(code, sub byte) notification {
 		n := notification{code: code, sub: sub}
@@ -384,6 +746,112 @@ func (s *Session) try(routerid IP, peer string, updates chan _update) (bool, not
 		Multiprotocol: multiprotocol,
 	}
 
+	var conditions bool // whether the conditions for advertising were met at the last update
+	var received_prefixes int
+	var route_refresh bool // peer supports ROUTE-REFRESH
+
+	// received routes are only decoded and kept while conditions refer to them
+	decoding := s.update.Parameters.watches(peer) || s.ribs.watched(peer)
+
+	watch := func() {
+		w := s.update.Parameters.watches(peer) || s.ribs.watched(peer)
+
+		// routes sent before the peer was referred to were discarded - ask for them again
+		if w && !decoding && established && route_refresh {
+			conn.queue(&routeRefresh{afi: 1, safi: 1})
+
+			if ipv6 || multiprotocol {
+				conn.queue(&routeRefresh{afi: 2, safi: 1})
+			}
+		}
+
+		if !w && decoding {
+			s.ribs.clear(peer)
+			received_prefixes = 0
+			s.adjRIBIn(received_prefixes, conditions)
+		}
+
+		decoding = w
+	}
+
+	// calculate NLRI to transmit - force re-advertisement if parameters have changed (MED, local-pref, communities)
+	// if withdraw is set then only withdrawals are sent, as these are exempt from MRAI (RFC 4271 9.2.1.1)
+	advertise := func(r _update, force, withdraw bool) bool {
+		t := time.Now()
+		p := r.Parameters
+		u := updateTemplate.withParameters(p, remoteasn)
+
+		// withdraw everything if conditions on received routes are not met
+		if conditions = p.conditionsMet(peer, s.ribs); !conditions {
+			r.RIB = nil
+		}
+
+		s.adjRIBIn(received_prefixes, conditions)
+
+		list, nlri, excess := r.nlri(adjRIBOut, ipv6, force)
+
+		if withdraw {
+			list, nlri = withdrawals(adjRIBOut, nlri)
+		} else {
+			parameters = p
+		}
+
+		adjRIBOut = list
+		took := time.Now().Sub(t)
+
+		// report the Adj-RIB-Out once the messages have actually been sent
+		sent := func() {
+			s.update_stats(took, list, nlri)
+			s.monitors.advertised(current(), u, nlri, len(r.RIB))
+		}
+
+		if len(nlri) > 0 {
+			updates := u.updates(nlri, maxlen)
+
+			if len(updates) < 1 {
+				return false
+			}
+
+			pace.send(conn, p.UpdateRate, sent, updates...)
+			s.emit(updateEvent(peer, nlri, len(updates)))
+		} else {
+			sent()
+		}
+
+		if p.MRAI > 0 && !withdraw {
+			mrai.Reset(time.Duration(p.MRAI) * time.Second)
+			mrai_running = true
+		}
+
+		s.prefix_limit(excess, p.MaxPrefixesWarn, len(pace.backlog))
+
+		return true
+	}
+
+	// the RIB, parameters or conditions changed - send updates now, or
+	// withdrawals now and advertisements when the MRAI timer expires
+	changed := func() bool {
+		if !established {
+			return true
+		}
+
+		if mrai_running {
+			mrai_pending = true
+			s.batched()
+			return advertise(s.update, false, true)
+		}
+
+		return advertise(s.update, parameters.Diff(s.update.Parameters), false)
+	}
+
+	// received routes changed - re-evaluate conditions
+	reevaluate := func() bool {
+		if !established || s.update.Parameters.conditionsMet(peer, s.ribs) == conditions {
+			return true
+		}
+		return changed()
+	}
+
 	for {
 		select {
 		case m, ok := <-conn.C:
@@ -394,38 +862,18 @@ func (s *Session) try(routerid IP, peer string, updates chan _update) (bool, not
 
 			hold_timer.Reset(hold_time_ns)
 
+			if n, ok := s.received(m); !ok {
+				conn.queue(&n)
+				return false, n
+			}
+
 			switch m.Type() {
 			case M_NOTIFICATION:
 				n, _ := m.(*notification)
 				return true, *n
 
-			case M_KEEPALIVE:
-				if s.status.State == OPEN_SENT {
-					return false, notify(FSM_ERROR, 0)
-				}
-
 			case M_OPEN:
-				o, ok := m.(*open)
-				if !ok {
-					return false, notify(FSM_ERROR, 0)
-				}
-
-				if s.status.State != OPEN_SENT {
-					return false, notify(FSM_ERROR, 0)
-				}
-
-				//if m.open.version != 4 {
-				if o.version != 4 {
-					return false, notify(OPEN_MESSAGE_ERROR, UNSUPPORTED_VERSION_NUMBER)
-				}
-
-				if o.holdTime < 3 {
-					return false, notify(OPEN_MESSAGE_ERROR, UNNACEPTABLE_HOLD_TIME)
-				}
-
-				if o.routerID == routerid {
-					return false, notify(OPEN_MESSAGE_ERROR, BAD_BGP_ID)
-				}
+				o, _ := m.(*open) // OPEN_CONFIRM - the state machine has validated the message
 
 				if o.holdTime < holdtime {
 					holdtime = o.holdTime
@@ -437,86 +885,212 @@ func (s *Session) try(routerid IP, peer string, updates chan _update) (bool, not
 				keepalive_timer.Reset(keepalive_time_ns)
 
 				//external = o.asNumber != asnumber
-				remoteasn = o.asNumber
+				remoteasn = o.peerAS()
+				updateTemplate.as4 = o.as4 // we always advertise the capability
+				route_refresh = o.refresh
 
-				s.established(holdtime, asnumber, remoteasn)
+				if o.extended {
+					maxlen = MAX_EXTENDED_MESSAGE_LENGTH
+					conn.extended()
+				}
 
-				conn.queue(&keepalive{})
+				s.opened(holdtime, remoteasn, o.extended)
 
-				t := time.Now()
-				p := s.update.Parameters
-				u := updateTemplate.withParameters(p, remoteasn)
+				imutex.Lock()
+				info.remoteASN = remoteasn
+				info.remoteID = o.routerID
+				info.as4 = o.as4
+				imutex.Unlock()
 
-				// initial NLRI will simply advertise any initial addresses in the RIB
-				//adjRIBOut, nlri = NLRI(s.update.adjRIBOut(ipv6), nil, false)
-				adjRIBOut, nlri = s.update.nlri(nil, ipv6, false)
-				parameters = p
+				peer_open = frame(M_OPEN, o.raw)
 
-				//fmt.Println("Init:", adjRIBOut, nlri)
+				conn.queue(&keepalive{})
 
-				if len(nlri) > 0 {
-					if updates := u.updates(nlri); len(updates) < 1 {
+			case M_KEEPALIVE:
+				if !established && s.current() == ESTABLISHED {
+					established = true
+					s.established()
+					s.monitors.established(current(), sent, peer_open)
+
+					if p := s.update.Parameters; p.PeerAS != 0 || p.PeerID != nul4 {
+						s.emit(Event{Type: EVENT_VERIFIED, Reason: fmt.Sprintf("Peer verified: AS %d, router ID %s", remoteasn, ip_string(current().remoteID))})
+					}
+
+					// initial NLRI will simply advertise any initial addresses in the RIB
+					if !advertise(s.update, false, false) {
 						return false, notify(CEASE, OUT_OF_RESOURCES)
-					} else {
-						conn.queue(updates...)
 					}
 				}
 
-				s.update_stats(time.Now().Sub(t), adjRIBOut, nlri)
-
 			case M_UPDATE:
-				if s.status.State != ESTABLISHED {
-					return false, notify(FSM_ERROR, 0)
+				// we don't do any routing, but received prefixes may be used in conditions for advertisement
+				if !decoding {
+					continue
 				}
-				// we don't process update contents because we don't need to do any routing
 
-			default:
-				return false, notify(MESSAGE_HEADER_ERROR, BAD_MESSAGE_TYPE)
+				o, _ := m.(*other)
+				d := Decoder{AS4: updateTemplate.as4}
+				u, err := d.decodeUpdate(o.body)
+
+				if err != nil {
+					s.malformed() // ignore the UPDATE rather than resetting the session [RFC7606]
+					continue
+				}
+
+				advertised, withdrawn := u.Routes()
+				received_prefixes = s.ribs.update(peer, advertised, withdrawn)
+				s.adjRIBIn(received_prefixes, conditions)
+
+				if !reevaluate() {
+					return false, notify(CEASE, OUT_OF_RESOURCES)
+				}
 			}
 
 		case r, ok := <-updates:
 
 			if !ok {
-				return false, notify(CEASE, ADMINISTRATIVE_SHUTDOWN)
+				n := s.shutdown()
+				conn.queue(&n)
+				return false, n
 			}
 
-			if s.status.State == ESTABLISHED {
-				t := time.Now()
-				p := r.Parameters
-				u := updateTemplate.withParameters(p, remoteasn)
+			if len(r.reset) > 0 {
+				changes := r.reset
+				r.reset = nil
+				s.update = r
+				s.reconfigured()
+				n := notify(CEASE, OTHER_CONFIGURATION_CHANGE) // reconnect immediately with the new parameters
+				n.reason = "configuration changed: " + strings.Join(changes, ", ")
+				return false, n
+			}
 
-				// calculate NLRI to transmit - force re-advertisement if parameters have changed (MED, local-pref, communities)
-				//adjRIBOut, nlri = NLRI(r.adjRIBOut(ipv6), adjRIBOut, parameters.Diff(p))
-				adjRIBOut, nlri = r.nlri(adjRIBOut, ipv6, parameters.Diff(p))
-				parameters = p
+			s.update = r
+			watch()
 
-				//fmt.Println("Update:", adjRIBOut, nlri)
+			if !changed() {
+				return false, notify(CEASE, OUT_OF_RESOURCES)
+			}
 
-				if len(nlri) > 0 {
-					if updates := u.updates(nlri); len(updates) < 1 {
-						return false, notify(CEASE, OUT_OF_RESOURCES)
-					} else {
-						conn.queue(updates...)
-					}
-				}
+		case <-evaluate:
+			watch()
 
-				s.update_stats(time.Now().Sub(t), adjRIBOut, nlri)
+			if !reevaluate() {
+				return false, notify(CEASE, OUT_OF_RESOURCES)
 			}
 
-			s.update = r
+		case <-mrai.C:
+			mrai_running = false
+			s.emit(Event{Type: EVENT_TIMER, Timer: TIMER_MRAI})
+
+			if mrai_pending {
+				mrai_pending = false
+				if !advertise(s.update, parameters.Diff(s.update.Parameters), false) {
+					return false, notify(CEASE, OUT_OF_RESOURCES)
+				}
+			}
+
+		case <-pace.C():
+			pace.tick(conn, s.update.Parameters.UpdateRate)
+			s.queued(len(pace.backlog))
+
+		case <-reset:
+			return false, notify(CEASE, ADMINISTRATIVE_RESET)
 
 		case <-keepalive_timer.C:
-			if s.status.State == ESTABLISHED {
+			if state := s.current(); state == OPEN_CONFIRM || state == ESTABLISHED {
 				conn.queue(&keepalive{})
 			}
 
 		case <-hold_timer.C:
+			s.emit(Event{Type: EVENT_TIMER, Timer: TIMER_HOLD})
 			return false, notify(HOLD_TIMER_EXPIRED, 0)
 		}
 	}
 
 }
 
+// Paces UPDATE messages to a maximum number per second. Messages which
+// cannot be sent immediately are held in a backlog which is released
+// as the timer fires.
+type pacer struct {
+	backlog []paced
+	timer   *time.Timer
+	armed   bool
+	last    time.Time
+}
+
+type paced struct {
+	message message
+	sent    func() // called when the message has been passed to the connection
+}
+
+func (p *pacer) C() <-chan time.Time {
+	if !p.armed {
+		return nil // blocks forever in a select
+	}
+	return p.timer.C
+}
+
+func (p *pacer) stop() {
+	if p.timer != nil {
+		p.timer.Stop()
+	}
+}
+
+// Queue messages for sending, calling sent (if not nil) once the last
+// of them has been passed to the connection.
+func (p *pacer) send(c *connection, rate uint16, sent func(), ms ...message) {
+	for i, m := range ms {
+		x := paced{message: m}
+		if i == len(ms)-1 {
+			x.sent = sent
+		}
+		p.backlog = append(p.backlog, x)
+	}
+
+	if !p.armed {
+		p.drain(c, rate)
+	}
+}
+
+func (p *pacer) tick(c *connection, rate uint16) {
+	p.armed = false
+	p.drain(c, rate)
+}
+
+func (p *pacer) drain(c *connection, rate uint16) {
+
+	var interval time.Duration
+
+	if rate > 0 {
+		interval = time.Second / time.Duration(rate)
+	}
+
+	for len(p.backlog) > 0 {
+		now := time.Now()
+
+		if wait := p.last.Add(interval).Sub(now); rate > 0 && wait > 0 {
+			if p.timer == nil {
+				p.timer = time.NewTimer(wait)
+			} else {
+				p.timer.Reset(wait)
+			}
+			p.armed = true
+			return
+		}
+
+		x := p.backlog[0]
+		p.backlog = p.backlog[1:]
+		p.last = now
+
+		c.queue(x.message)
+
+		if x.sent != nil {
+			x.sent()
+		}
+	}
+}
+
 func local(s uint8, d string) notification {
 	return notification{code: 0, sub: s, data: []byte(d)}
 }
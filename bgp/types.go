@@ -23,6 +23,7 @@ import (
 	"fmt"
 	"net"
 	"net/netip"
+	"reflect"
 	"regexp"
 	"strconv"
 )
@@ -131,10 +132,16 @@ func (c *Community) UnmarshalJSON(data []byte) error {
 }
 
 type Parameters struct {
-	// only used at session start
+	// only used at session start - changes cause an established session to be reset
 	ASNumber uint16 `json:"as_number,omitempty"`
 	HoldTime uint16 `json:"hold_time,omitempty"`
 	SourceIP IP4    `json:"source_ip,omitempty"` // not sure that this can be used with Dial()
+	PeerAS   uint32 `json:"peer_as,omitempty"`   // expected AS number of the peer (4-byte numbers supported) - any is accepted if 0
+	PeerID   IP4    `json:"peer_id,omitempty"`   // expected router ID of the peer - any is accepted if 0.0.0.0
+
+	// delays between connection attempts, in seconds
+	ConnectRetry uint16 `json:"connect_retry,omitempty"`  // initial delay after a failed attempt, backs off exponentially (default 30)
+	IdleHoldTime uint16 `json:"idle_hold_time,omitempty"` // delay after a session was torn down by a NOTIFICATION (defaults to ConnectRetry)
 
 	NextHop4      IP4  `json:"next_hop_4,omitempty"`
 	NextHop6      IP6  `json:"next_hop_6,omitempty"`
@@ -145,8 +152,18 @@ type Parameters struct {
 	LocalPref   uint32      `json:"local_pref,omitempty"`
 	Communities []Community `json:"communities,omitempty"`
 
+	// limits on outbound advertisements
+	MaxPrefixes     uint32 `json:"max_prefixes,omitempty"`      // maximum number of prefixes to advertise (0 for no limit)
+	MaxPrefixesWarn bool   `json:"max_prefixes_warn,omitempty"` // advertise all prefixes, but report the limit being exceeded in Status
+	MRAI            uint16 `json:"mrai,omitempty"`              // MinRouteAdvertisementInterval in seconds - changes are batched
+	UpdateRate      uint16 `json:"update_rate,omitempty"`       // maximum number of UPDATE messages sent per second (0 for no limit)
+
 	Accept []netip.Prefix `json:"accept,omitempty"`
 	Reject []netip.Prefix `json:"reject,omitempty"`
+	Policy Policy         `json:"policy,omitempty"` // applied to prefixes which pass the Accept/Reject lists
+
+	// advertise only while all conditions on received routes are met
+	Conditions []Condition `json:"conditions,omitempty"`
 }
 
 func (a *Parameters) Diff(b Parameters) bool {
@@ -165,7 +182,87 @@ func (a *Parameters) Diff(b Parameters) bool {
 		}
 	}
 
-	return false
+	// attributes set by the policy may have changed
+	return !reflect.DeepEqual(a.Policy, b.Policy)
+}
+
+// Returns an error describing the first problem found with the
+// parameters, if any.
+func (p *Parameters) Validate() error {
+
+	if p.ASNumber == 0 {
+		return errors.New("AS number must be set")
+	}
+
+	if p.HoldTime == 1 || p.HoldTime == 2 {
+		return errors.New("Hold time must be zero or at least 3 seconds")
+	}
+
+	for _, n := range append(append([]netip.Prefix{}, p.Accept...), p.Reject...) {
+		if !n.IsValid() {
+			return errors.New("Invalid prefix in accept/reject list")
+		}
+	}
+
+	for _, t := range p.Policy {
+		for _, n := range t.Match.Prefixes {
+			if !n.IsValid() {
+				return errors.New("Invalid prefix in policy term " + t.Name)
+			}
+		}
+	}
+
+	for _, c := range p.Conditions {
+		if !c.Prefix.IsValid() {
+			return errors.New("Invalid prefix in condition")
+		}
+	}
+
+	return nil
+}
+
+// Compares the parameters with a new set, returning the (JSON) names
+// of the fields which have changed. Changes in the reset list only take
+// effect when the session is re-established; live changes can be
+// applied to an established session.
+func (p *Parameters) Changes(n Parameters) (reset, live []string) {
+
+	r := func(changed bool, name string) {
+		if changed {
+			reset = append(reset, name)
+		}
+	}
+
+	l := func(changed bool, name string) {
+		if changed {
+			live = append(live, name)
+		}
+	}
+
+	r(p.ASNumber != n.ASNumber, "as_number")
+	r(p.HoldTime != n.HoldTime, "hold_time")
+	r(p.SourceIP != n.SourceIP, "source_ip")
+	r(p.PeerAS != n.PeerAS, "peer_as")
+	r(p.PeerID != n.PeerID, "peer_id")
+	r(p.NextHop4 != n.NextHop4, "next_hop_4")
+	r(p.NextHop6 != n.NextHop6, "next_hop_6")
+	r(p.Multiprotocol != n.Multiprotocol, "multiprotocol")
+
+	l(p.ConnectRetry != n.ConnectRetry, "connect_retry")
+	l(p.IdleHoldTime != n.IdleHoldTime, "idle_hold_time")
+	l(p.MED != n.MED, "med")
+	l(p.LocalPref != n.LocalPref, "local_pref")
+	l(!reflect.DeepEqual(p.Communities, n.Communities), "communities")
+	l(p.MaxPrefixes != n.MaxPrefixes, "max_prefixes")
+	l(p.MaxPrefixesWarn != n.MaxPrefixesWarn, "max_prefixes_warn")
+	l(p.MRAI != n.MRAI, "mrai")
+	l(p.UpdateRate != n.UpdateRate, "update_rate")
+	l(!reflect.DeepEqual(p.Accept, n.Accept), "accept")
+	l(!reflect.DeepEqual(p.Reject, n.Reject), "reject")
+	l(!reflect.DeepEqual(p.Policy, n.Policy), "policy")
+	l(!reflect.DeepEqual(p.Conditions, n.Conditions), "conditions")
+
+	return
 }
 
 type IP4 [4]byte
@@ -47,7 +47,20 @@ func main() {
 	var rib []netip.Addr // start with an empty routing information base - it could be pre-populated, though, eg.:
 	// rib:= routingInformationBase()
 
-	routerid, peer, parameters := parseCommandLineArguments()
+	routerid, peer, parameters, record := parseCommandLineArguments()
+
+	if record != "" {
+		// messages can be decoded with bgpdump, eg.: bgpdump -m bgp.mrt
+		m, err := bgp.NewMRT(record, 10000000, 3)
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		defer m.Close()
+
+		s.MRT(m) // before starting the session so that the OPEN messages are recorded
+	}
 
 	s.Start(routerid, peer, parameters, rib, &Log{}) // start the session - connections will be retried if they fail initially
 
@@ -98,7 +111,7 @@ func routingInformationBase() (rib []netip.Addr) {
 	return
 }
 
-func parseCommandLineArguments() ([4]byte, string, bgp.Parameters) {
+func parseCommandLineArguments() ([4]byte, string, bgp.Parameters, string) {
 
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage: %s [options] <as-number> <router-id> <peer-address>\n\n", os.Args[0])
@@ -109,6 +122,7 @@ func parseCommandLineArguments() ([4]byte, string, bgp.Parameters) {
 	multiprotocol := flag.Bool("m", false, "Multiprotocol")
 	nexthop6 := flag.String("6", "", "IPv6 next hop")
 	nexthop4 := flag.String("4", "", "IPv4 next hop")
+	record := flag.String("r", "", "Record BGP messages to an MRT file")
 
 	flag.Parse()
 
@@ -194,7 +208,7 @@ func parseCommandLineArguments() ([4]byte, string, bgp.Parameters) {
 		fmt.Println(string(js))
 	}
 
-	return routerid, peer, parameters
+	return routerid, peer, parameters, *record
 }
 
 func htonl(h uint32) [4]byte {
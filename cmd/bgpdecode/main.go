@@ -0,0 +1,186 @@
+/*
+ * VC5 load balancer. Copyright (C) 2021-present David Coles
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/davidcoles/cue/bgp"
+)
+
+/*
+
+  Decode BGP messages to JSON, for offline investigation of interop problems.
+
+  Messages given as hex strings on the command line (whitespace and colons are ignored):
+
+  # go run main.go ffffffffffffffffffffffffffffffff001304
+
+  One hex encoded message per line on stdin (eg. from a packet capture):
+
+  # tshark -r bgp.pcap -Y bgp -T fields -e tcp.payload | go run main.go
+
+  Messages recorded in MRT files (eg. by the -r option of ../bgp.go), with -4 to
+  decode AS_PATH attributes in hex input with 4-byte AS numbers:
+
+  # go run main.go -mrt bgp.mrt bgp.mrt.1
+
+*/
+
+type record struct {
+	*bgp.MRTRecord
+	Decoded *bgp.Message `json:"decoded,omitempty"`
+	Error   string       `json:"error,omitempty"`
+}
+
+func main() {
+
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [options] [<hex-message>|<mrt-file> ...]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Options:\n")
+		flag.PrintDefaults()
+	}
+
+	mrt := flag.Bool("mrt", false, "Arguments are MRT files (- for stdin)")
+	as4 := flag.Bool("4", false, "Hex messages use 4-byte AS numbers in AS_PATH")
+
+	flag.Parse()
+
+	args := flag.Args()
+
+	out := json.NewEncoder(os.Stdout)
+	out.SetIndent("", " ")
+
+	if *mrt {
+		if len(args) == 0 {
+			args = []string{"-"}
+		}
+
+		for _, a := range args {
+			if err := readMRTFile(out, a); err != nil {
+				log.Fatal(a, ": ", err)
+			}
+		}
+
+		return
+	}
+
+	d := bgp.Decoder{AS4: *as4}
+
+	if len(args) > 0 {
+		for _, a := range args {
+			out.Encode(decodeHex(d, a))
+		}
+		return
+	}
+
+	scanner := bufio.NewScanner(os.Stdin)
+	scanner.Buffer(nil, 2*bgp.MAX_EXTENDED_MESSAGE_LENGTH+1024)
+
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			out.Encode(decodeHex(d, line))
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func readMRTFile(out *json.Encoder, name string) error {
+	if name == "-" {
+		return readMRT(out, os.Stdin)
+	}
+
+	f, err := os.Open(name)
+
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	return readMRT(out, f)
+}
+
+func readMRT(out *json.Encoder, f io.Reader) error {
+	r := bgp.NewMRTReader(f)
+
+	for {
+		m, err := r.Next()
+
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		rec := record{MRTRecord: &m}
+
+		if msg, err := m.Decode(); err != nil {
+			rec.Error = err.Error()
+		} else {
+			rec.Decoded = &msg
+		}
+
+		out.Encode(rec)
+	}
+}
+
+// A hex string may contain several concatenated messages (eg. a TCP segment)
+func decodeHex(d bgp.Decoder, s string) (r []record) {
+
+	s = strings.NewReplacer(" ", "", ":", "", "\t", "").Replace(s)
+
+	b, err := hex.DecodeString(s)
+
+	if err != nil {
+		return []record{{Error: err.Error()}}
+	}
+
+	for len(b) > 0 {
+		m, n, err := d.Decode(b)
+
+		if n == 0 {
+			return append(r, record{Error: err.Error()})
+		}
+
+		rec := record{Decoded: &m}
+
+		if err != nil {
+			rec.Error = err.Error()
+		}
+
+		r = append(r, rec)
+		b = b[n:]
+	}
+
+	return r
+}
@@ -0,0 +1,444 @@
+/*
+ * VC5 load balancer. Copyright (C) 2021-present David Coles
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package cue
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/davidcoles/cue/bgp"
+	"gopkg.in/yaml.v3"
+)
+
+// A complete configuration for a Director and, optionally, a BGP pool,
+// in JSON or YAML (with the same field names), eg.:
+//
+//	{
+//	  "services": [
+//	    {
+//	      "address": "192.168.101.1", "port": 80, "protocol": "TCP", "required": 1,
+//	      "destinations": [
+//	        {"address": "10.1.2.3", "port": 80, "weight": 1, "checks": [{"type": "http", "path": "/health"}]}
+//	      ]
+//	    }
+//	  ],
+//	  "thresholds": {"192.168.101.1": "any"},
+//	  "bgp": {"router_id": "10.1.2.254", "peers": {"10.1.2.1": {"as_number": 65000}}}
+//	}
+type Config struct {
+	Services   []Service                `json:"services"`
+	Thresholds map[netip.Addr]Threshold `json:"thresholds,omitempty"`
+	BGP        *BGPConfig               `json:"bgp,omitempty"`
+}
+
+type BGPConfig struct {
+	RouterID bgp.IP4                   `json:"router_id,omitempty"` // for use with bgp.NewPool - changes are not applied on reload
+	Peers    map[string]bgp.Parameters `json:"peers"`
+}
+
+func (p *protocol) UnmarshalText(data []byte) error {
+	switch strings.ToUpper(string(data)) {
+	case "TCP":
+		*p = TCP
+	case "UDP":
+		*p = UDP
+	default:
+		return errors.New("Protocol must be TCP or UDP: " + string(data))
+	}
+	return nil
+}
+
+type plainService Service
+
+func (s Service) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		plainService
+		Protocol protocol `json:"protocol"`
+	}{plainService(s), protocol(s.Protocol)})
+}
+
+// Unknown fields are rejected, as with ParseConfig.
+func (s *Service) UnmarshalJSON(data []byte) error {
+	x := struct {
+		*plainService
+		Protocol protocol `json:"protocol"`
+	}{plainService: (*plainService)(s)}
+
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.DisallowUnknownFields()
+
+	if err := d.Decode(&x); err != nil {
+		return err
+	}
+
+	s.Protocol = uint8(x.Protocol)
+
+	return nil
+}
+
+// Parse a JSON configuration. Unknown fields are rejected so that typos
+// are not silently ignored. The configuration is not validated.
+func ParseConfig(data []byte) (*Config, error) {
+	var c Config
+
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.DisallowUnknownFields()
+
+	if err := d.Decode(&c); err != nil {
+		return nil, err
+	}
+
+	return &c, nil
+}
+
+// Parse a YAML configuration. It is converted to JSON and parsed with
+// ParseConfig, so unknown fields are rejected in the same way.
+func ParseYAMLConfig(data []byte) (*Config, error) {
+	var v interface{}
+
+	if err := yaml.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+
+	if v == nil {
+		return nil, errors.New("Empty configuration")
+	}
+
+	js, err := json.Marshal(jsonable(v))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseConfig(js)
+}
+
+// YAML mappings with non-string keys are decoded as
+// map[interface{}]interface{}, which cannot be encoded as JSON.
+func jsonable(v interface{}) interface{} {
+	switch x := v.(type) {
+	case map[string]interface{}:
+		for k, e := range x {
+			x[k] = jsonable(e)
+		}
+	case map[interface{}]interface{}:
+		m := map[string]interface{}{}
+		for k, e := range x {
+			m[fmt.Sprint(k)] = jsonable(e)
+		}
+		return m
+	case []interface{}:
+		for i, e := range x {
+			x[i] = jsonable(e)
+		}
+	}
+
+	return v
+}
+
+// Read, parse and validate a configuration file. Files with a .yaml or
+// .yml extension are parsed as YAML, anything else as JSON.
+func LoadConfig(file string) (*Config, error) {
+	data, err := os.ReadFile(file)
+
+	if err != nil {
+		return nil, err
+	}
+
+	parse := ParseConfig
+
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".yaml", ".yml":
+		parse = ParseYAMLConfig
+	}
+
+	c, err := parse(data)
+
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Check the services and BGP parameters, returning a *ValidationError
+// listing every problem.
+func (c *Config) Validate() error {
+	var e ValidationError
+
+	if err := Validate(c.Services); err != nil {
+		e.Problems = append(e.Problems, err.(*ValidationError).Problems...)
+	}
+
+	critical := criticalServices(c.Services)
+
+	for _, vip := range sortedAddrs(c.Thresholds) {
+		path := "thresholds[" + vip.String() + "]"
+
+		if n, ok := critical[vip]; !ok {
+			e.add(path, "No services are configured for the VIP")
+		} else if t := c.Thresholds[vip]; t != ALL && int(t) > n {
+			e.add(path, fmt.Sprintf("Threshold of %d is more than the number of critical services (%d)", t, n))
+		}
+	}
+
+	if c.BGP != nil {
+		var peers []string
+
+		for peer, _ := range c.BGP.Peers {
+			peers = append(peers, peer)
+		}
+
+		sort.Strings(peers)
+
+		for _, peer := range peers {
+			path := "bgp.peers[" + peer + "]"
+			params := c.BGP.Peers[peer]
+
+			host := peer
+
+			if h, _, err := net.SplitHostPort(peer); err == nil {
+				host = h
+			}
+
+			if _, err := netip.ParseAddr(host); err != nil {
+				e.add(path, "Peer must be an IP address, optionally with a port")
+			}
+
+			if err := params.Validate(); err != nil {
+				e.add(path, "%s", err.Error())
+			}
+		}
+	}
+
+	if len(e.Problems) > 0 {
+		return &e
+	}
+
+	return nil
+}
+
+func sortedAddrs(m map[netip.Addr]Threshold) (r []netip.Addr) {
+	for a, _ := range m {
+		r = append(r, a)
+	}
+	sort.Slice(r, func(i, j int) bool { return r[i].Less(r[j]) })
+	return
+}
+
+// Applies a configuration file (see Config and LoadConfig) to a
+// Director and, optionally, a BGP pool. The file is reloaded on SIGHUP,
+// and when it changes if Interval is set - once its size and
+// modification time are the same for two checks, so that a file which
+// is being written is not loaded. If a reload fails then the running
+// configuration is left in place.
+type Loader struct {
+	File     string
+	Director *Director
+	Pool     *bgp.Pool     // optional - peers are configured from the "bgp" section
+	Interval time.Duration // how often to check the file for changes (0 to only reload on SIGHUP)
+
+	// Called after each attempt to (re)load the file, with a nil error on success.
+	Report func(file string, err error)
+
+	loading sync.Mutex // serialises loads
+	mutex   sync.Mutex
+	config  *Config
+	stat    os.FileInfo // when the file was last loaded
+	pending os.FileInfo // a change seen by the previous check
+	done    chan bool
+}
+
+// Load the file and start watching for changes. An error is returned
+// if the initial configuration could not be loaded.
+func (l *Loader) Start() error {
+
+	if err := l.Load(); err != nil {
+		return err
+	}
+
+	done := make(chan bool)
+
+	l.mutex.Lock()
+	l.done = done
+	l.mutex.Unlock()
+
+	go l.background(done)
+
+	return nil
+}
+
+// Stop watching for changes. It is safe to call Stop if Start was not
+// called or failed.
+func (l *Loader) Stop() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.done != nil {
+		close(l.done)
+		l.done = nil
+	}
+}
+
+// The configuration currently in use.
+func (l *Loader) Config() *Config {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.config
+}
+
+// Load the file and apply it. Nothing is changed if the file cannot be
+// read or fails validation.
+func (l *Loader) Load() error {
+	l.loading.Lock()
+	defer l.loading.Unlock()
+
+	stat, _ := os.Stat(l.File)
+
+	c, err := l.load()
+
+	l.mutex.Lock()
+	l.stat = stat // don't retry a broken file until it changes again
+	l.pending = nil
+	if err == nil {
+		l.config = c
+	}
+	l.mutex.Unlock()
+
+	// without the mutex held so that Report may call Config
+	if l.Report != nil {
+		l.Report(l.File, err)
+	}
+
+	return err
+}
+
+func (l *Loader) load() (*Config, error) {
+	c, err := LoadConfig(l.File)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := l.Director.apply(c); err != nil {
+		return nil, err
+	}
+
+	if l.Pool != nil {
+		var peers map[string]bgp.Parameters
+
+		if c.BGP != nil {
+			peers = c.BGP.Peers
+		}
+
+		l.Pool.Configure(peers, "Removed from configuration")
+	}
+
+	return c, nil
+}
+
+// Set the services and thresholds together so that subscribers never
+// see one without the other.
+func (d *Director) apply(c *Config) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if err := d.configure(c.Services); err != nil {
+		return err
+	}
+
+	d.setThresholds(c.Thresholds)
+	d.services() // report changes to subscribers
+	d.inform()
+
+	return nil
+}
+
+func (l *Loader) changed() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	stat, err := os.Stat(l.File)
+
+	if err != nil {
+		l.pending = nil
+		return false // probably being replaced - try again later
+	}
+
+	if l.stat != nil && same(stat, l.stat) {
+		l.pending = nil
+		return false
+	}
+
+	// wait until the file has stopped changing
+	if l.pending == nil || !same(stat, l.pending) {
+		l.pending = stat
+		return false
+	}
+
+	return true
+}
+
+func same(a, b os.FileInfo) bool {
+	return a.ModTime().Equal(b.ModTime()) && a.Size() == b.Size()
+}
+
+func (l *Loader) background(done chan bool) {
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var poll <-chan time.Time
+
+	if l.Interval > 0 {
+		ticker := time.NewTicker(l.Interval)
+		defer ticker.Stop()
+		poll = ticker.C
+	}
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-hup:
+			l.Load()
+		case <-poll:
+			if l.changed() {
+				l.Load()
+			}
+		}
+	}
+}
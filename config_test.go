@@ -0,0 +1,369 @@
+/*
+ * VC5 load balancer. Copyright (C) 2021-present David Coles
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package cue
+
+import (
+	"encoding/json"
+	"errors"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/davidcoles/cue/mon"
+)
+
+const testConfig = `{
+  "services": [
+    {
+      "address": "192.168.101.1", "port": 80, "protocol": "TCP", "required": 1,
+      "destinations": [
+        {"address": "10.1.2.3", "port": 80, "weight": 1, "checks": [{"type": "http", "path": "/health"}]}
+      ]
+    }
+  ],
+  "thresholds": {"192.168.101.1": "any"},
+  "bgp": {"router_id": "10.1.2.254", "peers": {"10.1.2.1": {"as_number": 65000}}}
+}`
+
+func TestParseConfig(t *testing.T) {
+	c, err := ParseConfig([]byte(testConfig))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(c.Services) != 1 || c.Services[0].Protocol != TCP || c.Services[0].Destinations[0].Checks[0].Path != "/health" {
+		t.Error("Unexpected services:", c.Services)
+	}
+
+	if c.BGP == nil || c.BGP.Peers["10.1.2.1"].ASNumber != 65000 || c.BGP.RouterID.String() != "10.1.2.254" {
+		t.Error("Unexpected BGP config:", c.BGP)
+	}
+
+	if js, _ := json.Marshal(c.Services[0]); !strings.Contains(string(js), `"protocol":"TCP"`) {
+		t.Error("Unexpected JSON:", string(js))
+	}
+
+	for _, bad := range []string{
+		`{"services": [{"address": "192.168.101.1", "port": 80, "protocol": "SCTP"}]}`,
+		`{"services": [{"address": "192.168.101.1", "prot": 80}]}`,
+		`{"service": []}`,
+	} {
+		if _, err := ParseConfig([]byte(bad)); err == nil {
+			t.Error("Invalid config accepted:", bad)
+		}
+	}
+}
+
+func TestParseYAMLConfig(t *testing.T) {
+	c, err := ParseYAMLConfig([]byte(`
+services:
+  - address: 192.168.101.1
+    port: 80
+    protocol: TCP
+    required: 1
+    destinations:
+      - {address: 10.1.2.3, port: 80, weight: 1, checks: [{type: http, path: /health, method: HEAD}]}
+thresholds:
+  192.168.101.1: any
+bgp:
+  router_id: 10.1.2.254
+  peers:
+    10.1.2.1: {as_number: 65000}
+`))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	want, _ := ParseConfig([]byte(testConfig))
+	want.Services[0].Destinations[0].Checks[0].Method = true
+
+	x, _ := json.Marshal(c)
+	y, _ := json.Marshal(want)
+
+	if string(x) != string(y) {
+		t.Error("Unexpected config:", string(x), "expected", string(y))
+	}
+
+	file := filepath.Join(t.TempDir(), "config.yml")
+	os.WriteFile(file, []byte("services: []\nthresholds: {192.168.101.1: all}"), 0644)
+
+	if c, err := LoadConfig(file); err == nil || !strings.Contains(err.Error(), "thresholds[192.168.101.1]") {
+		t.Error("Unexpected result:", c, err)
+	}
+
+	for _, bad := range []string{
+		"services: [{address: 192.168.101.1, prot: 80}]",
+		"services: [",
+		"",
+	} {
+		if _, err := ParseYAMLConfig([]byte(bad)); err == nil {
+			t.Error("Invalid config accepted:", bad)
+		}
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	c, err := ParseConfig([]byte(`{
+  "services": [{"address": "192.168.101.1", "port": 80, "protocol": "UDP"}],
+  "thresholds": {"192.168.101.1": 2, "192.168.101.2": 2},
+  "bgp": {"peers": {"router": {"as_number": 65000}, "10.1.2.1": {}}}
+}`))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var v *ValidationError
+
+	if err := c.Validate(); !errors.As(err, &v) {
+		t.Fatal("Unexpected error:", err)
+	}
+
+	want := []string{"thresholds[192.168.101.1]", "thresholds[192.168.101.2]", "bgp.peers[10.1.2.1]", "bgp.peers[router]"}
+
+	if len(v.Problems) != len(want) {
+		t.Fatal("Unexpected problems:", v.Problems)
+	}
+
+	for i, p := range v.Problems {
+		if p.Path != want[i] {
+			t.Error("Unexpected problem:", p)
+		}
+	}
+}
+
+func TestLoader(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.json")
+
+	// replace the file atomically, so that it is never seen part written
+	write := func(s string, age time.Duration) {
+		tmp := file + ".tmp"
+		if err := os.WriteFile(tmp, []byte(s), 0644); err != nil {
+			t.Fatal(err)
+		}
+		// make sure that the modification time changes
+		when := time.Now().Add(-age)
+		os.Chtimes(tmp, when, when)
+		if err := os.Rename(tmp, file); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reports := make(chan error, 10)
+
+	wait := func() error {
+		t.Helper()
+		select {
+		case err := <-reports:
+			return err
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for reload")
+		}
+		return nil
+	}
+
+	write(testConfig, time.Hour)
+
+	d := &Director{Prober: prober(false)}
+
+	if err := d.Start(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	defer d.Stop()
+
+	var l *Loader
+
+	// Report may look at the configuration
+	l = &Loader{File: file, Director: d, Interval: 10 * time.Millisecond, Report: func(f string, err error) { l.Config(); reports <- err }}
+
+	if err := l.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	defer l.Stop()
+
+	if err := wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	if s := d.Status(); len(s) != 1 {
+		t.Error("Unexpected services:", s)
+	}
+
+	// a broken file leaves the running config in place
+	write(strings.Replace(testConfig, `"port": 80, "protocol"`, `"port": 0, "protocol"`, 1), 2*time.Hour)
+
+	if err := wait(); err == nil || !strings.Contains(err.Error(), "Service port cannot be 0") {
+		t.Error("Unexpected error:", err)
+	}
+
+	if s := d.Status(); len(s) != 1 || s[0].Port != 80 || l.Config().Services[0].Port != 80 {
+		t.Error("Unexpected services:", s)
+	}
+
+	second := strings.Replace(testConfig, `"services": [`, `"services": [{"address": "192.168.101.2", "port": 53, "protocol": "UDP"},`, 1)
+	write(second, 3*time.Hour)
+
+	if err := wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	if s := d.Status(); len(s) != 2 {
+		t.Error("Unexpected services:", s)
+	}
+
+	// reload on SIGHUP, even though the file is unchanged
+	if p, err := os.FindProcess(os.Getpid()); err != nil || p.Signal(syscall.SIGHUP) != nil {
+		t.Skip("Unable to send SIGHUP")
+	}
+
+	if err := wait(); err != nil {
+		t.Error("Unexpected error:", err)
+	}
+}
+
+// a file which is being written in place is only loaded once it has
+// stopped changing
+func TestLoaderChanged(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.json")
+
+	write := func(s string, age time.Duration) {
+		if err := os.WriteFile(file, []byte(s), 0644); err != nil {
+			t.Fatal(err)
+		}
+		when := time.Now().Add(-age)
+		os.Chtimes(file, when, when)
+	}
+
+	write(testConfig, time.Hour)
+
+	l := &Loader{File: file}
+	l.stat, _ = os.Stat(file)
+
+	if l.changed() {
+		t.Error("Unchanged file reported as changed")
+	}
+
+	write(testConfig[:10], 2*time.Hour) // part written
+
+	if l.changed() {
+		t.Error("Changing file reported as changed")
+	}
+
+	write(testConfig, 3*time.Hour)
+
+	if l.changed() {
+		t.Error("Changing file reported as changed")
+	}
+
+	if !l.changed() {
+		t.Error("Changed file not reported")
+	}
+}
+
+// fails probes to one port
+type portProber uint16
+
+func (p portProber) Probe(_ *mon.Mon, i mon.Instance, _ mon.Check) (bool, string) {
+	return i.Destination.Port != uint16(p), "fake"
+}
+
+func TestApply(t *testing.T) {
+	vip := netip.MustParseAddr("192.168.0.1")
+	a := service("192.168.0.1", 80, "10.0.0.1")
+	b := service("192.168.0.1", 443, "10.0.0.1")
+	b.NonCritical = true
+
+	for _, s := range []*Service{&a, &b} {
+		s.Destinations[0].Checks = []mon.Check{{Type: "http"}}
+	}
+
+	// a's destination is restored as up, b's starts down
+	file := filepath.Join(t.TempDir(), "state.json")
+	now := time.Now()
+	data, _ := json.Marshal([]savedState{{Address: vip, Port: 80, Protocol: TCP, Destination: netip.MustParseAddrPort("10.0.0.1:80"),
+		Status: mon.Status{OK: true, Last: now, When: now, Initialised: true}}})
+
+	if err := os.WriteFile(file, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	d := &Director{Prober: portProber(443), StateFile: file}
+	s := d.Subscribe(100)
+
+	if err := d.Start([]Service{a, b}); err != nil {
+		t.Fatal(err)
+	}
+
+	defer d.Stop()
+
+	for e := next(t, s); e.Type != VIP_HEALTHY; e = next(t, s) {
+	}
+
+	// services and thresholds are applied together, so making b
+	// critical while lowering the threshold does not flap the VIP
+	b.NonCritical = false
+
+	if err := d.apply(&Config{Services: []Service{a, b}, Thresholds: map[netip.Addr]Threshold{vip: ANY}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a failed update changes neither
+	if err := d.apply(&Config{Services: []Service{{Address: vip}}}); err == nil {
+		t.Error("Invalid services accepted")
+	}
+
+	if v := d.VIPStatus(); len(v) != 1 || !v[0].Healthy || v[0].Required != 1 || v[0].Critical != 2 {
+		t.Error("Unexpected status:", v)
+	}
+
+	select {
+	case e := <-s.C:
+		t.Error("Unexpected event:", e.Type, e.Instance)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestLoaderStop(t *testing.T) {
+	l := &Loader{File: filepath.Join(t.TempDir(), "missing.json"), Director: &Director{}}
+
+	l.Stop() // never started
+
+	if err := l.Start(); err == nil {
+		t.Error("Missing file accepted")
+	}
+
+	l.Stop()
+	l.Stop()
+}
@@ -19,7 +19,6 @@
 package cue
 
 import (
-	"errors"
 	"net/netip"
 	"sort"
 	"sync"
@@ -36,19 +35,21 @@ const (
 type Check = mon.Check
 type Scheduler = string
 
+// Protocol is encoded in JSON as "TCP" or "UDP" (see config.go).
 type Service struct {
-	Address      netip.Addr
-	Port         uint16
-	Protocol     uint8
-	Scheduler    string
-	Persist      uint32
-	Sticky       bool
-	Reset        bool
-	Required     uint8
-	Destinations []Destination
+	Address      netip.Addr    `json:"address"`
+	Port         uint16        `json:"port"`
+	Protocol     uint8         `json:"protocol"`
+	Scheduler    string        `json:"scheduler,omitempty"`
+	Persist      uint32        `json:"persist,omitempty"`
+	Sticky       bool          `json:"sticky,omitempty"`
+	Reset        bool          `json:"reset,omitempty"`
+	Required     uint8         `json:"required,omitempty"`
+	NonCritical  bool          `json:"non_critical,omitempty"` // the service does not count towards the health of the VIP (see VIPStatus)
+	Destinations []Destination `json:"destinations,omitempty"`
 	available    uint8
-	Up           bool
-	When         time.Time
+	Up           bool      `json:"up"`
+	When         time.Time `json:"when"`
 }
 
 type Destination struct {
@@ -81,6 +82,11 @@ func (p protocol) MarshalText() ([]byte, error) {
 	return []byte("Unknown"), nil
 }
 
+func (p protocol) String() string {
+	b, _ := p.MarshalText()
+	return string(b)
+}
+
 func (s *Service) Available() uint8 {
 	return s.available
 }
@@ -107,6 +113,7 @@ func (i Service) less(j Service) bool {
 
 type Director struct {
 	// A channel which may be used to receive notifications of changes in status of backend servers.
+	// See Subscribe() for details of what changed.
 	C chan bool
 
 	// The Balancer which will implement the services managed by this Director.
@@ -119,12 +126,26 @@ type Director struct {
 	// Default IP address to use for network probes (needed for SYN, should be optional).
 	Address netip.Addr
 
+	// Optional file in which the health state of destinations is saved when it changes,
+	// every StateMaxAge/2 and at shutdown. Destinations in the first non-empty
+	// configuration resume from any saved state which is no older than StateMaxAge (default
+	// one minute) rather than starting down.
+	StateFile   string
+	StateMaxAge time.Duration
+
 	mutex sync.Mutex
 	cfg   map[tuple]Service
 	mon   *mon.Mon
 	die   chan bool
 
 	svc map[tuple]status
+
+	subs   map[*Subscription]bool
+	health health // last state reported to subscribers
+
+	thresholds map[netip.Addr]Threshold
+	restored   map[mon.Instance]mon.Status // saved state, only used by the first non-empty configuration
+	stopped    bool                        // state has been saved for the last time
 }
 
 type status struct {
@@ -152,9 +173,15 @@ func (d *Director) Start(cfg []Service) error {
 		return err
 	}
 
-	err = d.Configure(cfg)
-
-	if err != nil {
+	d.mutex.Lock()
+	d.stopped = false
+	d.restored = d.restore(time.Now())
+	d.mutex.Unlock()
+
+	if err = d.Configure(cfg); err != nil {
+		d.mutex.Lock()
+		d.restored = nil
+		d.mutex.Unlock()
 		d.mon.Update(nil)
 		return err
 	}
@@ -167,6 +194,10 @@ func (d *Director) Start(cfg []Service) error {
 }
 
 func (d *Director) Stop() {
+	d.mutex.Lock()
+	d.save() // before the services are removed
+	d.stopped = true
+	d.mutex.Unlock()
 	close(d.die)
 }
 
@@ -174,6 +205,23 @@ func (d *Director) Configure(config []Service) error {
 	d.mutex.Lock()
 	defer d.mutex.Unlock()
 
+	if err := d.configure(config); err != nil {
+		return err
+	}
+
+	d.services() // report changes to subscribers
+	d.inform()
+
+	return nil
+}
+
+// Must be called with the mutex held. Subscribers are not informed.
+func (d *Director) configure(config []Service) error {
+
+	if err := Validate(config); err != nil {
+		return err
+	}
+
 	cfg := map[tuple]Service{}
 
 	for _, s := range config {
@@ -181,59 +229,64 @@ func (d *Director) Configure(config []Service) error {
 		cfg[t] = s
 	}
 
-	vips := map[netip.Addr]bool{}
-	svcs := map[mon.Service]bool{}
-
-	// scan previous config for checks to see if vip/service existed ...
-	for s, _ := range d.cfg {
-		vips[s.Address] = true
-		svcs[mon.Service{Address: s.Address, Port: s.Port, Protocol: s.Protocol}] = true
-	}
+	starting := initial(d.cfg)
+	r := d.restored
+	age := d.stateMaxAge()
 
 	services := map[mon.Instance]mon.Target{}
 
 	for _, s := range cfg {
-		if s.Port == 0 {
-			return errors.New("Service port cannot be 0")
-		}
 
-		if s.Protocol != TCP && s.Protocol != UDP {
-			return errors.New("Only TCP and UDP protocols supported")
-		}
+		service := mon.Service{Address: s.Address, Port: s.Port, Protocol: s.Protocol}
+		init := starting(service)
 
 		for _, d := range s.Destinations {
-			if d.Port == 0 {
-				return errors.New("Destination port cannot be 0")
+			i := mon.Instance{Service: service, Destination: mon.Destination{Address: d.Address, Port: d.Port}}
+			target := mon.Target{Init: init, Checks: d.Checks}
+
+			if status, ok := r[i]; ok && time.Since(status.Last) <= age {
+				target.Status = &status
 			}
+
+			services[i] = target
 		}
 	}
 
-	for _, s := range cfg {
+	d.cfg = cfg
 
-		service := mon.Service{Address: s.Address, Port: s.Port, Protocol: s.Protocol}
+	if len(cfg) > 0 {
+		d.restored = nil
+	}
+
+	d.mon.Update(services)
 
+	return nil
+}
+
+// Returns a function giving the health state which new destinations of
+// a service start in, given the previous configuration.
+func initial(prev map[tuple]Service) func(tuple) bool {
+
+	vips := map[netip.Addr]bool{}
+	svcs := map[mon.Service]bool{}
+
+	// scan previous config for checks to see if vip/service existed ...
+	for s, _ := range prev {
+		vips[s.Address] = true
+		svcs[mon.Service{Address: s.Address, Port: s.Port, Protocol: s.Protocol}] = true
+	}
+
+	return func(service tuple) bool {
 		// When:
 		// 1) adding a new vip, all checks should start as down(false) to prevent routing flaps
 		// 2) adding a new service to an existing vip, start up(true) to prevent vip being withdrawn
 		// 3) adding a new real to an existing service, start as down(false) state to prevent rehash
 
-		init := vips[s.Address] && !svcs[service]
+		return vips[service.Address] && !svcs[service]
 		// 1: false && ?????? => false
 		// 2: true  && !false => true
 		// 3: true  && !true  => false
-
-		for _, d := range s.Destinations {
-			i := mon.Instance{Service: service, Destination: mon.Destination{Address: d.Address, Port: d.Port}}
-			services[i] = mon.Target{Init: init, Checks: d.Checks}
-		}
 	}
-
-	d.cfg = cfg
-
-	d.mon.Update(services)
-	d.inform()
-
-	return nil
 }
 
 func clone(in []Service) (out []Service) {
@@ -301,6 +354,10 @@ func (d *Director) services() (r []Service) {
 
 	d.svc = svc
 
+	next, diagnostics := newHealth(r, d.thresholds)
+	d.emit(d.health.changes(next, diagnostics, time.Now()))
+	d.health = next
+
 	return
 }
 
@@ -328,16 +385,35 @@ func (d *Director) inform() {
 }
 
 func (d *Director) background() {
+
+	var refresh <-chan time.Time
+
+	// keep the saved state fresh, even when nothing changes
+	if d.StateFile != "" {
+		ticker := time.NewTicker(d.stateMaxAge() / 2)
+		defer ticker.Stop()
+		refresh = ticker.C
+	}
+
 	for {
 		select {
 		case <-d.mon.C:
 			d.mutex.Lock()
+			d.services() // report changes to subscribers
+			d.save()
 			d.inform()
 			d.mutex.Unlock()
+		case <-refresh:
+			d.mutex.Lock()
+			d.save()
+			d.mutex.Unlock()
 		case <-d.die:
 			d.Configure(nil)
 			d.mon.Update(nil)
 			d.inform()
+			d.mutex.Lock()
+			d.unsubscribeAll()
+			d.mutex.Unlock()
 			return
 		}
 	}
@@ -357,25 +433,13 @@ func AllVIPs(services []Service) (r []netip.Addr) {
 	return
 }
 
+// VIPs on which all critical services are up. See Director.VIPStatus
+// for VIPs with other thresholds.
 func HealthyVIPs(services []Service) (r []netip.Addr) {
 
-	vips := map[netip.Addr]bool{}
-
-	for _, s := range services {
-		vip := s.Address
-
-		if s.Up {
-			if _, ok := vips[vip]; !ok {
-				vips[vip] = true
-			}
-		} else {
-			vips[vip] = false
-		}
-	}
-
-	for ip, ok := range vips {
-		if ok {
-			r = append(r, ip)
+	for _, v := range vipStatus(services, nil) {
+		if v.Healthy {
+			r = append(r, v.Address)
 		}
 	}
 
@@ -0,0 +1,160 @@
+/*
+ * VC5 load balancer. Copyright (C) 2021-present David Coles
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package cue
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/davidcoles/cue/mon"
+)
+
+type prober bool
+
+func (p prober) Probe(*mon.Mon, mon.Instance, mon.Check) (bool, string) {
+	return bool(p), "fake"
+}
+
+func service(vip string, port uint16, destinations ...string) Service {
+	s := Service{Address: netip.MustParseAddr(vip), Port: port, Protocol: TCP, Required: 1}
+
+	for _, d := range destinations {
+		s.Destinations = append(s.Destinations, Destination{Address: netip.MustParseAddr(d), Port: port, Weight: 1})
+	}
+
+	return s
+}
+
+func next(t *testing.T, s *Subscription) Event {
+	t.Helper()
+
+	select {
+	case e, ok := <-s.C:
+		if !ok {
+			t.Fatal("Subscription closed")
+		}
+		return e
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for event")
+	}
+
+	return Event{}
+}
+
+func TestSubscribe(t *testing.T) {
+	d := &Director{Prober: prober(false)}
+	s := d.Subscribe(10)
+
+	a := service("192.168.0.1", 80, "10.0.0.1")
+	b := service("192.168.0.1", 443, "10.0.0.1", "10.0.0.2")
+
+	if err := d.Start([]Service{a}); err != nil {
+		t.Fatal(err)
+	}
+
+	// destinations for a new service on an existing VIP start as healthy
+	if err := d.Configure([]Service{a, b}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []EventType{DESTINATION_UP, DESTINATION_UP, SERVICE_UP} {
+		if e := next(t, s); e.Type != want || e.Instance.Service.Port != 443 {
+			t.Error("Unexpected event:", e.Type, e.Instance, "expected", want)
+		}
+	}
+
+	d.Stop()
+
+	for _, want := range []EventType{DESTINATION_DOWN, DESTINATION_DOWN, SERVICE_DOWN} {
+		if e := next(t, s); e.Type != want || e.Instance.Service.Port != 443 {
+			t.Error("Unexpected event:", e.Type, e.Instance, "expected", want)
+		}
+	}
+
+	for range s.C {
+		t.Error("Unexpected event")
+	}
+}
+
+func TestEventChanges(t *testing.T) {
+	a := service("192.168.0.1", 80, "10.0.0.1", "10.0.0.2")
+	b := service("192.168.0.2", 80, "10.0.0.1")
+
+	a.Destinations[0].Status.OK = true
+	a.Up = true
+
+	var prev health
+	next, diagnostics := newHealth([]Service{a, b}, nil)
+	events := prev.changes(next, diagnostics, time.Now())
+
+	var types []EventType
+	for _, e := range events {
+		types = append(types, e.Type)
+	}
+
+	if len(types) != 3 || types[0] != DESTINATION_UP || types[1] != SERVICE_UP || types[2] != VIP_HEALTHY {
+		t.Error("Unexpected events:", types)
+	}
+
+	if e := events[0]; e.Instance.Destination.Address != netip.MustParseAddr("10.0.0.1") || e.VIP != a.Address {
+		t.Error("Unexpected event:", e)
+	}
+
+	// VIP removed
+	prev = next
+	next, diagnostics = newHealth([]Service{b}, nil)
+	events = prev.changes(next, diagnostics, time.Now())
+
+	if len(events) != 3 || events[0].Type != DESTINATION_DOWN || events[0].Diagnostic != "Removed" || events[2].Type != VIP_UNHEALTHY {
+		t.Error("Unexpected events:", events)
+	}
+}
+
+func TestOverflow(t *testing.T) {
+	d := &Director{}
+	s := d.Subscribe(2)
+
+	d.mutex.Lock()
+	for n := 0; n < 5; n++ {
+		d.emit([]Event{{Type: VIP_HEALTHY}})
+	}
+	d.mutex.Unlock()
+
+	next(t, s)
+	next(t, s)
+
+	d.mutex.Lock()
+	d.emit([]Event{{Type: VIP_UNHEALTHY}})
+	d.mutex.Unlock()
+
+	if e := next(t, s); e.Type != OVERFLOW || e.Dropped != 3 {
+		t.Error("Unexpected event:", e)
+	}
+
+	if e := next(t, s); e.Type != VIP_UNHEALTHY {
+		t.Error("Unexpected event:", e)
+	}
+
+	s.Unsubscribe()
+
+	if _, ok := <-s.C; ok {
+		t.Error("Subscription not closed")
+	}
+}
@@ -0,0 +1,251 @@
+/*
+ * VC5 load balancer. Copyright (C) 2021-present David Coles
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package cue
+
+import (
+	"net/netip"
+	"sort"
+	"time"
+
+	"github.com/davidcoles/cue/mon"
+)
+
+type EventType string
+
+const (
+	DESTINATION_UP   EventType = "destination_up"   // a destination passed its health checks (Instance, Diagnostic)
+	DESTINATION_DOWN EventType = "destination_down" // a destination failed its health checks, or was removed (Instance, Diagnostic)
+	SERVICE_UP       EventType = "service_up"       // enough destinations are healthy for the service to be up (Instance.Service)
+	SERVICE_DOWN     EventType = "service_down"     // too few destinations are healthy, or the service was removed (Instance.Service)
+	VIP_HEALTHY      EventType = "vip_healthy"      // enough critical services on the VIP are up (VIP, Diagnostic)
+	VIP_UNHEALTHY    EventType = "vip_unhealthy"    // too few critical services are up, or the VIP was removed (VIP, Diagnostic)
+	OVERFLOW         EventType = "overflow"         // events were discarded because the subscriber's buffer was full (Dropped)
+)
+
+// A change in the state of a destination, service or VIP. Items are
+// considered down/unhealthy when first configured, so a consumer which
+// applies events in order to an empty set will track the current
+// state. After an OVERFLOW event the consumer should resynchronise
+// with Director.Status().
+type Event struct {
+	Type       EventType    `json:"type"`
+	Time       time.Time    `json:"time"`
+	VIP        netip.Addr   `json:"vip"`
+	Instance   mon.Instance `json:"instance"`
+	Diagnostic string       `json:"diagnostic,omitempty"`
+	Dropped    uint64       `json:"dropped,omitempty"`
+}
+
+// A subscription to a Director's events. C is closed when the
+// subscription is cancelled or the Director is stopped.
+type Subscription struct {
+	C <-chan Event
+
+	c       chan Event
+	d       *Director
+	dropped uint64
+}
+
+// Subscribe to events. Up to size events are buffered; if the
+// subscriber falls further behind than that then events are discarded
+// and an OVERFLOW event is delivered once there is space.
+func (d *Director) Subscribe(size int) *Subscription {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if size < 1 {
+		size = 1
+	}
+
+	c := make(chan Event, size)
+	s := &Subscription{C: c, c: c, d: d}
+
+	if d.subs == nil {
+		d.subs = map[*Subscription]bool{}
+	}
+
+	d.subs[s] = true
+
+	return s
+}
+
+// Cancel the subscription, closing C.
+func (s *Subscription) Unsubscribe() {
+	d := s.d
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.subs[s] {
+		delete(d.subs, s)
+		close(s.c)
+	}
+}
+
+func (s *Subscription) send(e Event) {
+	if s.dropped > 0 {
+		select {
+		case s.c <- Event{Type: OVERFLOW, Time: e.Time, Dropped: s.dropped}:
+			s.dropped = 0
+		default:
+			s.dropped++
+			return
+		}
+	}
+
+	select {
+	case s.c <- e:
+	default:
+		s.dropped++
+	}
+}
+
+// must be called with the mutex held
+func (d *Director) emit(events []Event) {
+	for _, e := range events {
+		for s, _ := range d.subs {
+			s.send(e)
+		}
+	}
+}
+
+// must be called with the mutex held
+func (d *Director) unsubscribeAll() {
+	for s, _ := range d.subs {
+		close(s.c)
+	}
+	d.subs = nil
+}
+
+type health struct {
+	dst map[mon.Instance]bool
+	svc map[mon.Service]bool
+	vip map[netip.Addr]bool
+	why map[netip.Addr]string
+}
+
+func newHealth(services []Service, thresholds map[netip.Addr]Threshold) (h health, diagnostics map[mon.Instance]string) {
+	h = health{dst: map[mon.Instance]bool{}, svc: map[mon.Service]bool{}, vip: map[netip.Addr]bool{}, why: map[netip.Addr]string{}}
+	diagnostics = map[mon.Instance]string{}
+
+	for _, s := range services {
+		t := tuple{Address: s.Address, Port: s.Port, Protocol: s.Protocol}
+
+		for _, d := range s.Destinations {
+			i := mon.Instance{Service: t, Destination: mon.Destination{Address: d.Address, Port: d.Port}}
+			h.dst[i] = d.Status.OK
+			diagnostics[i] = d.Status.Diagnostic
+		}
+
+		h.svc[t] = s.Up
+	}
+
+	for _, v := range vipStatus(services, thresholds) {
+		h.vip[v.Address] = v.Healthy
+		h.why[v.Address] = v.Reason
+	}
+
+	return
+}
+
+// Events describing the changes from one state to the next. Items which
+// have been added are treated as previously down, and those which have
+// been removed as now down.
+func (prev *health) changes(next health, diagnostics map[mon.Instance]string, when time.Time) (events []Event) {
+
+	var dst []Event
+	var svc []Event
+	var vip []Event
+
+	for i, up := range next.dst {
+		if up != prev.dst[i] {
+			e := Event{Type: DESTINATION_DOWN, Time: when, VIP: i.Service.Address, Instance: i, Diagnostic: diagnostics[i]}
+			if up {
+				e.Type = DESTINATION_UP
+			}
+			dst = append(dst, e)
+		}
+	}
+
+	for i, up := range prev.dst {
+		if _, ok := next.dst[i]; up && !ok {
+			dst = append(dst, Event{Type: DESTINATION_DOWN, Time: when, VIP: i.Service.Address, Instance: i, Diagnostic: "Removed"})
+		}
+	}
+
+	for t, up := range next.svc {
+		if up != prev.svc[t] {
+			e := Event{Type: SERVICE_DOWN, Time: when, VIP: t.Address, Instance: mon.Instance{Service: t}}
+			if up {
+				e.Type = SERVICE_UP
+			}
+			svc = append(svc, e)
+		}
+	}
+
+	for t, up := range prev.svc {
+		if _, ok := next.svc[t]; up && !ok {
+			svc = append(svc, Event{Type: SERVICE_DOWN, Time: when, VIP: t.Address, Instance: mon.Instance{Service: t}})
+		}
+	}
+
+	for a, up := range next.vip {
+		if up != prev.vip[a] {
+			e := Event{Type: VIP_UNHEALTHY, Time: when, VIP: a, Diagnostic: next.why[a]}
+			if up {
+				e.Type = VIP_HEALTHY
+			}
+			vip = append(vip, e)
+		}
+	}
+
+	for a, up := range prev.vip {
+		if _, ok := next.vip[a]; up && !ok {
+			vip = append(vip, Event{Type: VIP_UNHEALTHY, Time: when, VIP: a})
+		}
+	}
+
+	sort.SliceStable(dst, func(i, j int) bool { return instanceLess(dst[i].Instance, dst[j].Instance) })
+	sort.SliceStable(svc, func(i, j int) bool { return instanceLess(svc[i].Instance, svc[j].Instance) })
+	sort.SliceStable(vip, func(i, j int) bool { return vip[i].VIP.Less(vip[j].VIP) })
+
+	events = append(events, dst...)
+	events = append(events, svc...)
+	events = append(events, vip...)
+
+	return
+}
+
+func instanceLess(a, b mon.Instance) bool {
+	x := Service{Address: a.Service.Address, Port: a.Service.Port, Protocol: a.Service.Protocol}
+	y := Service{Address: b.Service.Address, Port: b.Service.Port, Protocol: b.Service.Protocol}
+
+	if x.less(y) {
+		return true
+	}
+
+	if y.less(x) {
+		return false
+	}
+
+	if r := a.Destination.Address.Compare(b.Destination.Address); r != 0 {
+		return r < 0
+	}
+
+	return a.Destination.Port < b.Destination.Port
+}
@@ -37,7 +37,7 @@ func dnsudp(addr string, port uint16) (bool, string) {
 		return false, "Port is 0"
 	}
 
-	conn, err := dialer.Dial("udp", fmt.Sprintf("%s:%d", addr, port))
+	conn, err := dialer.Dial("udp", net.JoinHostPort(addr, fmt.Sprint(port)))
 
 	if err != nil {
 		return false, err.Error()
@@ -86,7 +86,13 @@ func dnsudp(addr string, port uint16) (bool, string) {
 		return false, "Read from server failed:" + err.Error()
 	}
 
-	if read < 2 {
+	return dnsUDPReply(tid, buff[:read])
+}
+
+// check that a UDP reply is for the query with transaction ID tid
+func dnsUDPReply(tid uint16, buff []byte) (bool, string) {
+
+	if len(buff) < 2 {
 		return false, "Malformed packet: Too short"
 	}
 
@@ -103,7 +109,7 @@ func dnstcp(addr string, port uint16) (bool, string) {
 		return false, "Port is 0"
 	}
 
-	conn, err := dialer.Dial("tcp", fmt.Sprintf("%s:%d", addr, port))
+	conn, err := dialer.Dial("tcp", net.JoinHostPort(addr, fmt.Sprint(port)))
 
 	if err != nil {
 		return false, err.Error()
@@ -141,13 +147,20 @@ func dnstcp(addr string, port uint16) (bool, string) {
 		return false, "Read from server failed:" + err.Error()
 	}
 
-	if read < 4 {
+	return dnsTCPReply(tid, buff[:read])
+}
+
+// check that a TCP reply (with 2 byte length prefix) is for the query
+// with transaction ID tid
+func dnsTCPReply(tid uint16, buff []byte) (bool, string) {
+
+	if len(buff) < 4 {
 		return false, "Malformed packet: Too short"
 	}
 
 	length := int(buff[0])<<8 + int(buff[1])
 
-	if length+2 != read {
+	if length+2 != len(buff) {
 		return false, "Malformed packet: Length mismatch"
 	}
 
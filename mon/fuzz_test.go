@@ -0,0 +1,71 @@
+/*
+ * VC5 load balancer. Copyright (C) 2021-present David Coles
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package mon
+
+import (
+	"testing"
+)
+
+func FuzzDNSUDPReply(f *testing.F) {
+	f.Add(uint16(0x1234), []byte{0x12, 0x34, 0x81, 0x80})
+	f.Add(uint16(0), []byte{0})
+
+	f.Fuzz(func(t *testing.T, tid uint16, b []byte) {
+		if ok, _ := dnsUDPReply(tid, b); ok && (len(b) < 2 || uint16(b[0])<<8|uint16(b[1]) != tid) {
+			t.Fatal("Accepted bad reply")
+		}
+	})
+}
+
+func FuzzDNSTCPReply(f *testing.F) {
+	f.Add(uint16(0x1234), []byte{0, 4, 0x12, 0x34, 0x81, 0x80})
+	f.Add(uint16(0), []byte{0, 0, 0})
+
+	f.Fuzz(func(t *testing.T, tid uint16, b []byte) {
+		if ok, _ := dnsTCPReply(tid, b); ok && (len(b) < 4 || int(b[0])<<8|int(b[1]) != len(b)-2) {
+			t.Fatal("Accepted bad reply")
+		}
+	})
+}
+
+func FuzzSYNACK(f *testing.F) {
+	syn := synrst([4]byte{10, 0, 0, 1}, [4]byte{10, 0, 0, 2}, 12345, 80, 1000, false)
+	ack := append([]byte{}, syn...)
+	ack[13] |= 16
+
+	f.Add(syn)
+	f.Add(ack)
+	f.Add([]byte{0})
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		remp, locp, acn, ok := synack(b)
+
+		if !ok {
+			return
+		}
+
+		if len(b) < 20 || b[13]&0x17 != 0x12 {
+			t.Fatal("Accepted segment which was not a SYN-ACK")
+		}
+
+		if remp != uint16(b[0])<<8|uint16(b[1]) || locp != uint16(b[2])<<8|uint16(b[3]) || acn>>24 != uint32(b[8]) {
+			t.Fatal("Bad header values")
+		}
+	})
+}
@@ -21,6 +21,7 @@ package mon
 import (
 	"context"
 	"crypto/tls"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -126,12 +127,34 @@ type Services map[Instance]Checks
 type Target struct {
 	Init   bool
 	Checks Checks
+	Status *Status // previous status to start from, eg. restored after a restart - Init is ignored if set
 }
 
 type state struct {
-	mutex  sync.Mutex
-	checks chan Checks
-	status status
+	mutex   sync.Mutex
+	probe   probeKey
+	history [5]bool
+	status  status
+}
+
+// instances with the same destination and checks share a single probe
+type probeKey struct {
+	service     Service // only set for a custom Prober, which is passed the Instance
+	destination Destination
+	checks      string // JSON, so that values containing spaces cannot collide
+}
+
+type probe struct {
+	mutex     sync.Mutex
+	checks    Checks
+	instances map[Instance]*state
+	done      chan bool
+}
+
+type result struct {
+	check string
+	ok    bool
+	s     string
 }
 
 type status = Status
@@ -144,6 +167,9 @@ type Status struct {
 	Initialised bool
 }
 
+// The built-in probes are shared between instances with the same
+// destination and checks. A Prober is passed the Instance being checked
+// and so its probes are not shared between services.
 type Prober interface {
 	Probe(*Mon, Instance, Check) (bool, string)
 }
@@ -162,6 +188,7 @@ type Mon struct {
 	IPv4                 netip.Addr // IP address to use as source for SYN probes (optional)
 
 	services map[Instance]*state
+	shared   map[probeKey]*probe
 	syn      *SYN
 }
 
@@ -243,20 +270,38 @@ func (m *Mon) Stop() {
 
 func (m *Mon) Update(checks map[Instance]Target) {
 
+	if m.services == nil {
+		m.services = make(map[Instance]*state)
+	}
+
+	if m.shared == nil {
+		m.shared = make(map[probeKey]*probe)
+	}
+
 	for instance, state := range m.services {
 		if new, ok := checks[instance]; ok {
-			state.checks <- new.Checks
+			if key := m.probeKey(instance, new.Checks); key != state.probe {
+				m.unsubscribe(instance, state)
+				m.subscribe(instance, state, key, new.Checks)
+			}
 			delete(checks, instance)
 		} else {
-			close(state.checks) // no longer exists
+			m.unsubscribe(instance, state) // no longer exists
 			delete(m.services, instance)
 		}
 	}
 
 	for instance, c := range checks {
 		state := &state{status: status{OK: c.Init, Diagnostic: "Initialising ...", When: time.Now()}}
-		state.checks = m.monitor(instance, state, c.Checks)
+		if c.Status != nil {
+			state.status = *c.Status
+		}
+		if state.status.OK {
+			state.history = [5]bool{true, true, true, true, true}
+		}
 		m.services[instance] = state
+		m.notify(instance, state.status.OK)
+		m.subscribe(instance, state, m.probeKey(instance, c.Checks), c.Checks)
 	}
 
 	select {
@@ -265,6 +310,65 @@ func (m *Mon) Update(checks map[Instance]Target) {
 	}
 }
 
+func (m *Mon) probeKey(instance Instance, checks Checks) probeKey {
+	var normalised Checks
+	for _, c := range checks {
+		if c.Port == 0 {
+			c.Port = instance.Destination.Port
+		}
+		normalised = append(normalised, c)
+	}
+
+	js, _ := json.Marshal(normalised)
+	key := probeKey{destination: instance.Destination, checks: string(js)}
+
+	if m.Prober != nil {
+		key.service = instance.Service
+	}
+
+	return key
+}
+
+func newProbe(checks Checks) *probe {
+	return &probe{checks: checks, instances: map[Instance]*state{}, done: make(chan bool)}
+}
+
+func (m *Mon) subscribe(instance Instance, state *state, key probeKey, checks Checks) {
+	state.mutex.Lock()
+	state.probe = key
+	state.mutex.Unlock()
+
+	p, ok := m.shared[key]
+
+	if !ok {
+		p = newProbe(checks)
+		m.shared[key] = p
+		m.monitor(p)
+	}
+
+	p.mutex.Lock()
+	p.instances[instance] = state
+	p.mutex.Unlock()
+}
+
+func (m *Mon) unsubscribe(instance Instance, state *state) {
+	p, ok := m.shared[state.probe]
+
+	if !ok {
+		return
+	}
+
+	p.mutex.Lock()
+	delete(p.instances, instance)
+	last := len(p.instances) == 0
+	p.mutex.Unlock()
+
+	if last {
+		close(p.done) // no instances are using the probe any more
+		delete(m.shared, state.probe)
+	}
+}
+
 func (m *Mon) notify(instance Instance, state bool) {
 	if n := m.Notifier; n != nil {
 		n.Notify(instance, state)
@@ -283,20 +387,10 @@ func (m *Mon) check(instance Instance, check string, round uint64, state bool, r
 	}
 }
 
-func (m *Mon) monitor(instance Instance, state *state, c Checks) chan Checks {
-
-	C := make(chan Checks, 10)
-
-	m.notify(instance, state.status.OK)
+func (m *Mon) monitor(p *probe) {
 
 	go func() {
 
-		var history [5]bool
-
-		if state.status.OK {
-			history = [5]bool{true, true, true, true, true}
-		}
-
 		ticker := time.NewTicker(2 * time.Second)
 		defer ticker.Stop()
 
@@ -305,76 +399,99 @@ func (m *Mon) monitor(instance Instance, state *state, c Checks) chan Checks {
 		for {
 			round++
 
-			var ok bool
 			select {
-			case c, ok = <-C:
-				if !ok {
-					return
-				}
-				continue // go back and wait for ticker
+			case <-p.done:
+				return
 			case <-ticker.C:
 			}
 
-			state.mutex.Lock()
-			was := state.status
-			state.mutex.Unlock()
+			p.mutex.Lock()
+			instances := make(map[Instance]*state, len(p.instances))
+			var instance Instance
+			for k, v := range p.instances {
+				instances[k] = v
+				instance = k
+			}
+			p.mutex.Unlock()
 
-			now := was
+			if len(instances) == 0 {
+				continue
+			}
 
 			t := time.Now()
 
-			ok, now.Diagnostic = m.probes(instance, c, round)
-
-			m.result(instance, ok, now.Diagnostic)
+			ok, diagnostic, results := m.probes(instance, p.checks)
 
-			copy(history[0:], history[1:])
-			history[4] = ok
+			took := time.Now().Sub(t)
 
-			var passed int
-			for _, v := range history {
-				if v {
-					passed++
+			for instance, state := range instances {
+				for _, r := range results {
+					m.check(instance, r.check, round, r.ok, r.s)
 				}
-			}
 
-			if was.OK {
-				if passed < 4 {
-					now.OK = false
-				}
-			} else {
-				if passed > 4 {
-					now.OK = true
-				}
+				m.result(instance, ok, diagnostic)
+
+				m.update(instance, state, ok, diagnostic, t, took)
 			}
+		}
+	}()
+}
 
-			now.Last = t
-			now.Took = time.Now().Sub(t)
-			now.Initialised = true
+// record the outcome of a probe against an instance's history and
+// signal if its status has changed
+func (m *Mon) update(instance Instance, state *state, ok bool, diagnostic string, t time.Time, took time.Duration) {
 
-			var changed bool
-			if !was.Initialised || was.OK != now.OK {
-				if was.Initialised {
-					m.notify(instance, now.OK)
-				}
-				changed = true
-				now.When = t
-			}
+	state.mutex.Lock()
 
-			state.mutex.Lock()
-			state.status = now
-			state.mutex.Unlock()
+	was := state.status
+	now := was
 
-			if changed {
-				select {
-				case m.C <- true:
-				default:
-				}
-			}
+	history := &state.history
+
+	copy(history[0:], history[1:])
+	history[4] = ok
 
+	var passed int
+	for _, v := range history {
+		if v {
+			passed++
 		}
-	}()
+	}
 
-	return C
+	if was.OK {
+		if passed < 4 {
+			now.OK = false
+		}
+	} else {
+		if passed > 4 {
+			now.OK = true
+		}
+	}
+
+	now.Diagnostic = diagnostic
+	now.Last = t
+	now.Took = took
+	now.Initialised = true
+
+	var changed bool
+	if !was.Initialised || was.OK != now.OK {
+		changed = true
+		now.When = t
+	}
+
+	state.status = now
+	state.mutex.Unlock()
+
+	if changed && was.Initialised {
+		m.notify(instance, now.OK)
+	}
+
+	if changed {
+		select {
+		case m.C <- true:
+		default:
+		}
+	}
 }
 
 type Checks = []Check
@@ -478,7 +595,7 @@ func (m *method) UnmarshalJSON(data []byte) error {
 	return errors.New("Badly formed method: " + s)
 }
 
-func (m *Mon) probes(i Instance, checks Checks, round uint64) (ok bool, s string) {
+func (m *Mon) probes(i Instance, checks Checks) (ok bool, s string, results []result) {
 	for _, c := range checks {
 
 		if c.Port == 0 {
@@ -493,14 +610,14 @@ func (m *Mon) probes(i Instance, checks Checks, round uint64) (ok bool, s string
 			ok, s = m.Probe(i.Destination.Address, c)
 		}
 
-		m.check(i, c.String(), round, ok, s)
+		results = append(results, result{check: c.String(), ok: ok, s: s})
 
 		if !ok {
-			return ok, c.Type + ": " + s
+			return ok, c.Type + ": " + s, results
 		}
 	}
 
-	return true, "OK"
+	return true, "OK", results
 }
 
 func (m *Mon) Probe(addr netip.Addr, c Check) (ok bool, s string) {
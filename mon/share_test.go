@@ -0,0 +1,164 @@
+/*
+ * VC5 load balancer. Copyright (C) 2021-present David Coles
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package mon
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type counter struct {
+	mutex sync.Mutex
+	calls map[Instance]int
+}
+
+func (c *counter) Probe(_ *Mon, i Instance, _ Check) (bool, string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.calls[i]++
+	return true, "OK"
+}
+
+func (c *counter) count(i Instance) int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.calls[i]
+}
+
+// a web server which counts requests, and the destination to reach it
+func server(t *testing.T) (*int32, Destination) {
+	var n int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&n, 1)
+	}))
+	t.Cleanup(s.Close)
+	addr := netip.MustParseAddrPort(s.Listener.Addr().String())
+	return &n, Destination{Address: addr.Addr(), Port: addr.Port()}
+}
+
+func TestSharedProbes(t *testing.T) {
+	m := &Mon{}
+
+	if err := m.Init(nil); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+
+	requests, shared := server(t)
+	others, other := server(t)
+
+	vip1 := Service{Address: netip.MustParseAddr("192.168.101.1"), Port: 80, Protocol: 6}
+	vip2 := Service{Address: netip.MustParseAddr("192.168.101.2"), Port: 80, Protocol: 6}
+
+	http := Checks{{Type: "http", Path: "/alive"}}
+	explicit := Checks{{Type: "http", Port: shared.Port, Path: "/alive"}} // same as default port
+
+	m.Update(map[Instance]Target{
+		{Service: vip1, Destination: shared}: {Checks: http},
+		{Service: vip2, Destination: shared}: {Checks: explicit},
+		{Service: vip1, Destination: other}:  {Checks: http},
+	})
+
+	if n := len(m.shared); n != 2 {
+		t.Fatalf("expected 2 probes, got %d", n)
+	}
+
+	time.Sleep(2500 * time.Millisecond)
+
+	if n := atomic.LoadInt32(requests); n != 1 {
+		t.Error("shared destination probed", n, "times in one round")
+	}
+
+	if n := atomic.LoadInt32(others); n != 1 {
+		t.Error("other destination probed", n, "times in one round")
+	}
+
+	for _, i := range []Instance{{vip1, shared}, {vip2, shared}, {vip1, other}} {
+		if s, ok := m.Status(i.Service, i.Destination); !ok || !s.Initialised || s.Diagnostic != "OK" {
+			t.Error("instance not updated by probe:", i, s)
+		}
+	}
+
+	// a change of checks moves the instance to its own probe, and
+	// removing the last instance stops the probe
+	m.Update(map[Instance]Target{
+		{Service: vip1, Destination: shared}: {Checks: http},
+		{Service: vip2, Destination: shared}: {Checks: Checks{{Type: "syn"}}},
+	})
+
+	if n := len(m.shared); n != 2 {
+		t.Fatalf("expected 2 probes, got %d", n)
+	}
+
+	m.Update(nil)
+
+	if n := len(m.shared); n != 0 {
+		t.Error("probes not stopped:", n)
+	}
+}
+
+// a custom Prober is called for each instance
+func TestProberNotShared(t *testing.T) {
+	c := &counter{calls: map[Instance]int{}}
+	m := &Mon{Prober: c}
+
+	if err := m.Init(nil); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+
+	vip1 := Service{Address: netip.MustParseAddr("192.168.101.1"), Port: 80, Protocol: 6}
+	vip2 := Service{Address: netip.MustParseAddr("192.168.101.2"), Port: 80, Protocol: 6}
+	dest := Destination{Address: netip.MustParseAddr("10.1.2.3"), Port: 80}
+	http := Checks{{Type: "http", Path: "/alive"}}
+
+	m.Update(map[Instance]Target{
+		{Service: vip1, Destination: dest}: {Checks: http},
+		{Service: vip2, Destination: dest}: {Checks: http},
+	})
+
+	if n := len(m.shared); n != 2 {
+		t.Fatalf("expected 2 probes, got %d", n)
+	}
+
+	time.Sleep(2500 * time.Millisecond)
+
+	for _, i := range []Instance{{vip1, dest}, {vip2, dest}} {
+		if n := c.count(i); n != 1 {
+			t.Error(i, "probed", n, "times in one round")
+		}
+	}
+}
+
+func TestProbeKey(t *testing.T) {
+	m := &Mon{}
+	i := Instance{Destination: Destination{Address: netip.MustParseAddr("10.1.2.3"), Port: 80}}
+
+	a := m.probeKey(i, Checks{{Type: "http", Host: "a b", Path: "/"}})
+	b := m.probeKey(i, Checks{{Type: "http", Host: "a", Path: "b /"}})
+
+	if a == b {
+		t.Error("checks with different hosts and paths share a probe:", a.checks)
+	}
+}
@@ -136,21 +136,13 @@ func (s *SYN) background(reset bool) {
 
 		n, peer, err := s.con.ReadFrom(buf[:])
 
-		if err != nil || n < 20 {
+		if err != nil {
 			continue
 		}
 
-		flg := buf[13]
-		//cwr := (flg & 128) != 0
-		//ece := (flg & 64) != 0
-		//urg := (flg & 32) != 0
-		ack := (flg & 16) != 0
-		//psh := (flg & 8) != 0
-		rst := (flg & 4) != 0
-		syn := (flg & 2) != 0
-		fin := (flg & 1) != 0
-
-		if !syn || !ack || fin || rst {
+		remp, locp, acn, ok := synack(buf[:n])
+
+		if !ok {
 			continue
 		}
 
@@ -162,10 +154,6 @@ func (s *SYN) background(reset bool) {
 
 		rem := [4]byte{addr[0], addr[1], addr[2], addr[3]}
 
-		remp := uint16(buf[0])<<8 | uint16(buf[1])
-		locp := uint16(buf[2])<<8 | uint16(buf[3])
-		acn := uint32(buf[8])<<24 | uint32(buf[9])<<16 | uint32(buf[10])<<8 | uint32(buf[11])
-
 		v, ok := s.syn.LoadAndDelete(synkey{seq: acn, rem: rem, locp: locp, remp: remp})
 
 		if !ok {
@@ -195,6 +183,35 @@ func (s *SYN) background(reset bool) {
 	}
 }
 
+// If the TCP segment is a SYN-ACK then return the (remote) source port,
+// (local) destination port and acknowledgement number
+func synack(buf []byte) (remp, locp uint16, acn uint32, ok bool) {
+
+	if len(buf) < 20 {
+		return
+	}
+
+	flg := buf[13]
+	//cwr := (flg & 128) != 0
+	//ece := (flg & 64) != 0
+	//urg := (flg & 32) != 0
+	ack := (flg & 16) != 0
+	//psh := (flg & 8) != 0
+	rst := (flg & 4) != 0
+	syn := (flg & 2) != 0
+	fin := (flg & 1) != 0
+
+	if !syn || !ack || fin || rst {
+		return
+	}
+
+	remp = uint16(buf[0])<<8 | uint16(buf[1])
+	locp = uint16(buf[2])<<8 | uint16(buf[3])
+	acn = uint32(buf[8])<<24 | uint32(buf[9])<<16 | uint32(buf[10])<<8 | uint32(buf[11])
+
+	return remp, locp, acn, true
+}
+
 func synrst(src, dst [4]byte, srcPort, dstPort uint16, seq uint32, reset bool) []byte {
 
 	var sum uint32
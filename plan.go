@@ -0,0 +1,241 @@
+/*
+ * VC5 load balancer. Copyright (C) 2021-present David Coles
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package cue
+
+import (
+	"net/netip"
+	"reflect"
+	"sort"
+)
+
+// The changes which Configure would make to the running configuration.
+type Plan struct {
+	AddVIPs    []netip.Addr `json:"add_vips,omitempty"`
+	RemoveVIPs []netip.Addr `json:"remove_vips,omitempty"`
+
+	AddServices    []Change `json:"add_services,omitempty"`
+	RemoveServices []Change `json:"remove_services,omitempty"`
+	ChangeServices []Change `json:"change_services,omitempty"` // Fields lists the settings which differ
+
+	AddDestinations    []Change `json:"add_destinations,omitempty"` // InitiallyUp is the state that health checks will start in
+	RemoveDestinations []Change `json:"remove_destinations,omitempty"`
+	ChangeDestinations []Change `json:"change_destinations,omitempty"` // Fields lists the settings which differ, eg. "checks"
+}
+
+// A service, or a destination of the service if Destination is valid.
+type Change struct {
+	Address     netip.Addr     `json:"address"`
+	Port        uint16         `json:"port"`
+	Protocol    protocol       `json:"protocol"`
+	Destination netip.AddrPort `json:"destination,omitempty"`
+	InitiallyUp bool           `json:"initially_up,omitempty"`
+	Fields      []string       `json:"fields,omitempty"`
+}
+
+// Returns true if applying the configuration would change nothing.
+func (p *Plan) Empty() bool {
+	return reflect.DeepEqual(*p, Plan{})
+}
+
+// Compare a proposed configuration with the running one, without
+// applying anything. Invalid configurations return the error from
+// Validate.
+func (d *Director) Plan(config []Service) (*Plan, error) {
+
+	if err := Validate(config); err != nil {
+		return nil, err
+	}
+
+	d.mutex.Lock()
+	prev := d.cfg
+	d.mutex.Unlock()
+
+	next := map[tuple]Service{}
+
+	for _, s := range config {
+		next[tuple{Address: s.Address, Port: s.Port, Protocol: s.Protocol}] = s
+	}
+
+	return plan(prev, next), nil
+}
+
+func plan(prev, next map[tuple]Service) *Plan {
+	var p Plan
+
+	starting := initial(prev)
+
+	vips := func(m map[tuple]Service) map[netip.Addr]bool {
+		r := map[netip.Addr]bool{}
+		for t, _ := range m {
+			r[t.Address] = true
+		}
+		return r
+	}
+
+	old, new := vips(prev), vips(next)
+
+	for a, _ := range new {
+		if !old[a] {
+			p.AddVIPs = append(p.AddVIPs, a)
+		}
+	}
+
+	for a, _ := range old {
+		if !new[a] {
+			p.RemoveVIPs = append(p.RemoveVIPs, a)
+		}
+	}
+
+	change := func(t tuple) Change {
+		return Change{Address: t.Address, Port: t.Port, Protocol: protocol(t.Protocol)}
+	}
+
+	destination := func(t tuple, d Destination) Change {
+		c := change(t)
+		c.Destination = netip.AddrPortFrom(d.Address, d.Port)
+		return c
+	}
+
+	for t, s := range next {
+		o, ok := prev[t]
+
+		if !ok {
+			p.AddServices = append(p.AddServices, change(t))
+			init := starting(t)
+
+			for _, d := range s.Destinations {
+				c := destination(t, d)
+				c.InitiallyUp = init
+				p.AddDestinations = append(p.AddDestinations, c)
+			}
+
+			continue
+		}
+
+		if f := serviceChanges(o, s); len(f) > 0 {
+			c := change(t)
+			c.Fields = f
+			p.ChangeServices = append(p.ChangeServices, c)
+		}
+
+		dests := map[netip.AddrPort]Destination{}
+
+		for _, d := range o.Destinations {
+			dests[netip.AddrPortFrom(d.Address, d.Port)] = d
+		}
+
+		for _, d := range s.Destinations {
+			x, ok := dests[netip.AddrPortFrom(d.Address, d.Port)]
+
+			if !ok {
+				c := destination(t, d) // new destination on an existing service starts down
+				p.AddDestinations = append(p.AddDestinations, c)
+				continue
+			}
+
+			delete(dests, netip.AddrPortFrom(d.Address, d.Port))
+
+			if f := destinationChanges(x, d); len(f) > 0 {
+				c := destination(t, d)
+				c.Fields = f
+				p.ChangeDestinations = append(p.ChangeDestinations, c)
+			}
+		}
+
+		for _, d := range dests {
+			p.RemoveDestinations = append(p.RemoveDestinations, destination(t, d))
+		}
+	}
+
+	for t, s := range prev {
+		if _, ok := next[t]; !ok {
+			p.RemoveServices = append(p.RemoveServices, change(t))
+
+			for _, d := range s.Destinations {
+				p.RemoveDestinations = append(p.RemoveDestinations, destination(t, d))
+			}
+		}
+	}
+
+	addrs := func(a []netip.Addr) {
+		sort.Slice(a, func(i, j int) bool { return a[i].Less(a[j]) })
+	}
+
+	changes := func(c []Change) {
+		sort.Slice(c, func(i, j int) bool { return c[i].less(c[j]) })
+	}
+
+	addrs(p.AddVIPs)
+	addrs(p.RemoveVIPs)
+	changes(p.AddServices)
+	changes(p.RemoveServices)
+	changes(p.ChangeServices)
+	changes(p.AddDestinations)
+	changes(p.RemoveDestinations)
+	changes(p.ChangeDestinations)
+
+	return &p
+}
+
+func (c Change) less(d Change) bool {
+	x := Service{Address: c.Address, Port: c.Port, Protocol: uint8(c.Protocol)}
+	y := Service{Address: d.Address, Port: d.Port, Protocol: uint8(d.Protocol)}
+
+	if x.less(y) {
+		return true
+	}
+
+	if y.less(x) {
+		return false
+	}
+
+	return c.Destination.Addr().Less(d.Destination.Addr()) ||
+		(c.Destination.Addr() == d.Destination.Addr() && c.Destination.Port() < d.Destination.Port())
+}
+
+func serviceChanges(a, b Service) (r []string) {
+	f := func(changed bool, name string) {
+		if changed {
+			r = append(r, name)
+		}
+	}
+
+	f(a.Scheduler != b.Scheduler, "scheduler")
+	f(a.Persist != b.Persist, "persist")
+	f(a.Sticky != b.Sticky, "sticky")
+	f(a.Reset != b.Reset, "reset")
+	f(a.Required != b.Required, "required")
+	f(a.NonCritical != b.NonCritical, "non_critical")
+
+	return
+}
+
+func destinationChanges(a, b Destination) (r []string) {
+	f := func(changed bool, name string) {
+		if changed {
+			r = append(r, name)
+		}
+	}
+
+	f(a.Disabled != b.Disabled, "disabled")
+	f(a.Weight != b.Weight, "weight")
+	f(!reflect.DeepEqual(a.Checks, b.Checks), "checks")
+
+	return
+}
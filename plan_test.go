@@ -0,0 +1,105 @@
+/*
+ * VC5 load balancer. Copyright (C) 2021-present David Coles
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package cue
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestPlan(t *testing.T) {
+	web := service("192.168.0.1", 80, "10.0.0.1", "10.0.0.2")
+	dns := service("192.168.0.2", 53, "10.0.0.3")
+
+	d := &Director{Prober: prober(false)}
+
+	if err := d.Start([]Service{web, dns}); err != nil {
+		t.Fatal(err)
+	}
+
+	defer d.Stop()
+
+	if p, err := d.Plan([]Service{web, dns}); err != nil || !p.Empty() {
+		t.Error("Unexpected plan:", p, err)
+	}
+
+	if _, err := d.Plan([]Service{service("192.168.0.1", 0)}); err == nil {
+		t.Error("Invalid configuration accepted")
+	}
+
+	web2 := service("192.168.0.1", 80, "10.0.0.2", "10.0.0.4")
+	web2.Scheduler = "wrr"
+	web2.Destinations[0].Checks = []Check{{Type: "syn"}}
+
+	https := service("192.168.0.1", 443, "10.0.0.1")
+	mail := service("192.168.0.3", 25, "10.0.0.5")
+
+	p, err := d.Plan([]Service{web2, https, mail})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vip := func(a []netip.Addr, s string) bool {
+		return len(a) == 1 && a[0] == netip.MustParseAddr(s)
+	}
+
+	if !vip(p.AddVIPs, "192.168.0.3") || !vip(p.RemoveVIPs, "192.168.0.2") {
+		t.Error("Unexpected VIPs:", p.AddVIPs, p.RemoveVIPs)
+	}
+
+	if len(p.AddServices) != 2 || p.AddServices[0].Port != 443 || p.AddServices[1].Port != 25 {
+		t.Error("Unexpected added services:", p.AddServices)
+	}
+
+	if len(p.RemoveServices) != 1 || p.RemoveServices[0].Port != 53 {
+		t.Error("Unexpected removed services:", p.RemoveServices)
+	}
+
+	if len(p.ChangeServices) != 1 || p.ChangeServices[0].Fields[0] != "scheduler" {
+		t.Error("Unexpected changed services:", p.ChangeServices)
+	}
+
+	// a new service on an existing VIP starts up, new destinations on
+	// an existing service and destinations on a new VIP start down
+	want := map[string]bool{"10.0.0.4:80": false, "10.0.0.1:443": true, "10.0.0.5:25": false}
+
+	if len(p.AddDestinations) != len(want) {
+		t.Error("Unexpected added destinations:", p.AddDestinations)
+	}
+
+	for _, c := range p.AddDestinations {
+		if up, ok := want[c.Destination.String()]; !ok || up != c.InitiallyUp {
+			t.Error("Unexpected added destination:", c)
+		}
+	}
+
+	if len(p.RemoveDestinations) != 2 || p.RemoveDestinations[0].Destination.String() != "10.0.0.1:80" || p.RemoveDestinations[1].Destination.String() != "10.0.0.3:53" {
+		t.Error("Unexpected removed destinations:", p.RemoveDestinations)
+	}
+
+	if c := p.ChangeDestinations; len(c) != 1 || c[0].Destination.String() != "10.0.0.2:80" || c[0].Fields[0] != "checks" {
+		t.Error("Unexpected changed destinations:", c)
+	}
+
+	// nothing was applied
+	if s := d.Status(); len(s) != 2 || s[0].Scheduler != "" {
+		t.Error("Unexpected status:", s)
+	}
+}
@@ -0,0 +1,134 @@
+/*
+ * VC5 load balancer. Copyright (C) 2021-present David Coles
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package cue
+
+import (
+	"encoding/json"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/davidcoles/cue/mon"
+)
+
+const defaultStateMaxAge = time.Minute
+
+// The health state of a destination, as saved to Director.StateFile.
+type savedState struct {
+	Address     netip.Addr     `json:"address"`
+	Port        uint16         `json:"port"`
+	Protocol    protocol       `json:"protocol"`
+	Destination netip.AddrPort `json:"destination"`
+	Status      mon.Status     `json:"status"`
+}
+
+// Read the state file, returning the status of each instance which was
+// probed recently enough to be trusted. A missing or corrupt file is
+// ignored - destinations just start in the usual initial state.
+func (d *Director) restore(now time.Time) map[mon.Instance]mon.Status {
+
+	if d.StateFile == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(d.StateFile)
+
+	if err != nil {
+		return nil
+	}
+
+	var saved []savedState
+
+	if json.Unmarshal(data, &saved) != nil {
+		return nil
+	}
+
+	age := d.stateMaxAge()
+
+	r := map[mon.Instance]mon.Status{}
+
+	for _, s := range saved {
+		if !s.Status.Initialised || now.Sub(s.Status.Last) > age {
+			continue
+		}
+
+		i := mon.Instance{
+			Service:     tuple{Address: s.Address, Port: s.Port, Protocol: uint8(s.Protocol)},
+			Destination: mon.Destination{Address: s.Destination.Addr(), Port: s.Destination.Port()},
+		}
+
+		r[i] = s.Status
+	}
+
+	return r
+}
+
+func (d *Director) stateMaxAge() time.Duration {
+	if d.StateMaxAge == 0 {
+		return defaultStateMaxAge
+	}
+	return d.StateMaxAge
+}
+
+// Write the status of each destination which has been probed to the
+// state file. Must be called with the mutex held.
+func (d *Director) save() error {
+
+	if d.StateFile == "" || d.stopped {
+		return nil
+	}
+
+	saved := []savedState{}
+
+	for _, s := range d.status() {
+		for _, x := range s.Destinations {
+			if x.Status.Initialised {
+				saved = append(saved, savedState{Address: s.Address, Port: s.Port, Protocol: protocol(s.Protocol),
+					Destination: netip.AddrPortFrom(x.Address, x.Port), Status: x.Status})
+			}
+		}
+	}
+
+	data, err := json.MarshalIndent(saved, "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	// write to a temporary file and rename so that a crash never leaves a partial file
+	tmp, err := os.CreateTemp(filepath.Dir(d.StateFile), filepath.Base(d.StateFile)+".*")
+
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), d.StateFile)
+}
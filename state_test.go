@@ -0,0 +1,157 @@
+/*
+ * VC5 load balancer. Copyright (C) 2021-present David Coles
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package cue
+
+import (
+	"encoding/json"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/davidcoles/cue/mon"
+)
+
+func TestRestoreState(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "state.json")
+
+	now := time.Now()
+	web := service("192.168.0.1", 80, "10.0.0.1", "10.0.0.2")
+
+	saved := []savedState{
+		{Address: web.Address, Port: 80, Protocol: TCP, Destination: netip.MustParseAddrPort("10.0.0.1:80"),
+			Status: mon.Status{OK: true, Diagnostic: "OK", Last: now, When: now.Add(-time.Hour), Initialised: true}},
+		{Address: web.Address, Port: 80, Protocol: TCP, Destination: netip.MustParseAddrPort("10.0.0.2:80"),
+			Status: mon.Status{OK: true, Diagnostic: "OK", Last: now.Add(-time.Hour), When: now.Add(-time.Hour), Initialised: true}},
+	}
+
+	data, _ := json.Marshal(saved)
+
+	if err := os.WriteFile(file, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	d := &Director{Prober: prober(false), StateFile: file}
+
+	if err := d.Start([]Service{web}); err != nil {
+		t.Fatal(err)
+	}
+
+	s := d.Status()
+
+	// the stale state for 10.0.0.2 is ignored
+	if len(s) != 1 || !s[0].Up || !s[0].Destinations[0].Status.OK || s[0].Destinations[1].Status.OK {
+		t.Fatal("State not restored:", s)
+	}
+
+	if !s[0].Destinations[0].Status.When.Equal(saved[0].Status.When) {
+		t.Error("Unexpected status:", s[0].Destinations[0].Status)
+	}
+
+	d.Stop()
+
+	data, err := os.ReadFile(file)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	saved = nil
+
+	if err := json.Unmarshal(data, &saved); err != nil {
+		t.Fatal(err)
+	}
+
+	// 10.0.0.2 has not been probed yet so is not saved
+	if len(saved) != 1 || saved[0].Destination.String() != "10.0.0.1:80" || !saved[0].Status.OK {
+		t.Error("Unexpected saved state:", saved)
+	}
+}
+
+// the saved state is used by the first non-empty configuration, as when
+// a Loader configures a Director started without services
+func TestRestoreStateLater(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "state.json")
+
+	now := time.Now()
+	web := service("192.168.0.1", 80, "10.0.0.1")
+
+	data, _ := json.Marshal([]savedState{{Address: web.Address, Port: 80, Protocol: TCP, Destination: netip.MustParseAddrPort("10.0.0.1:80"),
+		Status: mon.Status{OK: true, Diagnostic: "OK", Last: now, When: now.Add(-time.Hour), Initialised: true}}})
+
+	if err := os.WriteFile(file, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	d := &Director{Prober: prober(true), StateFile: file}
+
+	if err := d.Start(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	defer d.Stop()
+
+	if err := d.Configure([]Service{web}); err != nil {
+		t.Fatal(err)
+	}
+
+	if s := d.Status(); len(s) != 1 || !s[0].Up || !s[0].Destinations[0].Status.OK {
+		t.Fatal("State not restored:", s)
+	}
+
+	// only used once
+	d.Configure(nil)
+
+	if err := d.Configure([]Service{web}); err != nil {
+		t.Fatal(err)
+	}
+
+	if s := d.Status(); len(s) != 1 || s[0].Destinations[0].Status.OK {
+		t.Error("State restored twice:", s)
+	}
+
+}
+
+// the file is rewritten every StateMaxAge/2, even when nothing changes
+func TestStateRefresh(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "state.json")
+
+	d := &Director{Prober: prober(true), StateFile: file, StateMaxAge: 200 * time.Millisecond}
+
+	if err := d.Start([]Service{service("192.168.0.1", 80, "10.0.0.1")}); err != nil {
+		t.Fatal(err)
+	}
+
+	defer d.Stop()
+
+	time.Sleep(50 * time.Millisecond)
+
+	d.mutex.Lock()
+	old := time.Now().Add(-time.Hour)
+	d.save()
+	os.Chtimes(file, old, old)
+	d.mutex.Unlock()
+
+	time.Sleep(300 * time.Millisecond)
+
+	if s, err := os.Stat(file); err != nil || !s.ModTime().After(old) {
+		t.Error("State file not refreshed:", s, err)
+	}
+}
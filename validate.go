@@ -0,0 +1,155 @@
+/*
+ * VC5 load balancer. Copyright (C) 2021-present David Coles
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package cue
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// Scheduler names which Validate accepts - the IPVS schedulers, plus
+// the empty string for the balancer's default. Balancers which support
+// a different set may replace this.
+var Schedulers = map[string]bool{
+	"": true, "rr": true, "wrr": true, "lc": true, "wlc": true, "lblc": true, "lblcr": true,
+	"dh": true, "sh": true, "sed": true, "nq": true, "mh": true, "fo": true, "ovf": true,
+}
+
+// A problem with a configuration, and where it was found, eg.:
+// services[1] 192.168.0.1:80/TCP destinations[0] 10.0.0.1:80 checks[0]
+type Problem struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+func (p Problem) String() string {
+	return p.Path + ": " + p.Message
+}
+
+// Returned by Validate, listing every problem found.
+type ValidationError struct {
+	Problems []Problem `json:"problems"`
+}
+
+func (e *ValidationError) Error() string {
+	var s []string
+	for _, p := range e.Problems {
+		s = append(s, p.String())
+	}
+	return fmt.Sprintf("%d configuration error(s): %s", len(e.Problems), strings.Join(s, "; "))
+}
+
+func (e *ValidationError) add(path, format string, a ...any) {
+	e.Problems = append(e.Problems, Problem{Path: path, Message: fmt.Sprintf(format, a...)})
+}
+
+// Check a set of services for problems. If any are found then a
+// *ValidationError is returned.
+func Validate(services []Service) error {
+	var e ValidationError
+
+	seen := map[tuple]bool{}
+
+	for i, s := range services {
+		path := fmt.Sprintf("services[%d] %s", i, serviceName(s))
+
+		if !s.Address.IsValid() {
+			e.add(path, "Service address is not valid")
+		}
+
+		if s.Port == 0 {
+			e.add(path, "Service port cannot be 0")
+		}
+
+		if s.Protocol != TCP && s.Protocol != UDP {
+			e.add(path, "Only TCP and UDP protocols supported")
+		}
+
+		if !Schedulers[s.Scheduler] {
+			e.add(path, "Unknown scheduler %q", s.Scheduler)
+		}
+
+		if int(s.Required) > len(s.Destinations) {
+			e.add(path, "Required (%d) is greater than the number of destinations (%d)", s.Required, len(s.Destinations))
+		}
+
+		t := tuple{Address: s.Address, Port: s.Port, Protocol: s.Protocol}
+
+		if seen[t] {
+			e.add(path, "Duplicate service")
+		}
+
+		seen[t] = true
+
+		dests := map[netip.AddrPort]bool{}
+
+		for j, d := range s.Destinations {
+			path := fmt.Sprintf("%s destinations[%d] %s", path, j, netip.AddrPortFrom(d.Address, d.Port))
+
+			if !d.Address.IsValid() {
+				e.add(path, "Destination address is not valid")
+			}
+
+			if d.Port == 0 {
+				e.add(path, "Destination port cannot be 0")
+			}
+
+			if ap := netip.AddrPortFrom(d.Address, d.Port); dests[ap] {
+				e.add(path, "Duplicate destination")
+			} else {
+				dests[ap] = true
+			}
+
+			for k, c := range d.Checks {
+				validateCheck(&e, fmt.Sprintf("%s checks[%d]", path, k), c)
+			}
+		}
+	}
+
+	if len(e.Problems) > 0 {
+		return &e
+	}
+
+	return nil
+}
+
+func validateCheck(e *ValidationError, path string, c Check) {
+	switch c.Type {
+	case "http", "https":
+		for _, code := range c.Expect {
+			if code < 100 || code > 599 {
+				e.add(path, "Invalid HTTP status code %d", code)
+			}
+		}
+		return
+	case "syn", "dns":
+	default:
+		e.add(path, "Unknown check type %q", c.Type)
+		return
+	}
+
+	if len(c.Expect) > 0 {
+		e.add(path, "Expected status codes are only used by HTTP/HTTPS checks")
+	}
+}
+
+func serviceName(s Service) string {
+	return fmt.Sprintf("%s/%s", netip.AddrPortFrom(s.Address, s.Port), protocol(s.Protocol))
+}
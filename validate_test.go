@@ -0,0 +1,85 @@
+/*
+ * VC5 load balancer. Copyright (C) 2021-present David Coles
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package cue
+
+import (
+	"errors"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	good := service("192.168.0.1", 80, "10.0.0.1", "10.0.0.2")
+	good.Scheduler = "wrr"
+	good.Destinations[0].Checks = []Check{{Type: "http", Path: "/", Expect: []int{200, 204}}, {Type: "syn"}}
+
+	if err := Validate([]Service{good}); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+
+	bad := service("192.168.0.1", 80, "10.0.0.1", "10.0.0.1")
+	bad.Required = 3
+	bad.Scheduler = "random"
+	bad.Protocol = 1
+	bad.Destinations[0].Checks = []Check{{Type: "ping"}, {Type: "https", Expect: []int{99}}, {Type: "dns", Expect: []int{200}}}
+
+	zero := Service{Address: netip.MustParseAddr("192.168.0.2"), Protocol: UDP, Destinations: []Destination{{Address: netip.MustParseAddr("10.0.0.1")}}}
+
+	err := Validate([]Service{good, bad, good, zero})
+
+	var v *ValidationError
+
+	if !errors.As(err, &v) {
+		t.Fatal("Unexpected error:", err)
+	}
+
+	want := []Problem{
+		{"services[1] 192.168.0.1:80/Unknown", "Only TCP and UDP protocols supported"},
+		{"services[1] 192.168.0.1:80/Unknown", `Unknown scheduler "random"`},
+		{"services[1] 192.168.0.1:80/Unknown", "Required (3) is greater than the number of destinations (2)"},
+		{"services[1] 192.168.0.1:80/Unknown destinations[0] 10.0.0.1:80 checks[0]", `Unknown check type "ping"`},
+		{"services[1] 192.168.0.1:80/Unknown destinations[0] 10.0.0.1:80 checks[1]", "Invalid HTTP status code 99"},
+		{"services[1] 192.168.0.1:80/Unknown destinations[0] 10.0.0.1:80 checks[2]", "Expected status codes are only used by HTTP/HTTPS checks"},
+		{"services[1] 192.168.0.1:80/Unknown destinations[1] 10.0.0.1:80", "Duplicate destination"},
+		{"services[2] 192.168.0.1:80/TCP", "Duplicate service"},
+		{"services[3] 192.168.0.2:0/UDP", "Service port cannot be 0"},
+		{"services[3] 192.168.0.2:0/UDP destinations[0] 10.0.0.1:0", "Destination port cannot be 0"},
+	}
+
+	if len(v.Problems) != len(want) {
+		t.Fatal("Unexpected problems:", v.Problems)
+	}
+
+	for i, p := range v.Problems {
+		if p != want[i] {
+			t.Errorf("Problem %d: got %q, expected %q", i, p, want[i])
+		}
+	}
+
+	if !strings.HasPrefix(err.Error(), "10 configuration error(s): services[1]") {
+		t.Error("Unexpected message:", err)
+	}
+
+	d := &Director{Prober: prober(false)}
+
+	if err := d.Start([]Service{zero}); !errors.As(err, &v) {
+		t.Error("Configuration not validated:", err)
+	}
+}
@@ -0,0 +1,217 @@
+/*
+ * VC5 load balancer. Copyright (C) 2021-present David Coles
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package cue
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"sort"
+	"strings"
+)
+
+// The number of critical services on a VIP which must be up for the
+// VIP to be healthy: ALL (the default), ANY, or N of M for larger
+// values (more than the number of critical services is treated as ALL).
+// Encoded in JSON as "all", "any" or a number.
+type Threshold uint8
+
+const (
+	ALL Threshold = 0
+	ANY Threshold = 1
+)
+
+func (t Threshold) MarshalJSON() ([]byte, error) {
+	switch t {
+	case ALL:
+		return []byte(`"all"`), nil
+	case ANY:
+		return []byte(`"any"`), nil
+	}
+	return json.Marshal(uint8(t))
+}
+
+func (t *Threshold) UnmarshalJSON(data []byte) error {
+	var s string
+
+	if json.Unmarshal(data, &s) == nil {
+		switch s {
+		case "all":
+			*t = ALL
+		case "any":
+			*t = ANY
+		default:
+			return errors.New("Threshold must be \"all\", \"any\" or a number: " + s)
+		}
+		return nil
+	}
+
+	var n uint8
+
+	if err := json.Unmarshal(data, &n); err != nil {
+		return errors.New("Threshold must be \"all\", \"any\" or a number: " + string(data))
+	}
+
+	*t = Threshold(n)
+
+	return nil
+}
+
+// The health of a VIP, with an explanation.
+type VIPStatus struct {
+	Address  netip.Addr `json:"address"`
+	Healthy  bool       `json:"healthy"`
+	Up       int        `json:"up"`       // number of critical services up
+	Critical int        `json:"critical"` // number of critical services
+	Required int        `json:"required"` // number of critical services which must be up
+	Reason   string     `json:"reason"`
+}
+
+// Set the threshold for each VIP - VIPs which are not in the map use
+// ALL.
+func (d *Director) Thresholds(t map[netip.Addr]Threshold) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.setThresholds(t)
+
+	if d.mon != nil {
+		d.services() // report changes to subscribers
+		d.inform()
+	}
+}
+
+// Must be called with the mutex held. Subscribers are not informed.
+func (d *Director) setThresholds(t map[netip.Addr]Threshold) {
+	d.thresholds = map[netip.Addr]Threshold{}
+
+	for k, v := range t {
+		d.thresholds[k] = v
+	}
+}
+
+func (d *Director) threshold() map[netip.Addr]Threshold {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	t := map[netip.Addr]Threshold{}
+
+	for k, v := range d.thresholds {
+		t[k] = v
+	}
+
+	return t
+}
+
+// The health of each VIP, according to the thresholds which have been
+// set and which services are critical.
+func (d *Director) VIPStatus() []VIPStatus {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return vipStatus(d.status(), d.thresholds)
+}
+
+func vipStatus(services []Service, thresholds map[netip.Addr]Threshold) (r []VIPStatus) {
+
+	vips := map[netip.Addr][]Service{}
+
+	for _, s := range services {
+		vips[s.Address] = append(vips[s.Address], s)
+	}
+
+	for vip, list := range vips {
+		r = append(r, vipHealth(vip, list, thresholds[vip]))
+	}
+
+	sort.Slice(r, func(i, j int) bool { return r[i].Address.Less(r[j].Address) })
+
+	return
+}
+
+// The number of critical services on each VIP.
+func criticalServices(services []Service) map[netip.Addr]int {
+	vips := map[netip.Addr][]Service{}
+
+	for _, s := range services {
+		vips[s.Address] = append(vips[s.Address], s)
+	}
+
+	r := map[netip.Addr]int{}
+
+	for vip, list := range vips {
+		r[vip] = vipHealth(vip, list, ALL).Critical
+	}
+
+	return r
+}
+
+// Non-critical services are ignored, unless all of the services on the
+// VIP are non-critical - in which case they are all treated as
+// critical.
+func vipHealth(vip netip.Addr, services []Service, threshold Threshold) (v VIPStatus) {
+
+	v.Address = vip
+
+	var critical bool
+
+	for _, s := range services {
+		if !s.NonCritical {
+			critical = true
+		}
+	}
+
+	var down []string
+
+	for _, s := range services {
+		name := fmt.Sprintf("%d/%s", s.Port, protocol(s.Protocol))
+
+		if critical && s.NonCritical {
+			if !s.Up {
+				down = append(down, name+" (non-critical)")
+			}
+			continue
+		}
+
+		v.Critical++
+
+		if s.Up {
+			v.Up++
+		} else {
+			down = append(down, name)
+		}
+	}
+
+	v.Required = v.Critical
+
+	// a threshold larger than the number of critical services is treated as ALL
+	if threshold != ALL && int(threshold) < v.Critical {
+		v.Required = int(threshold)
+	}
+
+	v.Healthy = v.Critical > 0 && v.Up >= v.Required
+	v.Reason = fmt.Sprintf("%d of %d critical services up, %d required", v.Up, v.Critical, v.Required)
+
+	if len(down) > 0 {
+		sort.Strings(down)
+		v.Reason += "; down: " + strings.Join(down, ", ")
+	}
+
+	return
+}
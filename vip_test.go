@@ -0,0 +1,106 @@
+/*
+ * VC5 load balancer. Copyright (C) 2021-present David Coles
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package cue
+
+import (
+	"encoding/json"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestVIPStatus(t *testing.T) {
+	vip1 := netip.MustParseAddr("192.168.0.1")
+	vip2 := netip.MustParseAddr("192.168.0.2")
+
+	services := []Service{
+		{Address: vip1, Port: 80, Protocol: TCP, Up: true},
+		{Address: vip1, Port: 443, Protocol: TCP, Up: true},
+		{Address: vip1, Port: 8443, Protocol: TCP, NonCritical: true},
+		{Address: vip2, Port: 53, Protocol: UDP, Up: true},
+		{Address: vip2, Port: 53, Protocol: TCP},
+		{Address: vip2, Port: 853, Protocol: TCP},
+	}
+
+	// a non-critical service being down does not affect the VIP
+	if r := HealthyVIPs(services); len(r) != 1 || r[0] != vip1 {
+		t.Error("Unexpected healthy VIPs:", r)
+	}
+
+	for _, x := range []struct {
+		threshold Threshold
+		healthy   bool
+		required  int
+	}{
+		{ALL, false, 3},
+		{ANY, true, 1},
+		{2, false, 2},
+		{5, false, 3},
+	} {
+		v := vipStatus(services, map[netip.Addr]Threshold{vip2: x.threshold})[1]
+
+		if v.Address != vip2 || v.Healthy != x.healthy || v.Up != 1 || v.Critical != 3 || v.Required != x.required {
+			t.Error("Unexpected status:", v)
+		}
+
+		if !strings.Contains(v.Reason, "down: 53/TCP, 853/TCP") {
+			t.Error("Unexpected reason:", v.Reason)
+		}
+	}
+
+	v := vipStatus(services, nil)[0]
+
+	if !v.Healthy || v.Critical != 2 || v.Reason != "2 of 2 critical services up, 2 required; down: 8443/TCP (non-critical)" {
+		t.Error("Unexpected status:", v)
+	}
+
+	// a threshold larger than the number of critical services requires all of them
+	v = vipStatus(services, map[netip.Addr]Threshold{vip1: 5})[0]
+
+	if !v.Healthy || v.Required != 2 {
+		t.Error("Unexpected status:", v)
+	}
+
+	// if all services are non-critical then they all count
+	v = vipHealth(vip1, []Service{{Address: vip1, Port: 80, NonCritical: true}}, ALL)
+
+	if v.Healthy || v.Critical != 1 {
+		t.Error("Unexpected status:", v)
+	}
+}
+
+func TestThresholdJSON(t *testing.T) {
+	var m map[string]Threshold
+
+	if err := json.Unmarshal([]byte(`{"a": "all", "b": "any", "c": 2}`), &m); err != nil {
+		t.Fatal(err)
+	}
+
+	if m["a"] != ALL || m["b"] != ANY || m["c"] != 2 {
+		t.Error("Unexpected thresholds:", m)
+	}
+
+	if js, _ := json.Marshal(m); string(js) != `{"a":"all","b":"any","c":2}` {
+		t.Error("Unexpected JSON:", string(js))
+	}
+
+	if err := json.Unmarshal([]byte(`{"a": "most"}`), &m); err == nil {
+		t.Error("Invalid threshold accepted")
+	}
+}